@@ -2,42 +2,233 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	_flag "flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math/bits"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 func main() {
 	withLogs := _flag.Bool("logs", false, "whether to show logs.")
+	logFile := _flag.String("log-file", "", "the file to write logs into instead of Stdout, if any.")
+	logLevelName := _flag.String("log-level", "info", "the most verbose logs to show (error, info, or debug).")
+	firstPlayer := _flag.String("first", string(playerWhite), "the side (W or B) that moves first, unless a loaded file says otherwise.")
+	aiPlayer := _flag.String("ai", "", "the side (W or B) played by the AI, if any.")
+	aiTime := _flag.Duration("ai-time", time.Second, "how long the AI may think per move.")
+	aiSeed := _flag.Int64("ai-seed", 0, "the seed the AI breaks ties between equally good moves with, zero for random.")
+	renderMode := _flag.String("render", string(renderAuto), "how to draw the board: full, compact (single-character glyphs), or auto.")
+	compactBelow := _flag.Int("compact-below", fullBoardWidth, "the terminal width below which the auto render mode draws compactly.")
+	cellWidth := _flag.Int("cell-width", 0, "how many columns each square of the board takes, zero for the render mode's default.")
+	notation := _flag.String("notation", string(notationAlgebraic), "how squares are shown: algebraic (ex: B2), or numeric (ex: (1,1)) for debugging.")
+	themeName := _flag.String("theme", "ascii", "the characters to draw the board's borders with (ascii, or unicode for box-drawing characters).")
+	ruleSetName := _flag.String("ruleset", "standard", "the named set of rules to play by (standard, club, or beginner).")
+	noFlagChallenge := _flag.Bool("no-flag-challenge", false, "whether to forbid the Flag from challenging.")
+	loneFlagLoss := _flag.Bool("lone-flag-loss", false, "whether a side left with only a Flag that has no way through loses (a draw if both sides are).")
+	freezeWinners := _flag.Bool("freeze-winners", false, "whether a piece that wins a challenge can't move on its side's next turn.")
+	noChallengeReveal := _flag.Bool("no-challenge-reveal", false, "whether the pieces of a challenge stay unknown to the enemy, rather than the survivor being revealed.")
+	flagGuardWarning := _flag.Bool("flag-guard-warning", false, "whether to warn when a move leaves the side's Flag without any of its pieces next to it.")
+	homeSurvival := _flag.Bool("home-survival", false, "whether a Flag reaching its far rank next to an enemy piece has to survive the enemy's next move to win.")
+	dualHomeDraw := _flag.Bool("dual-home-draw", false, "whether both Flags on their far ranks at once is a draw, rather than a win for the side that moved last.")
+	timeControl := _flag.String("time", "", "how long each side has for all of its moves, if the game is timed (ex: 5m, or 300:120 for time odds in seconds).")
+	maxMoves := _flag.Int("max-moves", 0, "the number of moves after which the game is a draw, zero for unlimited.")
+	setupRanks := _flag.Int("setup-ranks", defaultSetupRanks, "how many ranks at its end of the board each side sets its army up on.")
+	handicap := _flag.String("handicap", "", "pieces a side plays without, if any (ex: W:2*G,COL).")
+	flagScan := _flag.Bool("flag-scan", false, "whether a Flag missing from the board ends the game, rather than only a captured one.")
+	fog := _flag.Bool("fog", false, "whether to hide the enemy pieces of the side to move.")
+	autoFlip := _flag.Bool("auto-flip", false, "whether to turn the board around after every move, so that the side to move's pieces are drawn at the bottom.")
+	scoutPractice := _flag.Bool("scout-practice", false, "whether to practice with the fog of war, revealing a random enemy piece every turn.")
+	seed := _flag.Int64("seed", 0, "the seed for the game's randomness (ex: -scout-practice), zero for random.")
+	lenientImport := _flag.Bool("lenient-import", false, "whether JSON imports accept positions that are missing pieces.")
+	analysis := _flag.Bool("analysis", false, "whether to play in analysis mode, for exploring positions (ex: swapsides).")
+	retryInvalid := _flag.Bool("retry-invalid", false, "whether to prompt again right away after an unknown command or a rejected move, without showing the result.")
+	interactive := _flag.Bool("interactive", false, "whether MV and SET commands can be entered one token at a time, with guidance.")
+	whiteName := _flag.String("white-name", "", "the name of the player playing White, if any.")
+	blackName := _flag.String("black-name", "", "the name of the player playing Black, if any.")
+	scripts := _flag.String("script", "", "comma-separated files of commands, one per line, to run in order at startup, before any input (ex: pieces.txt,moves.txt).")
+	autosave := _flag.Int("autosave", 0, "save the game into "+autosaveFile+" every N moves, zero to never autosave.")
+	traceFile := _flag.String("trace", "", "the file to append the position string to after every move, if any.")
 	_flag.Parse()
 
 	logger := log.New(os.Stdout, "gg: ", log.LstdFlags|log.Lshortfile)
-	if !*withLogs {
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("unable to open -log-file: %v", err)
+		}
+		defer f.Close()
+		logger.SetOutput(f)
+	} else if !*withLogs {
 		logger.SetOutput(io.Discard)
 	}
 
-	in := NewStdinInput()
+	logLevel, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rules, ok := ruleSetProfiles[*ruleSetName]
+	if !ok {
+		log.Fatalf("invalid -ruleset %q, expected standard, club, or beginner", *ruleSetName)
+	}
+
+	// Individual rules are enabled on top of the ruleset.
+	rules.flagChallengeBan = rules.flagChallengeBan || *noFlagChallenge
+	rules.loneFlagLoss = rules.loneFlagLoss || *loneFlagLoss
+	rules.freezeWinners = rules.freezeWinners || *freezeWinners
+	rules.dualHomeDraw = rules.dualHomeDraw || *dualHomeDraw
+	rules.homeSurvival = rules.homeSurvival || *homeSurvival
+	rules.flagGuardWarning = rules.flagGuardWarning || *flagGuardWarning
+	rules.hideChallenges = rules.hideChallenges || *noChallengeReveal
+
+	var whiteTime, blackTime time.Duration
+	if *timeControl != "" {
+		var err error
+		whiteTime, blackTime, err = parseTimeControl(*timeControl)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var handicapPlayer GGPlayer
+	var handicapCodes []GGPieceCode
+	if *handicap != "" {
+		var err error
+		handicapPlayer, handicapCodes, err = parseHandicap(*handicap)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch GGRenderMode(*renderMode) {
+	case renderAuto, renderFull, renderCompact:
+	default:
+		log.Fatalf("invalid -render mode %q, expected full, compact, or auto", *renderMode)
+	}
+
+	switch GGNotation(*notation) {
+	case notationAlgebraic, notationNumeric:
+	default:
+		log.Fatalf("invalid -notation %q, expected algebraic or numeric", *notation)
+	}
+
+	theme, ok := boardThemes[*themeName]
+	if !ok {
+		log.Fatalf("invalid -theme %q, expected ascii or unicode", *themeName)
+	}
+
+	if *firstPlayer != string(playerWhite) && *firstPlayer != string(playerBlack) {
+		log.Fatalf("invalid -first side %q, expected W or B", *firstPlayer)
+	}
+
+	if *aiPlayer != "" && *aiPlayer != string(playerWhite) && *aiPlayer != string(playerBlack) {
+		log.Fatalf("invalid -ai side %q, expected W or B", *aiPlayer)
+	}
+
+	var in Input = NewStdinInput()
 	out := NewStdoutOutput()
-	gui := NewConsoleGUI(out)
-	gg := NewGG(logger, in, out, gui)
+	if *interactive {
+		in = NewInteractiveInput(in, out)
+	}
+	gui := NewConsoleGUI(out, ConsoleGUIOptions{
+		mode:         GGRenderMode(*renderMode),
+		terminal:     EnvTerminal{},
+		compactBelow: *compactBelow,
+		cellWidth:    *cellWidth,
+		theme:        theme,
+	})
 
-	gg.Start()
+	var trace io.Writer
+	if *traceFile != "" {
+		f, err := os.OpenFile(*traceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("unable to open -trace: %v", err)
+		}
+		defer f.Close()
+		trace = f
+	}
 
-	for gg.MainLoop() {
-		gg.DrawBoard()
-		gg.GetCommand()
-		gg.ResolveCommand()
-		gg.DetermineResult()
-		gg.ShowResult()
+	// Every game of the session autosaves into the same file, so they share a single autosaver.
+	var autosaver *GGAutosaver
+	if *autosave > 0 {
+		autosaver = NewGGAutosaver(autosaveFile, *autosave, NewGGLogger(logger, logLevel))
+	}
+
+	// Every game of the session is played with the same options.
+	manager := NewGGManager(func() *GG {
+		gg := NewGG(logger, in, out, gui)
+		gg.SetLogLevel(logLevel)
+		gg.SetRules(rules)
+		gg.SetFirstPlayer(GGPlayer(*firstPlayer))
+		gg.SetPlayerNames(*whiteName, *blackName)
+		gg.SetNotation(GGNotation(*notation))
+		gg.SetMaxMoves(*maxMoves)
+		if *timeControl != "" {
+			gg.SetTimeControl(whiteTime, blackTime)
+		}
+		gg.SetFlagScan(*flagScan)
+		gg.SetAnalysis(*analysis)
+		gg.SetLenientImport(*lenientImport)
+		gg.SetFog(*fog)
+		gg.SetAutoFlip(*autoFlip)
+		gg.SetScoutPractice(*scoutPractice)
+		gg.SetAutosaver(autosaver)
+		gg.SetTrace(trace)
+		if *seed != 0 {
+			gg.SetSeed(*seed)
+		}
+
+		if err := gg.SetSetupRanks(*setupRanks); err != nil {
+			log.Fatalf("invalid -setup-ranks: %v", err)
+		}
+
+		if handicapPlayer != "" {
+			if err := gg.SetHandicap(handicapPlayer, handicapCodes); err != nil {
+				log.Fatalf("invalid -handicap: %v", err)
+			}
+		}
+
+		if *aiPlayer != "" {
+			engine := NewGGEngine(GGPlayer(*aiPlayer), *aiTime)
+			if *aiSeed != 0 {
+				engine.SetSeed(*aiSeed)
+			}
+			gg.SetEngine(engine)
+		}
+
+		return gg
+	})
+
+	if *scripts != "" {
+		for _, path := range strings.Split(*scripts, ",") {
+			if err := manager.RunScript(path); err != nil {
+				log.Fatalf("unable to run -script: %v", err)
+			}
+		}
 	}
 
+	manager.Play(*retryInvalid)
+
 	// TODO: Implement graceful shutdown (ex: CTRL+C from Stdout).
-	gg.Quit()
+	manager.Quit()
 }
 
 // ==============================================================================
@@ -45,24 +236,134 @@ func main() {
 // ==============================================================================
 const (
 	// Commands.
-	cmdHelp       = "help"
-	cmdInvalid    = "invalid"
-	cmdExit       = "exit"
-	cmdLoadSample = "loadsample"
+	cmdHelp        = "help"
+	cmdInvalid     = "invalid"
+	cmdExit        = "exit"
+	cmdLoadSample  = "loadsample"
+	cmdSet         = "SET"
+	cmdMove        = "MV"
+	cmdStart       = "start"
+	cmdValidate    = "validate"
+	cmdTimeline    = "timeline"
+	cmdExport      = "export"
+	cmdRotate      = "rotate"
+	cmdTry         = "try"
+	cmdNewGame     = "newgame"
+	cmdGame        = "game"
+	cmdGames       = "games"
+	cmdSaveBin     = "savebin"
+	cmdLoadBin     = "loadbin"
+	cmdHeatmap     = "heatmap"
+	cmdStats       = "stats"
+	cmdRewind      = "rewind"
+	cmdFairness    = "fairness"
+	cmdOfferDraw   = "offerdraw"
+	cmdAcceptDraw  = "acceptdraw"
+	cmdDeclineDraw = "declinedraw"
+	cmdPuzzle      = "puzzle"
+	cmdSwapSides   = "swapsides"
+	cmdNote        = "note"
+	cmdSetup       = "setup"
+	cmdRestart     = "restart"
+	cmdDefense     = "defense"
+	cmdRuleSet     = "ruleset"
+	cmdCompare     = "compare"
+	cmdImport      = "import"
+	cmdKnown       = "known"
+	cmdUndo        = "undo"
+	cmdUndoTo      = "undoto"
+	cmdRedo        = "redo"
+	cmdLegend      = "legend"
+	cmdAnalyze     = "analyze"
+	cmdShare       = "share"
+	cmdOpen        = "open"
+	cmdRank        = "rank"
+	cmdOpenings    = "openings"
+	cmdFog         = "fog"
+	cmdSuggest     = "suggest"
+	cmdBattles     = "battles"
+	cmdDistances   = "distances"
+	cmdAIStats     = "ai-stats"
+	cmdReview      = "review"
+	cmdPaste       = "paste"
+	cmdFlagThreats = "flagthreats"
+	cmdNotation    = "notation"
+	cmdAtomic      = "atomic"
+	cmdEndAtomic   = "endatomic"
+	cmdEval        = "eval"
+	cmdWait        = "wait"
+	cmdCount       = "count"
+	cmdBarrier     = "barrier"
+	cmdForks       = "forks"
+	cmdLint        = "lint"
+	cmdShuffle     = "shuffle"
+	cmdDone        = "done"
 
 	// File paths.
 	sampleGggnFile = "setup.gggn"
+	autosaveFile   = "autosave.ggb"
+
+	// Binary save format, a magic string followed by a version byte.
+	binaryMagic   = "GGB"
+	binaryVersion = 1
+
+	// Game files, as tallied by the openings command, and how many of each side's first moves it tallies.
+	gggnExtension = ".gggn"
+	openingMoves  = 3
+
+	// Frames written by the export frames command (ex: "frame-07.txt").
+	framePrefix    = "frame-"
+	frameExtension = ".txt"
+
+	// File directives (ex: "#@first B").
+	directivePrefix = "#@"
+	directiveFirst  = "first"
+	directiveGoal   = "goal"
+
+	// Attaches a note to the game after the given number of moves (ex: "#@note 2 a bold opening"). A note
+	// without a number is attached before the first move.
+	directiveNote = "note"
+
+	// Lists a player's pieces that the other player has seen, by their squares once every move is made
+	// (ex: "#@revealed B A8 H8"). Challenges made by the moves in the file reveal pieces on their own.
+	directiveRevealed = "revealed"
+
+	// Seeds the game's randomness before the file's game begins (ex: "#@seed 42"), so that it plays out
+	// the same way every time the file is loaded.
+	directiveSeed = "seed"
+
+	// Lists the squares that are barriers, which no piece may enter (ex: "#@barrier D4 F5").
+	directiveBarrier = "barrier"
+
+	// Pauses the replay of the file's moves for a while at that point (ex: "#@wait 2s"), for pacing demos.
+	directiveWait = "wait"
+
+	// Puzzle goals (ex: "#@goal win-in 3").
+	goalCaptureFlag GGGoalType = "capture-flag-in"
+	goalWin         GGGoalType = "win-in"
 
 	// Board dimensions.
 	rows  = 8
 	files = 9
 
+	// How many ranks at its end of the board each side sets its army up on, unless -setup-ranks says otherwise.
+	defaultSetupRanks = 3
+
 	// Game states.
 	gamePreSetup   GGGameState = "PRE_SETUP"
 	gameSetup      GGGameState = "SETUP"
 	gameInProgress GGGameState = "IN_PROGRESS"
 	gameOver       GGGameState = "GAME_OVER"
 
+	// Reasons a game ended.
+	endFlagCaptured  GGEndReason = "flag captured"
+	endFlagHome      GGEndReason = "flag reached the other side"
+	endBothFlagsHome GGEndReason = "both flags reached the other side"
+	endStalemate     GGEndReason = "stalemate"
+	endMoveLimit     GGEndReason = "move limit reached"
+	endAgreement     GGEndReason = "agreed by both players"
+	endTimeout       GGEndReason = "time ran out"
+
 	// Pieces
 	fiveStarGeneral  GGPieceCode = "5*G"
 	fourStarGeneral  GGPieceCode = "4*G"
@@ -80,6 +381,9 @@ const (
 	spy              GGPieceCode = "SPY"
 	flag             GGPieceCode = "FLG"
 
+	// Shown in place of the enemy pieces hidden by the fog of war.
+	hidden GGPieceCode = "???"
+
 	// Movements
 	moveMove      GGMoveType = "MOVE"
 	moveChallenge GGMoveType = "CHALLENGE"
@@ -93,6 +397,39 @@ const (
 	// Players
 	playerWhite GGPlayer = "W"
 	playerBlack GGPlayer = "B"
+
+	// Render modes.
+	renderAuto    GGRenderMode = "auto"
+	renderFull    GGRenderMode = "full"
+	renderCompact GGRenderMode = "compact"
+
+	// Coordinate notations: algebraic files and ranks (ex: "B2"), or the board's (row, file) indexes
+	// for debugging (ex: "(1,1)").
+	notationAlgebraic GGNotation = "algebraic"
+	notationNumeric   GGNotation = "numeric"
+
+	// Number of columns taken by the full and compact renderings of the board, and by each of their squares.
+	fullBoardWidth    = 80
+	fullCellWidth     = 7
+	compactBoardWidth = 40
+	compactCellWidth  = 3
+
+	// What the squares that are barriers are filled with when drawn.
+	barrierFill = "#"
+
+	// Interactive input guidance, describing the token a command expects next.
+	guideCommand     = "enter MV or SET"
+	guideOrigin      = "enter origin coordinate"
+	guideDestination = "enter destination coordinate"
+	guidePlayer      = "enter player (W or B)"
+	guideSquare      = "enter coordinate"
+	guidePiece       = "enter piece code"
+
+	// AI search limits, and how long the AI thinks about the moves it suggests.
+	maxSearchDepth = 32
+	suggestBudget  = time.Second
+	maxScore       = 1 << 30
+	winScore       = 1 << 20
 )
 
 // ==============================================================================
@@ -100,8 +437,129 @@ const (
 // ==============================================================================
 var (
 	// Regexp
-	setCmdRegex = regexp.MustCompile(`^SET [WB] [ABCDEFGHI][12345678] .{3}$`)
-	mvCmdRegex  = regexp.MustCompile(`^MV [ABCDEFGHI][12345678] [ABCDEFGHI][12345678]$`)
+	setCmdRegex     = regexp.MustCompile(`^SET [WBwb] [ABCDEFGHI][12345678] .{3}$`)
+	mvCmdRegex      = regexp.MustCompile(`^MV [ABCDEFGHI][12345678] [ABCDEFGHI][12345678]$`)
+	csvCmdRegex     = regexp.MustCompile(`^export csv \S+$`)
+	framesCmdRegex  = regexp.MustCompile(`^export frames \S+$`)
+	jsonExportRegex = regexp.MustCompile(`^export json \S+$`)
+	gggnExportRegex = regexp.MustCompile(`^export gggn \S+$`)
+	pgnExportRegex  = regexp.MustCompile(`^export pgn \S+$`)
+	jsonCmdRegex    = regexp.MustCompile(`^import json \S+$`)
+	pgnCmdRegex     = regexp.MustCompile(`^import pgn \S+$`)
+	pgnTagRegex     = regexp.MustCompile(`^\[([A-Za-z]+) "(.*)"\]$`)
+	pgnMoveRegex    = regexp.MustCompile(`^([A-I][1-8])([-x])([A-I][1-8])$`)
+	pgnNumberRegex  = regexp.MustCompile(`^([0-9]+)\.(\.\.)?$`)
+	openCmdRegex    = regexp.MustCompile(`^open [A-Za-z0-9_-]+$`)
+	saveBinCmdRegex = regexp.MustCompile(`^savebin \S+$`)
+	loadBinCmdRegex = regexp.MustCompile(`^loadbin \S+$`)
+	puzzleCmdRegex  = regexp.MustCompile(`^puzzle \S+$`)
+	lintCmdRegex    = regexp.MustCompile(`^lint \S+$`)
+	compareCmdRegex = regexp.MustCompile(`^compare \S+ \S+$`)
+	defenseCmdRegex = regexp.MustCompile(`^defense( [WB])?$`)
+	flagThreatRegex = regexp.MustCompile(`^flagthreats( [WB])?$`)
+	undoToCmdRegex  = regexp.MustCompile(`^undoto \d+$`)
+	noteCmdRegex    = regexp.MustCompile(`^note .+$`)
+	rankCmdRegex    = regexp.MustCompile(`^rank \S+$`)
+	openingsRegex   = regexp.MustCompile(`^openings \S+$`)
+	fogCmdRegex     = regexp.MustCompile(`^fog (on|off)$`)
+	notationRegex   = regexp.MustCompile(`^notation (algebraic|numeric)$`)
+	rewindCmdRegex  = regexp.MustCompile(`^rewind \d+$`)
+	waitCmdRegex    = regexp.MustCompile(`^wait \S+$`)
+	barrierCmdRegex = regexp.MustCompile(`^barrier [ABCDEFGHI][12345678]$`)
+	shuffleCmdRegex = regexp.MustCompile(`^shuffle [WB]$`)
+	tryCmdRegex     = regexp.MustCompile(`^try MV [ABCDEFGHI][12345678] [ABCDEFGHI][12345678]$`)
+
+	coordinatesRegex   = regexp.MustCompile(`^[ABCDEFGHI][12345678]$`)
+	numericSquareRegex = regexp.MustCompile(`^\((\d+),(\d+)\)$`)
+
+	// The tokens of the commands that take squares, by their position, where either notation is accepted.
+	squareTokens = map[string][]int{
+		cmdSet:     {2},
+		cmdMove:    {1, 2},
+		cmdTry:     {2, 3},
+		cmdBarrier: {1},
+	}
+
+	// The (row, file) steps a piece can move by: forward, backward, and sideways.
+	directions = [][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}}
+
+	// Named combinations of optional rules.
+	ruleSetProfiles = map[string]GGRuleSet{
+		"standard": {},
+		"club":     {flagChallengeBan: true, loneFlagLoss: true},
+		"beginner": {flagChallengeBan: true, flagGuardWarning: true},
+	}
+
+	// Named sets of characters to draw the board's borders with.
+	boardThemes = map[string]GGBoardTheme{
+		"ascii":   asciiTheme,
+		"unicode": {horizontal: "─", vertical: "│", corner: "┼", rule: "═"},
+	}
+	asciiTheme = GGBoardTheme{horizontal: "-", vertical: "|", corner: " ", rule: "="}
+
+	// Every piece code, from the highest rank to the lowest.
+	pieceCodes = []GGPieceCode{
+		fiveStarGeneral,
+		fourStarGeneral,
+		threeStarGeneral,
+		twoStarGeneral,
+		oneStarGeneral,
+		colonel,
+		ltColonel,
+		major,
+		captain,
+		firstLt,
+		secondLt,
+		sergeant,
+		private,
+		spy,
+		flag,
+	}
+
+	// How many of each piece a player's army has.
+	roster = map[GGPieceCode]int{
+		fiveStarGeneral:  1,
+		fourStarGeneral:  1,
+		threeStarGeneral: 1,
+		twoStarGeneral:   1,
+		oneStarGeneral:   1,
+		colonel:          1,
+		ltColonel:        1,
+		major:            1,
+		captain:          1,
+		firstLt:          1,
+		secondLt:         1,
+		sergeant:         1,
+		private:          6,
+		spy:              2,
+		flag:             1,
+	}
+
+	// The full name of each piece.
+	pieceNames = map[GGPieceCode]string{
+		fiveStarGeneral:  "General of the Army",
+		fourStarGeneral:  "General",
+		threeStarGeneral: "Lieutenant General",
+		twoStarGeneral:   "Major General",
+		oneStarGeneral:   "Brigadier General",
+		colonel:          "Colonel",
+		ltColonel:        "Lieutenant Colonel",
+		major:            "Major",
+		captain:          "Captain",
+		firstLt:          "First Lieutenant",
+		secondLt:         "Second Lieutenant",
+		sergeant:         "Sergeant",
+		private:          "Private",
+		spy:              "Spy",
+		flag:             "Flag",
+	}
+
+	// The exceptions to the hierarchy, for the pieces that don't simply beat the ones below them.
+	pieceRules = map[GGPieceCode]string{
+		private: "Only beats the Spy, and loses to every officer.",
+		spy:     "Beats every piece but the Private, which eliminates it.",
+		flag:    "Loses to every piece, but captures the enemy Flag by challenging it. Reaching the far rank (the home run) wins the game.",
+	}
 )
 
 // ==============================================================================
@@ -113,28 +571,289 @@ type GG struct {
 	// Game logic properties.
 	status       GGGameState
 	winner       GGPlayer
+	endReason    GGEndReason
+	firstPlayer  GGPlayer
 	playerToMove GGPlayer
+	ply          int
+	setup        GGBoard
+	events       []GGEvent
+	notes        []GGNote
+	redoMoves    []GGMove
+	startedAt    time.Time
+	redraw       bool
+	rejected     bool
 	board        GGBoard
+	rules        GGRuleSet
+	rosters      map[GGPlayer]map[GGPieceCode]int
+	handicaps    map[GGPlayer][]GGPieceCode
+	setupRanks   int
 	commandStack *GGCommandStack
+	commands     map[string]GGCommandHandler
+
+	// Set when the loaded game is a puzzle.
+	puzzle *GGPuzzle
+
+	// Called after every challenge, in the order they were added.
+	challengeObservers []GGChallengeObserver
+
+	// The file loaded by the loadsample command.
+	sampleFilePath string
+
+	// Display names of the players, if they have any. Shared with the default result formatter.
+	names map[GGPlayer]string
+
+	// Clocks, if the game is timed: how much time each side started with, and has left as of its last move.
+	timeBudgets map[GGPlayer]time.Duration
+	timeLeft    map[GGPlayer]time.Duration
+
+	// When a saved game was loaded, if it was: the turn in progress is timed from then, not from the save.
+	resumedAt time.Time
+
+	// Move limit, zero or less for unlimited.
+	maxPlies int
+
+	// Saves the game every few moves, if autosaving is enabled.
+	autosaver *GGAutosaver
+
+	// Gets the position string after every move, if tracing is enabled.
+	trace io.Writer
+
+	// Draw offers, only one can be pending at a time.
+	drawOfferedBy GGPlayer
+
+	// Flags that reached their far rank next to an enemy piece, waiting to survive the enemy's next move.
+	flagArrivals map[GGPlayer]GGFlagArrival
+
+	// Also ends the game whenever a Flag is missing from the board, not just when one is captured.
+	flagScan bool
+
+	// Fog of war hides the enemy pieces that aren't revealed.
+	fog bool
+
+	// Draws the board from Black's side whenever it's Black's turn, for players sharing a screen.
+	autoFlip bool
+
+	// Scouting practice reveals a random enemy piece at the start of every turn. The reveal at the
+	// start of the game is kept here, and the ones after every move in their events.
+	scoutPractice bool
+	openingScout  *[2]int
+
+	// The game's randomness, and where it's drawn from, so that it can be recorded and restored.
+	rng       *rand.Rand
+	rngSource *GGRandomSource
+
+	// Lenient imports accept positions that are missing pieces (ex: for puzzles).
+	lenientImport bool
+
+	// Analysis mode allows exploring positions outside of real play.
+	analysis bool
+
+	// Built-in command dispatch tables.
+	exactCommands   map[string]func(cmd string)
+	patternCommands []GGPatternCommand
+
+	// How squares are shown to the players. Either notation is accepted as input.
+	notation GGNotation
+
+	// Commands held until the atomic block they're in ends, if one is open.
+	atomic         bool
+	atomicCommands []string
 
 	// Ancillary dependencies.
-	logger *log.Logger
-	in     Input
-	out    Output
-	gui    GUI
+	logger    *GGLogger
+	in        Input
+	out       Output
+	gui       GUI
+	formatter ResultFormatter
+	engine    *GGEngine
+	now       func() time.Time
+	sleep     func(time.Duration)
+
+	// The last search made by the AI, either for its own move or for a suggestion.
+	lastSearch *GGSearchStats
+}
+
+// GGRandomSource is a source of random numbers that counts how many it has drawn, so that its state
+// can be recorded as its seed and that count.
+type GGRandomSource struct {
+	seed  int64
+	draws uint64
+	src   rand.Source64
+}
+
+// NewGGRandomSource initializes a GGRandomSource drawing from the given seed.
+func NewGGRandomSource(seed int64) *GGRandomSource {
+	return &GGRandomSource{seed: seed, src: rand.NewSource(seed).(rand.Source64)}
+}
+
+// Int63 draws a non-negative 63-bit integer.
+func (s *GGRandomSource) Int63() int64 {
+	s.draws++
+	return s.src.Int63()
+}
+
+// Uint64 draws a 64-bit integer. Each draw advances the source by one step, whichever kind it is.
+func (s *GGRandomSource) Uint64() uint64 {
+	s.draws++
+	return s.src.Uint64()
+}
+
+// Seed starts drawing from the given seed over.
+func (s *GGRandomSource) Seed(seed int64) {
+	s.seed = seed
+	s.draws = 0
+	s.src.Seed(seed)
+}
+
+// GGCommandHandler handles a custom command, receiving the game and the full command string.
+type GGCommandHandler func(g *GG, cmd string)
+
+// GGFlagArrival is where and when a Flag reached its far rank.
+type GGFlagArrival struct {
+	x, y int
+	ply  int
+}
+
+// GGPuzzle is a goal to reach within a number of moves.
+type GGPuzzle struct {
+	goal   GGGoalType
+	moves  int
+	solver GGPlayer
+
+	// Set once the puzzle is either solved or failed.
+	outcome  string
+	reported bool
+}
+
+// String returns a user-friendly description of the puzzle's goal.
+func (p *GGPuzzle) String() string {
+	if p.goal == goalCaptureFlag {
+		return fmt.Sprintf("%s to capture the enemy Flag within %d moves", p.solver, p.moves)
+	}
+
+	return fmt.Sprintf("%s to win within %d moves", p.solver, p.moves)
+}
+
+// GGGoalType represents what has to be done to solve a puzzle.
+type GGGoalType string
+
+// GGChallengeObserver is notified of the pieces involved in a challenge and its result.
+type GGChallengeObserver func(challenger GGPiece, target GGPiece, result GGChallengeResult)
+
+// GGPatternCommand is a built-in command matched by a regular expression rather than by its exact text.
+type GGPatternCommand struct {
+	name    string
+	pattern *regexp.Regexp
+	handler func(cmd string)
+}
+
+// GGRuleSet holds the optional (house) rules in effect. The zero value plays by the standard rules.
+type GGRuleSet struct {
+	// Forbids the Flag from challenging, it may only move into empty squares.
+	flagChallengeBan bool
+	// Ends the game for a side whose only remaining piece is a Flag that's blocked from advancing.
+	loneFlagLoss bool
+	// Freezes a piece that wins a challenge, so that it can't move on its side's next turn.
+	freezeWinners bool
+	// Makes it a draw when both Flags are on their far ranks at once, instead of a win for the side that moved last.
+	dualHomeDraw bool
+	// Keeps the pieces of a challenge unknown to the enemy, instead of revealing the one left standing.
+	hideChallenges bool
+	// Makes a Flag that reaches its far rank next to an enemy piece survive the enemy's next move there
+	// before it wins, instead of winning right away.
+	homeSurvival bool
+	// Warns a side whose move leaves its Flag without any of its pieces next to it. The move is still made.
+	flagGuardWarning bool
+}
+
+// GGRuleToggle is an optional rule, named after its command line flag, and whether it's in effect.
+type GGRuleToggle struct {
+	name    string
+	enabled bool
+}
+
+// Toggles lists every optional rule of the ruleset, always in the same order.
+func (r GGRuleSet) Toggles() []GGRuleToggle {
+	return []GGRuleToggle{
+		{name: "no-flag-challenge", enabled: r.flagChallengeBan},
+		{name: "lone-flag-loss", enabled: r.loneFlagLoss},
+		{name: "freeze-winners", enabled: r.freezeWinners},
+		{name: "dual-home-draw", enabled: r.dualHomeDraw},
+		{name: "no-challenge-reveal", enabled: r.hideChallenges},
+		{name: "home-survival", enabled: r.homeSurvival},
+		{name: "flag-guard-warning", enabled: r.flagGuardWarning},
+	}
 }
 
 // GGBoard is a 2D array for GGSquares.
 type GGBoard [rows][files]GGSquare
 
+// Occupancy returns the set of squares occupied by the player's pieces.
+func (b GGBoard) Occupancy(player GGPlayer) GGBitboard {
+	bb := GGBitboard{}
+	for x := range b {
+		for y := range b[x] {
+			if b[x][y].piece.player == player {
+				bb.Set(x, y)
+			}
+		}
+	}
+
+	return bb
+}
+
+// GGBitboard is a set of squares, one bit per square from A1 onwards, rank by rank (A1, B1, ..., I1, A2, ...).
+// The board's 72 squares don't fit into a single uint64, so the bits are split across two of them.
+type GGBitboard [2]uint64
+
+// Set adds the square at the given address to the set.
+func (bb *GGBitboard) Set(x, y int) {
+	i := x*files + y
+	bb[i/64] |= 1 << (i % 64)
+}
+
+// Has checks if the square at the given address is in the set.
+func (bb GGBitboard) Has(x, y int) bool {
+	if !isOnBoard(x, y) {
+		return false
+	}
+
+	i := x*files + y
+	return bb[i/64]&(1<<(i%64)) != 0
+}
+
+// Count returns the number of squares in the set.
+func (bb GGBitboard) Count() int {
+	return bits.OnesCount64(bb[0]) + bits.OnesCount64(bb[1])
+}
+
+// Squares lists the addresses of the squares in the set, from A1 onwards.
+func (bb GGBitboard) Squares() [][2]int {
+	squares := make([][2]int, 0, bb.Count())
+	for word := range bb {
+		for w := bb[word]; w != 0; w &= w - 1 {
+			i := word*64 + bits.TrailingZeros64(w)
+			squares = append(squares, [2]int{i / files, i % files})
+		}
+	}
+
+	return squares
+}
+
 // GGSquare represents a square on the game board.
 type GGSquare struct {
 	piece GGPiece
+
+	// Barriers are never occupied, no piece may enter them.
+	barrier bool
 }
 
 // GGGameState represents the summary of the current game state.
 type GGGameState string
 
+// GGEndReason represents why a game ended.
+type GGEndReason string
+
 // GGChallengeResult represents a result of a piece challenge.
 type GGChallengeResult string
 
@@ -160,6 +879,11 @@ func (s *GGSquare) To(targetSquare GGSquare) GGMoveType {
 	return moveChallenge
 }
 
+// IsEmpty checks if the piece is the zero piece, i.e. no piece at all.
+func (p GGPiece) IsEmpty() bool {
+	return p == (GGPiece{})
+}
+
 // IsEmpty checks if the square is not occupied by a piece.
 func (s *GGSquare) IsEmpty() bool {
 	return s.piece == (GGPiece{})
@@ -174,6 +898,21 @@ func (s *GGSquare) Clear() {
 type GGPiece struct {
 	code   GGPieceCode
 	player GGPlayer
+
+	// Whether the piece is shown to the enemy despite the fog of war.
+	revealed bool
+	// Whether the piece won a challenge and can't move on its side's next turn (see GGRuleSet.freezeWinners).
+	frozen bool
+}
+
+// Code returns the piece's code.
+func (p GGPiece) Code() GGPieceCode {
+	return p.code
+}
+
+// Player returns the player owning the piece.
+func (p GGPiece) Player() GGPlayer {
+	return p.player
 }
 
 // Power returns a numerical representation of a piece's strength.
@@ -201,6 +940,49 @@ func (p GGPiece) Power() int {
 	return piecePowerMap[p.code]
 }
 
+// GGMove represents a single movement of a piece, expressed in square addresses.
+type GGMove struct {
+	fromX, fromY int
+	toX, toY     int
+}
+
+// newMove creates a move between the two given coordinates.
+func newMove(from string, to string) GGMove {
+	fromX, fromY := coordinatesToSquareAddress(from)
+	toX, toY := coordinatesToSquareAddress(to)
+	return GGMove{fromX: fromX, fromY: fromY, toX: toX, toY: toY}
+}
+
+// String returns the move in its command form (ex: "MV A3 A4").
+func (m GGMove) String() string {
+	return fmt.Sprintf("%s %s %s", cmdMove, squareAddressToCoordinates(m.fromX, m.fromY), squareAddressToCoordinates(m.toX, m.toY))
+}
+
+// GGEvent is the record of a move made during the game.
+type GGEvent struct {
+	ply      int
+	player   GGPlayer
+	move     GGMove
+	moveType GGMoveType
+
+	// Only set for challenges.
+	challenger GGPiece
+	target     GGPiece
+	result     GGChallengeResult
+
+	// The square of the enemy piece that scouting practice revealed once the move was made, if any.
+	scouted *[2]int
+
+	time time.Time
+}
+
+// GGNote is a comment attached to the game after the given number of moves (plies).
+type GGNote struct {
+	ply  int
+	text string
+	time time.Time
+}
+
 // GGPieceCode represents a piece code (ex: "FLG" for Flag).
 type GGPieceCode string
 
@@ -218,6 +1000,15 @@ func (p GGPlayer) String() string {
 	return ""
 }
 
+// Opponent returns the other player.
+func (p GGPlayer) Opponent() GGPlayer {
+	if p == playerWhite {
+		return playerBlack
+	}
+
+	return playerWhite
+}
+
 // GGCommandStack is an append-only, head-only read store for player commands.
 type GGCommandStack struct {
 	commands []string
@@ -244,403 +1035,5816 @@ func (s *GGCommandStack) Read() string {
 
 // NewGG initializes a new GG instance.
 func NewGG(logger *log.Logger, in Input, out Output, gui GUI) *GG {
-	return &GG{
+	names := map[GGPlayer]string{}
+	g := &GG{
 		// Game logic properties.
 		status:       gamePreSetup,
 		board:        GGBoard{},
+		rosters:      standardRosters(),
+		handicaps:    map[GGPlayer][]GGPieceCode{},
+		setupRanks:   defaultSetupRanks,
 		commandStack: &GGCommandStack{},
+		commands:     map[string]GGCommandHandler{},
+		firstPlayer:  playerWhite,
 		playerToMove: playerWhite,
+		redraw:       true,
+		flagArrivals: map[GGPlayer]GGFlagArrival{},
+		notation:     notationAlgebraic,
+
+		sampleFilePath: sampleGggnFile,
+		names:          names,
 
 		// Ancillary dependencies.
-		logger: logger,
-		in:     in,
-		out:    out,
-		gui:    gui,
+		logger:    NewGGLogger(logger, logInfo),
+		in:        in,
+		out:       out,
+		gui:       gui,
+		formatter: DefaultResultFormatter{names: names},
+		now:       time.Now,
+		sleep:     time.Sleep,
 	}
-}
+	g.SetSeed(time.Now().UnixNano())
 
-// Start kicks off any processes to start a GG game.
-func (g *GG) Start() {
-	g.logger.Println("starting GG...")
-	g.HandleHelp()
-	g.status = gameSetup
-}
+	g.exactCommands = map[string]func(cmd string){
+		cmdExit:        func(string) { g.HandleExit() },
+		cmdHelp:        func(string) { g.HandleHelp() },
+		cmdLoadSample:  func(string) { g.HandleLoadSample() },
+		cmdStart:       func(string) { g.HandleStart() },
+		cmdValidate:    func(string) { g.HandleValidate() },
+		cmdTimeline:    func(string) { g.HandleTimeline() },
+		cmdRotate:      func(string) { g.HandleRotate() },
+		cmdHeatmap:     func(string) { g.HandleHeatmap() },
+		cmdStats:       func(string) { g.HandleStats() },
+		cmdFairness:    func(string) { g.HandleFairness() },
+		cmdOfferDraw:   func(string) { g.HandleOfferDraw() },
+		cmdAcceptDraw:  func(string) { g.HandleRespondDraw(true) },
+		cmdDeclineDraw: func(string) { g.HandleRespondDraw(false) },
+		cmdSwapSides:   func(string) { g.HandleSwapSides() },
+		cmdSetup:       func(string) { g.HandleSetup() },
+		cmdRestart:     func(string) { g.HandleRestart() },
+		cmdRuleSet:     func(string) { g.HandleRuleSet() },
+		cmdKnown:       func(string) { g.HandleKnown() },
+		cmdUndo:        func(string) { g.HandleUndo() },
+		cmdRedo:        func(string) { g.HandleRedo() },
+		cmdLegend:      func(string) { g.HandleLegend() },
+		cmdAnalyze:     func(string) { g.HandleAnalyze() },
+		cmdShare:       func(string) { g.HandleShare() },
+		cmdSuggest:     func(string) { g.HandleSuggest() },
+		cmdBattles:     func(string) { g.HandleBattles() },
+		cmdDistances:   func(string) { g.HandleDistances() },
+		cmdAIStats:     func(string) { g.HandleAIStats() },
+		cmdReview:      func(string) { g.HandleReview() },
+		cmdPaste:       func(string) { g.HandlePaste() },
+		cmdAtomic:      func(string) { g.HandleAtomic() },
+		cmdEndAtomic:   func(string) { g.HandleEndAtomic() },
+		cmdEval:        func(string) { g.HandleEval() },
+		cmdCount:       func(string) { g.HandleCount() },
+		cmdForks:       func(string) { g.HandleForks() },
+	}
 
-// Close terminates the game.
-func (g *GG) Close() {
-	g.logger.Println("Closing GG...")
-}
+	// Patterns are tried in order, first match wins.
+	g.patternCommands = []GGPatternCommand{
+		{name: cmdSet, pattern: setCmdRegex, handler: g.HandleSet},
+		{name: cmdMove, pattern: mvCmdRegex, handler: g.HandleMove},
+		{name: cmdExport, pattern: csvCmdRegex, handler: g.HandleExportCSV},
+		{name: cmdExport, pattern: framesCmdRegex, handler: g.HandleExportFrames},
+		{name: cmdExport, pattern: jsonExportRegex, handler: g.HandleExportPosition},
+		{name: cmdExport, pattern: gggnExportRegex, handler: g.HandleExportPosition},
+		{name: cmdExport, pattern: pgnExportRegex, handler: g.HandleExportTranscript},
+		{name: cmdImport, pattern: jsonCmdRegex, handler: g.HandleImportJSON},
+		{name: cmdImport, pattern: pgnCmdRegex, handler: g.HandleImportPGN},
+		{name: cmdOpen, pattern: openCmdRegex, handler: g.HandleOpen},
+		{name: cmdTry, pattern: tryCmdRegex, handler: g.HandleTry},
+		{name: cmdRewind, pattern: rewindCmdRegex, handler: g.HandleRewind},
+		{name: cmdWait, pattern: waitCmdRegex, handler: g.HandleWait},
+		{name: cmdBarrier, pattern: barrierCmdRegex, handler: g.HandleBarrier},
+		{name: cmdShuffle, pattern: shuffleCmdRegex, handler: g.HandleShuffle},
+		{name: cmdUndoTo, pattern: undoToCmdRegex, handler: g.HandleUndoTo},
+		{name: cmdPuzzle, pattern: puzzleCmdRegex, handler: g.HandlePuzzle},
+		{name: cmdLint, pattern: lintCmdRegex, handler: g.HandleLint},
+		{name: cmdNote, pattern: noteCmdRegex, handler: g.HandleNote},
+		{name: cmdRank, pattern: rankCmdRegex, handler: g.HandleRank},
+		{name: cmdFog, pattern: fogCmdRegex, handler: g.HandleFog},
+		{name: cmdNotation, pattern: notationRegex, handler: g.HandleNotation},
+		{name: cmdDefense, pattern: defenseCmdRegex, handler: g.HandleDefense},
+		{name: cmdFlagThreats, pattern: flagThreatRegex, handler: g.HandleFlagThreats},
+		{name: cmdCompare, pattern: compareCmdRegex, handler: g.HandleCompare},
+		{name: cmdOpenings, pattern: openingsRegex, handler: g.HandleOpenings},
+		{name: cmdSaveBin, pattern: saveBinCmdRegex, handler: g.HandleSaveBin},
+		{name: cmdLoadBin, pattern: loadBinCmdRegex, handler: g.HandleLoadBin},
+	}
 
-// MainLoop is the game's main loop, returning whether the game is finished or not.
-func (g *GG) MainLoop() bool {
-	return g.status != gameOver
+	return g
 }
 
-// DrawBoard displays a graphical representation of the current game state.
-func (g *GG) DrawBoard() {
-	g.logger.Println("drawing board.")
-	g.gui.Draw(g.board)
-}
+// RegisterCommand adds a custom command, invoked when the first token of a command matches the given name.
+// Built-in commands take precedence and can't be overridden.
+func (g *GG) RegisterCommand(name string, handler GGCommandHandler) error {
+	if g.isBuiltinCommand(name) {
+		return fmt.Errorf("command %q is a built-in command", name)
+	}
 
-// GetCommand fetches the next player's command and stores it into the command stack.
-func (g *GG) GetCommand() {
-	g.logger.Println("fetching player command.")
+	if _, ok := g.commands[name]; ok {
+		return fmt.Errorf("command %q is already registered", name)
+	}
 
-	g.out.Write("Enter command: ")
-	cmd := g.in.Read()
-	g.commandStack.Append(cmd)
+	g.commands[name] = handler
+	return nil
 }
 
-// ResolveCommand reads the last command and invokes the appropriate handler.
-func (g *GG) ResolveCommand() {
-	cmd := g.commandStack.Read()
-
-	if cmd == cmdExit {
-		g.HandleExit()
-	} else if cmd == cmdHelp {
-		g.HandleHelp()
-	} else if cmd == cmdLoadSample {
-		g.HandleLoadSample()
-	} else if setCmdRegex.FindString(cmd) != "" {
-		g.HandleSet(cmd)
-	} else if mvCmdRegex.FindString(cmd) != "" {
-		g.HandleMove(cmd)
-	} else {
-		g.HandleInvalid()
+// isBuiltinCommand checks if the given name is reserved by a built-in command.
+func (g *GG) isBuiltinCommand(name string) bool {
+	if name == cmdInvalid {
+		return true
 	}
-}
-
-// DetermineResult calculates the game's result from the current game state.
-func (g *GG) DetermineResult() {
-	g.logger.Println("determining result.")
-
-	// Find both flags, and update the game status if one of them are not found.
-	if g.status == gameInProgress {
-		whiteFlagFound := false
-		blackFlagFound := false
 
-		for _, row := range g.board {
-			for _, square := range row {
-				if square.piece.code == flag {
-					if square.piece.player == playerWhite {
-						whiteFlagFound = true
-					} else if square.piece.player == playerBlack {
-						blackFlagFound = true
-					}
-				}
-			}
-		}
+	if _, ok := g.exactCommands[name]; ok {
+		return true
+	}
 
-		if whiteFlagFound && !blackFlagFound {
-			g.winner = playerWhite
-			g.status = gameOver
-		} else if blackFlagFound && !whiteFlagFound {
-			g.winner = playerBlack
-			g.status = gameOver
+	for _, c := range g.patternCommands {
+		if c.name == name {
+			return true
 		}
 	}
 
-	// Check the 8th rank for the white flag.
-	for _, square := range g.board[7] {
-		if square.piece.player == playerWhite && square.piece.code == flag {
-			g.status = gameOver
-			g.winner = playerWhite
-		}
+	return false
+}
+
+// SetRules changes the optional rules in effect.
+func (g *GG) SetRules(rules GGRuleSet) {
+	g.rules = rules
+}
+
+// SetHandicap has the given player play without the given pieces. The Flag can never be given up.
+func (g *GG) SetHandicap(player GGPlayer, codes []GGPieceCode) error {
+	reduced := map[GGPieceCode]int{}
+	for code, n := range g.rosters[player] {
+		reduced[code] = n
 	}
 
-	// Check the 1st rank for the black flag.
-	for _, square := range g.board[0] {
-		if square.piece.player == playerBlack && square.piece.code == flag {
-			g.status = gameOver
-			g.winner = playerBlack
+	for _, code := range codes {
+		if code == flag {
+			return errors.New("the Flag can't be handicapped")
 		}
+		if reduced[code] == 0 {
+			return fmt.Errorf("%s has no %s to give up", player, code)
+		}
+		reduced[code]--
 	}
+
+	g.rosters[player] = reduced
+	g.handicaps[player] = append(g.handicaps[player], codes...)
+	return nil
 }
 
-// ShowResult reports the "result" (i.e. what next step is needed) of the current game state.
-func (g *GG) ShowResult() {
-	g.logger.Println("showing result.")
+// SetSetupRanks changes how many ranks at its end of the board each side sets its army up on.
+// Both sides' ranks have to fit on the board without overlapping.
+func (g *GG) SetSetupRanks(n int) error {
+	if n < 1 {
+		return fmt.Errorf("%d ranks can't hold an army", n)
+	}
+	if 2*n > rows {
+		return fmt.Errorf("%d ranks for each side overlap on a board of %d ranks", n, rows)
+	}
+
+	g.setupRanks = n
+	return nil
+}
+
+// inSetupRanks checks if the rank with the given index is one of the ranks the player sets up on.
+func (g *GG) inSetupRanks(player GGPlayer, x int) bool {
+	if player == playerBlack {
+		return x >= rows-g.setupRanks
+	}
+
+	return x < g.setupRanks
+}
+
+// removeHandicaps takes the handicapped pieces off the board, for setups that include the full armies.
+func (g *GG) removeHandicaps(board *GGBoard) {
+	for player, codes := range g.handicaps {
+		for _, code := range codes {
+			removePiece(board, GGPiece{code: code, player: player})
+		}
+	}
+}
+
+// removePiece clears the first square, from A1 onwards, holding the given piece.
+func removePiece(board *GGBoard, piece GGPiece) {
+	for x := range board {
+		for y := range board[x] {
+			if board[x][y].piece == piece {
+				board[x][y].Clear()
+				return
+			}
+		}
+	}
+}
+
+// OnChallenge adds an observer to be notified after every challenge.
+func (g *GG) OnChallenge(observer GGChallengeObserver) {
+	g.challengeObservers = append(g.challengeObservers, observer)
+}
+
+// SetLogLevel changes the most verbose level of messages that get logged.
+func (g *GG) SetLogLevel(level GGLogLevel) {
+	g.logger.level = level
+}
+
+// SetSampleFilePath changes the file loaded by the loadsample command.
+func (g *GG) SetSampleFilePath(path string) {
+	g.sampleFilePath = path
+}
+
+// SetPlayerNames gives the players names to be shown along with their colors, empty for none.
+func (g *GG) SetPlayerNames(white string, black string) {
+	g.names[playerWhite] = white
+	g.names[playerBlack] = black
+}
+
+// playerName returns how the player is shown: their name and color (ex: "Alice (White)"), or just
+// their color if they don't have a name.
+func (g *GG) playerName(p GGPlayer) string {
+	return displayName(p, g.names)
+}
+
+// SetFirstPlayer makes the given side move first, in games started after a setup or loaded from files
+// that don't say otherwise.
+func (g *GG) SetFirstPlayer(player GGPlayer) {
+	g.firstPlayer = player
+	g.playerToMove = player
+}
+
+// SetTimeControl times the game, giving each side the given amount of time for all of its moves.
+// The sides can be given different amounts (time odds). A side that runs out of time loses.
+func (g *GG) SetTimeControl(white time.Duration, black time.Duration) {
+	g.timeBudgets = map[GGPlayer]time.Duration{playerWhite: white, playerBlack: black}
+	g.timeLeft = map[GGPlayer]time.Duration{playerWhite: white, playerBlack: black}
+}
+
+// SetMaxMoves limits the game to the given number of moves (plies), after which it's a draw.
+// Zero or less means unlimited.
+func (g *GG) SetMaxMoves(n int) {
+	g.maxPlies = n
+}
+
+// SetTrace has the position string written into the given writer, one per line, after every move
+// made; nil to stop tracing. The moves replayed when undoing aren't written again.
+func (g *GG) SetTrace(w io.Writer) {
+	g.trace = w
+}
+
+// SetAutosaver has the game saved by the given autosaver every few moves, nil to never autosave.
+func (g *GG) SetAutosaver(a *GGAutosaver) {
+	g.autosaver = a
+}
+
+// SetFlagScan enables or disables ending the game whenever a Flag is missing from the board,
+// even if it wasn't captured (ex: a board that's still being set up).
+func (g *GG) SetFlagScan(enabled bool) {
+	g.flagScan = enabled
+}
+
+// SetFog enables or disables the fog of war, hiding the enemy pieces of the side to move.
+func (g *GG) SetFog(enabled bool) {
+	g.fog = enabled
+}
+
+// SetAutoFlip enables or disables turning the board around on Black's turns, so that each side
+// sees its own pieces at the bottom when it's to move.
+func (g *GG) SetAutoFlip(enabled bool) {
+	g.autoFlip = enabled
+}
+
+// SetNotation sets how squares are shown to the players. Files and exports always use the algebraic notation.
+func (g *GG) SetNotation(notation GGNotation) {
+	g.notation = notation
+}
+
+// SetScoutPractice enables or disables scouting practice, a non-competitive mode that reveals
+// a random enemy piece at the start of every turn. The fog of war is enabled along with it.
+func (g *GG) SetScoutPractice(enabled bool) {
+	g.scoutPractice = enabled
+	if enabled {
+		g.fog = true
+	}
+}
+
+// SetSeed makes the game's randomness (ex: scouting practice) play out the same way every time.
+func (g *GG) SetSeed(seed int64) {
+	g.restoreRandomness(seed, 0)
+}
+
+// restoreRandomness puts the game's randomness back to how it was after drawing from the given seed the
+// given number of times, so that it carries on with the same random choices as before.
+func (g *GG) restoreRandomness(seed int64, draws uint64) {
+	g.rngSource = NewGGRandomSource(seed)
+	for g.rngSource.draws < draws {
+		g.rngSource.Uint64()
+	}
+	g.rng = rand.New(g.rngSource)
+}
+
+// SetLenientImport enables or disables importing positions in which the armies are missing pieces.
+func (g *GG) SetLenientImport(enabled bool) {
+	g.lenientImport = enabled
+}
+
+// SetAnalysis enables or disables analysis mode.
+func (g *GG) SetAnalysis(enabled bool) {
+	g.analysis = enabled
+}
+
+// SetClock replaces the clock used for timestamping moves.
+func (g *GG) SetClock(now func() time.Time) {
+	g.now = now
+}
+
+// SetSleeper replaces how the game pauses for wait commands and directives.
+func (g *GG) SetSleeper(sleep func(time.Duration)) {
+	g.sleep = sleep
+}
+
+// EndReason returns why the game ended, empty if it hasn't.
+func (g *GG) EndReason() GGEndReason {
+	return g.endReason
+}
+
+// Result returns the winner, empty for a draw, why the game ended and whether it has.
+// While the game is ongoing, or if it was left with the exit command, none of them are set.
+func (g *GG) Result() (GGPlayer, GGEndReason, bool) {
+	if g.status != gameOver || g.endReason == "" {
+		return "", "", false
+	}
+
+	return g.winner, g.endReason, true
+}
+
+// SetResultFormatter replaces how the result of a finished game is announced.
+func (g *GG) SetResultFormatter(formatter ResultFormatter) {
+	g.formatter = formatter
+}
+
+// SetGUI switches the game to drawing with the given GUI, starting with a redraw of the board.
+func (g *GG) SetGUI(gui GUI) {
+	g.gui = gui
+	g.redraw = true
+}
+
+// SetEngine lets the given AI play its side of the game.
+func (g *GG) SetEngine(engine *GGEngine) {
+	g.engine = engine
+}
+
+// commandNames lists the names of every command the game understands, sorted.
+func (g *GG) commandNames() []string {
+	names := []string{}
+	for name := range g.exactCommands {
+		names = append(names, name)
+	}
+	for _, c := range g.patternCommands {
+		names = append(names, c.name)
+	}
+	for name := range g.commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// PieceAt returns the piece on the given coordinates (ex: "B7"), and whether there's a piece there at all.
+func (g *GG) PieceAt(coordinates string) (GGPiece, bool, error) {
+	x, y, err := parseCoordinates(coordinates)
+	if err != nil {
+		return GGPiece{}, false, err
+	}
+
+	square := g.board[x][y]
+	return square.piece, !square.IsEmpty(), nil
+}
+
+// Start kicks off any processes to start a GG game.
+func (g *GG) Start() {
+	g.logger.Infof("starting GG...")
+	g.HandleHelp()
+	g.status = gameSetup
+	g.redraw = true
+}
+
+// Close terminates the game.
+func (g *GG) Close() {
+	g.logger.Infof("Closing GG...")
+}
+
+// MainLoop is the game's main loop, returning whether the game is finished or not.
+func (g *GG) MainLoop() bool {
+	return g.status != gameOver
+}
+
+// DrawBoard displays a graphical representation of the current game state,
+// unless the last command didn't change it.
+func (g *GG) DrawBoard() {
+	if !g.redraw {
+		g.logger.Debugf("skipping board redraw.")
+		return
+	}
+
+	g.logger.Debugf("drawing board.")
+	board := g.view(g.board)
+	if g.autoFlip && g.playerToMove == playerBlack {
+		board = flipBoard(board)
+	}
+	g.gui.Draw(board)
+}
+
+// view returns the board as the side to move sees it, with the fog of war if it's enabled.
+func (g *GG) view(board GGBoard) GGBoard {
+	if !g.fog {
+		return board
+	}
+
+	return fogView(board, g.playerToMove)
+}
+
+// GetCommand fetches the next player's command and stores it into the command stack.
+func (g *GG) GetCommand() {
+	g.logger.Debugf("fetching player command.")
+
+	g.out.Write("Enter command: ")
+	if g.isEngineTurn() {
+		move, ok := g.engine.BestMove(g.board, g.rules)
+		g.recordSearch(g.engine.stats)
+		if ok {
+			g.out.Write(fmt.Sprintf("%s\n", g.moveString(move)))
+			g.commandStack.Append(move.String())
+			return
+		}
+	}
+
+	cmd := g.in.Read()
+	g.commandStack.Append(cmd)
+}
+
+// isEngineTurn checks if the AI is the one to move.
+func (g *GG) isEngineTurn() bool {
+	return g.engine != nil && g.status == gameInProgress && g.playerToMove == g.engine.player
+}
+
+// ResolveCommand reads the last command and invokes the appropriate handler.
+// It reports false if the command isn't one that the game understands, or if its handler rejected it.
+func (g *GG) ResolveCommand() bool {
+	cmd := normalizeCoordinates(g.commandStack.Read())
+
+	// Informational handlers opt out of redrawing the board, and handlers of commands that turn out to
+	// be invalid (ex: an illegal move) reject them.
+	g.redraw = true
+	g.rejected = false
+
+	// The SET commands of an atomic block are only run once it ends, but the game can still be exited.
+	if g.atomic && cmd != cmdAtomic && cmd != cmdEndAtomic && cmd != cmdExit {
+		g.redraw = false
+		if tokens := tokenize(cmd); len(tokens) == 0 || tokens[0] != cmdSet {
+			g.out.Write(fmt.Sprintf("Only SET commands can be in an atomic block, skipping %q. End the block with endatomic first.\n", cmd))
+			return false
+		}
+		g.atomicCommands = append(g.atomicCommands, cmd)
+		return true
+	}
+
+	if handler, ok := g.exactCommands[cmd]; ok {
+		handler(cmd)
+		return !g.rejected
+	}
+
+	for _, c := range g.patternCommands {
+		if c.pattern.MatchString(cmd) {
+			c.handler(cmd)
+			return !g.rejected
+		}
+	}
+
+	// Custom commands come last, they can't shadow built-ins anyway.
+	if tokens := tokenize(cmd); len(tokens) > 0 {
+		if handler, ok := g.commands[tokens[0]]; ok {
+			handler(g, cmd)
+			return true
+		}
+	}
+
+	g.HandleInvalid(cmd)
+	return false
+}
+
+// lastMover returns the player who made the latest move, or the side that isn't to move if no move was made yet.
+func (g *GG) lastMover() GGPlayer {
+	if len(g.events) > 0 {
+		return g.events[len(g.events)-1].player
+	}
+
+	return g.playerToMove.Opponent()
+}
+
+// reachedHome checks if the player's Flag has made it to its far rank, on any of its files. With the
+// home-run survival rule, a Flag that arrives next to an enemy piece only makes it once it's still on
+// the same square after the enemy's next move; its arrival is recorded until then.
+func (g *GG) reachedHome(player GGPlayer) bool {
+	if !isFlagHome(g.board, player) {
+		return false
+	}
+	if !g.rules.homeSurvival {
+		return true
+	}
+
+	x, y, _ := findPiece(g.board, player, flag)
+	if arrival, ok := g.flagArrivals[player]; ok && arrival.x == x && arrival.y == y && arrival.ply <= g.ply {
+		return g.ply > arrival.ply
+	}
+	if !isFlagExposed(g.board, x, y) {
+		return true
+	}
+
+	g.flagArrivals[player] = GGFlagArrival{x: x, y: y, ply: g.ply}
+	g.out.Write(fmt.Sprintf("%s's Flag reached %s next to an enemy piece, it has to survive a turn there to win.\n", player, g.square(x, y)))
+	return false
+}
+
+// DetermineResult calculates the game's result from the current game state.
+func (g *GG) DetermineResult() {
+	g.logger.Debugf("determining result.")
+
+	// Find both flags, and update the game status if one of them are not found.
+	if g.status == gameInProgress && g.flagScan {
+		whiteFlagFound := false
+		blackFlagFound := false
+
+		for _, row := range g.board {
+			for _, square := range row {
+				if square.piece.code == flag {
+					if square.piece.player == playerWhite {
+						whiteFlagFound = true
+					} else if square.piece.player == playerBlack {
+						blackFlagFound = true
+					}
+				}
+			}
+		}
+
+		if whiteFlagFound && !blackFlagFound {
+			g.winner = playerWhite
+			g.status = gameOver
+			g.endReason = endFlagCaptured
+		} else if blackFlagFound && !whiteFlagFound {
+			g.winner = playerBlack
+			g.status = gameOver
+			g.endReason = endFlagCaptured
+		}
+	}
+
+	// A lone flag that can't reach the other end has lost the game, unless the other one can't either.
+	if g.status == gameInProgress && g.rules.loneFlagLoss {
+		if winner, ok := blockedFlagWinner(g.board); ok {
+			g.winner = winner
+			g.status = gameOver
+			g.endReason = endStalemate
+		}
+	}
+
+	// Check the 8th rank for the white flag, and the 1st rank for the black flag.
+	whiteHome := g.reachedHome(playerWhite)
+	blackHome := g.reachedHome(playerBlack)
+	switch {
+	case whiteHome && blackHome:
+		// Both flags can only be home at once in a loaded position: the side that moved last wins,
+		// unless the rules make it a draw.
+		g.status = gameOver
+		g.winner = g.lastMover()
+		g.endReason = endFlagHome
+		if g.rules.dualHomeDraw {
+			g.winner = ""
+			g.endReason = endBothFlagsHome
+		}
+	case whiteHome:
+		g.status = gameOver
+		g.winner = playerWhite
+		g.endReason = endFlagHome
+	case blackHome:
+		g.status = gameOver
+		g.winner = playerBlack
+		g.endReason = endFlagHome
+	}
+
+	// A side whose time runs out loses, even if it hasn't tried moving since.
+	if g.status == gameInProgress && g.timeBudgets != nil && g.clockLeft(g.playerToMove) == 0 {
+		g.winner = g.playerToMove.Opponent()
+		g.status = gameOver
+		g.endReason = endTimeout
+	}
+
+	// A game that's still going once the move limit is reached is a draw.
+	if g.status == gameInProgress && g.maxPlies > 0 && g.ply >= g.maxPlies {
+		g.status = gameOver
+		g.endReason = endMoveLimit
+	}
+
+	if g.puzzle != nil {
+		g.checkPuzzle()
+	}
+}
+
+// ShowResult reports the "result" (i.e. what next step is needed) of the current game state.
+func (g *GG) ShowResult() {
+	g.logger.Debugf("showing result.")
+
+	if g.puzzle != nil && g.puzzle.outcome != "" && !g.puzzle.reported {
+		g.out.Write(fmt.Sprintf(">>>>> %s\n", g.puzzle.outcome))
+		g.puzzle.reported = true
+	}
 
 	g.out.Write(">>>>> ")
 	if g.status == gameSetup {
 		g.out.Write("Please setup the board.\n")
+	} else if g.status == gameInProgress && g.drawOfferedBy != "" {
+		g.out.Write(fmt.Sprintf("Draw offered by %s; %s to respond.\n", g.playerName(g.drawOfferedBy), g.playerName(g.drawOfferedBy.Opponent())))
 	} else if g.status == gameInProgress {
-		g.out.Write(fmt.Sprintf("%s to move.\n", g.playerToMove))
-	} else if g.status == gameOver && g.winner != "" {
-		g.out.Write(fmt.Sprintf("%s wins!\n", g.winner))
+		g.out.Write(fmt.Sprintf("%s to move.", g.playerName(g.playerToMove)))
+		if g.timeBudgets != nil {
+			g.out.Write(fmt.Sprintf(" Clock: %s %s, %s %s.",
+				playerWhite, g.clockLeft(playerWhite).Round(time.Second),
+				playerBlack, g.clockLeft(playerBlack).Round(time.Second)))
+		}
+		g.out.Write("\n")
+	} else if g.status == gameOver && (g.winner != "" || g.endReason != "") {
+		g.out.Write(fmt.Sprintf("%s\n", g.formatter.FormatResult(g.winner, g.endReason)))
+	}
+}
+
+// checkPuzzle determines whether the puzzle has been solved or failed, if it isn't yet.
+func (g *GG) checkPuzzle() {
+	p := g.puzzle
+	if p.outcome != "" {
+		return
+	}
+
+	solverMoves := 0
+	for _, e := range g.events {
+		if e.player == p.solver {
+			solverMoves++
+		}
+	}
+
+	solved := false
+	switch p.goal {
+	case goalCaptureFlag:
+		solved = armyCounts(g.board, p.solver.Opponent())[flag] == 0
+	case goalWin:
+		solved = g.status == gameOver && g.winner == p.solver
+	}
+
+	if solved {
+		p.outcome = fmt.Sprintf("Puzzle solved in %d moves!", solverMoves)
+	} else if solverMoves >= p.moves || g.status == gameOver {
+		p.outcome = fmt.Sprintf("Puzzle failed: %s.", p)
+	}
+}
+
+// challengeCode returns the code of a piece of a challenge, as known to the side to move: with the fog of war,
+// the enemy pieces of challenges kept secret by the rules stay hidden.
+func (g *GG) challengeCode(piece GGPiece) GGPieceCode {
+	if g.fog && g.rules.hideChallenges && piece.player != g.playerToMove {
+		return hidden
+	}
+
+	return piece.code
+}
+
+// graveyardCodes lists the codes that the graveyard counts pieces under, in order. The enemy pieces of
+// secret challenges are counted as hidden (see challengeCode).
+func (g *GG) graveyardCodes() []GGPieceCode {
+	if g.fog && g.rules.hideChallenges {
+		return append(append([]GGPieceCode{}, pieceCodes...), hidden)
+	}
+
+	return pieceCodes
+}
+
+// graveyard counts the pieces each player has lost to challenges so far, by their codes as known to the
+// side to move (see challengeCode).
+func (g *GG) graveyard() map[GGPlayer]map[GGPieceCode]int {
+	captured := map[GGPlayer]map[GGPieceCode]int{
+		playerWhite: {},
+		playerBlack: {},
+	}
+
+	for _, e := range g.events {
+		switch e.result {
+		case resChallengerWins:
+			captured[e.target.player][g.challengeCode(e.target)]++
+		case resChallengerLoses:
+			captured[e.challenger.player][g.challengeCode(e.challenger)]++
+		case resDraw:
+			captured[e.target.player][g.challengeCode(e.target)]++
+			captured[e.challenger.player][g.challengeCode(e.challenger)]++
+		}
+	}
+
+	return captured
+}
+
+// GGGameFile is the contents of a .gggn file (GG Game notation), as read by parseGameFile.
+type GGGameFile struct {
+	// The position set up, barriers included, and the line each of its pieces was set on.
+	board      GGBoard
+	placements map[string]int
+
+	first    GGPlayer
+	puzzle   *GGPuzzle
+	notes    []GGNote
+	seed     *int64
+	revealed map[string]GGPlayer
+
+	// The moves to replay, and the pauses before them by the number of moves already made.
+	moves []GGMove
+	waits map[int]time.Duration
+}
+
+// lintProblem is a problem found in a game file, along with the line it's on. Problems with the whole
+// position have no line of their own.
+type lintProblem struct {
+	line int
+	text string
+}
+
+// loadError describes the problem as the error that stops its file from being loaded.
+func (p lintProblem) loadError() error {
+	if p.line == 0 {
+		return fmt.Errorf("impossible position: %s", p.text)
+	}
+
+	return fmt.Errorf("%s (line %d)", p.text, p.line)
+}
+
+// parseGameFile reads a .gggn file (GG Game notation), setting its pieces up on top of the given board,
+// and checks it the way loading it would: every line must be a valid directive, SET or MV command, the
+// position must be possible, and the moves legal. It carries on past the first problem and returns all
+// of them, in the order they're found. Moves stop being checked after an illegal one, since the position
+// the next ones are made in is unknown. Only failing to read the file is returned as an error.
+func (g *GG) parseGameFile(r io.Reader, board GGBoard) (GGGameFile, []lintProblem, error) {
+	problems := []lintProblem{}
+	report := func(lineNumber int, format string, args ...any) {
+		problems = append(problems, lintProblem{line: lineNumber, text: fmt.Sprintf(format, args...)})
+	}
+
+	// Unless the file says otherwise, the usual side moves first and there's no puzzle to solve.
+	file := GGGameFile{
+		board:      board,
+		placements: map[string]int{},
+		first:      g.firstPlayer,
+		revealed:   map[string]GGPlayer{},
+		waits:      map[int]time.Duration{},
+	}
+	barriers := map[string]int{}
+	revealedLines := map[string]int{}
+	moveLines := []int{}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		currentLine := scanner.Text()
+		lineNumber++
+
+		// Skip empty lines.
+		if currentLine == "" {
+			continue
+		}
+
+		// Handle directives.
+		if strings.HasPrefix(currentLine, directivePrefix) {
+			key, value := parseDirective(currentLine)
+			switch key {
+			case directiveFirst:
+				if value != string(playerWhite) && value != string(playerBlack) {
+					report(lineNumber, "invalid starting player %q", value)
+					continue
+				}
+				file.first = GGPlayer(value)
+			case directiveGoal:
+				puzzle, err := parsePuzzleGoal(value)
+				if err != nil {
+					report(lineNumber, "%v", err)
+					continue
+				}
+				file.puzzle = puzzle
+			case directiveNote:
+				file.notes = append(file.notes, parseNote(value))
+			case directiveSeed:
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					report(lineNumber, "invalid seed %q", value)
+					continue
+				}
+				file.seed = &n
+			case directiveBarrier:
+				fields := strings.Fields(value)
+				if len(fields) == 0 {
+					report(lineNumber, "invalid barriers %q, expected squares", value)
+				}
+				for _, coordinates := range fields {
+					if _, _, err := parseCoordinates(coordinates); err != nil {
+						report(lineNumber, "%v", err)
+						continue
+					}
+					barriers[coordinates] = lineNumber
+				}
+			case directiveWait:
+				d, err := parseWait(value)
+				if err != nil {
+					report(lineNumber, "%v", err)
+					continue
+				}
+				file.waits[len(file.moves)] += d
+			case directiveRevealed:
+				fields := strings.Fields(value)
+				if len(fields) < 2 || (fields[0] != string(playerWhite) && fields[0] != string(playerBlack)) {
+					report(lineNumber, "invalid revealed pieces %q, expected a player and squares", value)
+					continue
+				}
+				for _, coordinates := range fields[1:] {
+					if _, _, err := parseCoordinates(coordinates); err != nil {
+						report(lineNumber, "%v", err)
+						continue
+					}
+					file.revealed[coordinates] = GGPlayer(fields[0])
+					revealedLines[coordinates] = lineNumber
+				}
+			default:
+				report(lineNumber, "unknown directive %q", key)
+			}
+			continue
+		}
+
+		// Ignore comments.
+		if currentLine[0] == '#' {
+			continue
+		}
+
+		// Moves are replayed once the whole setup is read, so they must come after it.
+		tokens := tokenize(currentLine)
+		if len(tokens) > 0 && tokens[0] == cmdMove {
+			if !mvCmdRegex.MatchString(strings.Join(tokens, " ")) {
+				report(lineNumber, "invalid move %q", currentLine)
+				continue
+			}
+			file.moves = append(file.moves, newMove(tokens[1], tokens[2]))
+			moveLines = append(moveLines, lineNumber)
+			continue
+		}
+		if len(file.moves) > 0 {
+			report(lineNumber, "setup after the first move")
+			continue
+		}
+
+		if err := checkSet(file.board, currentLine); err != nil {
+			report(lineNumber, "%v", err)
+			continue
+		}
+
+		// Two pieces can't be set on the same square.
+		coordinates := tokens[2]
+		if line, ok := file.placements[coordinates]; ok {
+			report(lineNumber, "duplicate placement at %s, first set on line %d", coordinates, line)
+			continue
+		}
+		file.placements[coordinates] = lineNumber
+
+		player, _ := parsePlayer(tokens[1])
+		x, y := coordinatesToSquareAddress(coordinates)
+		file.board[x][y].piece = GGPiece{player: player, code: GGPieceCode(tokens[3])}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return GGGameFile{}, nil, err
+	}
+
+	// Files can include the pieces that the handicaps take off.
+	g.removeHandicaps(&file.board)
+
+	for coordinates, line := range barriers {
+		x, y := coordinatesToSquareAddress(coordinates)
+		if !file.board[x][y].IsEmpty() {
+			report(line, "barrier on occupied square %s", coordinates)
+			continue
+		}
+		file.board[x][y].barrier = true
+	}
+
+	// A side with several flags would make the game's result ambiguous.
+	for _, violation := range flagViolations(file.board) {
+		report(0, "%s", violation)
+	}
+
+	// Check the moves on a copy of the board, so that an illegal one is found before the game begins.
+	check := file.board
+	player := file.first
+	for i, m := range file.moves {
+		if _, err := validateMove(check, player, m, g.rules); err != nil {
+			report(moveLines[i], "invalid move %s: %v", m, err)
+			break
+		}
+		playMove(&check, m, g.rules)
+		player = player.Opponent()
+	}
+
+	for coordinates, owner := range file.revealed {
+		x, y := coordinatesToSquareAddress(coordinates)
+		if check[x][y].piece.player != owner {
+			report(revealedLines[coordinates], "no %s piece on %s to reveal", owner, coordinates)
+		}
+	}
+
+	return file, problems, nil
+}
+
+// loadFile executes the contents of a .gggn file (GG Game notation) and starts the game,
+// replaying any moves listed after the setup. The file is checked as a whole before anything
+// is changed, so the game is left untouched if it can't be loaded. Only its first problem is
+// reported, see lintFile for all of them.
+func (g *GG) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	file, problems, err := g.parseGameFile(f, g.board)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return problems[0].loadError()
+	}
+
+	g.board = file.board
+	g.playerToMove = file.first
+	if file.seed != nil {
+		g.SetSeed(*file.seed)
+	}
+	g.beginGame()
+
+	// The puzzle is solved by whoever moves first.
+	g.puzzle = file.puzzle
+	if file.puzzle != nil {
+		file.puzzle.solver = file.first
+	}
+
+	// The moves were checked while parsing, so none of them can fail.
+	for i, m := range file.moves {
+		if d := file.waits[i]; d > 0 {
+			g.sleep(d)
+		}
+		g.makeMove(m)
+	}
+	if d := file.waits[len(file.moves)]; d > 0 {
+		g.sleep(d)
+	}
+	g.attachNotes(file.notes)
+
+	for coordinates := range file.revealed {
+		x, y := coordinatesToSquareAddress(coordinates)
+		g.board[x][y].piece.revealed = true
+	}
+	return nil
+}
+
+// lintFile checks a game file the way loading it would (see parseGameFile), and more strictly: the armies
+// can't have more pieces than the rosters allow, and complete armies must be set up on their side's first
+// ranks. Unlike loading, it lists every problem with its line, and problems with the whole position after
+// them. The game is left untouched.
+func (g *GG) lintFile(r io.Reader) ([]string, error) {
+	file, found, err := g.parseGameFile(r, GGBoard{})
+	if err != nil {
+		return nil, err
+	}
+
+	lined := []lintProblem{}
+	position := []string{}
+	for _, p := range found {
+		if p.line == 0 {
+			position = append(position, p.text)
+			continue
+		}
+		lined = append(lined, p)
+	}
+	position = append(position, rosterViolations(file.board, g.rosters)...)
+
+	// Only complete armies are setups, other positions can have their pieces anywhere.
+	if len(missingPieces(file.board, g.rosters)) == 0 {
+		for coordinates, line := range file.placements {
+			x, y := coordinatesToSquareAddress(coordinates)
+			piece := file.board[x][y].piece
+			if !piece.IsEmpty() && !g.inSetupRanks(piece.player, x) {
+				lined = append(lined, lintProblem{line: line, text: fmt.Sprintf("%s's %s on %s is outside of its first %d ranks", piece.player, piece.code, coordinates, g.setupRanks)})
+			}
+		}
+	}
+
+	// Some problems are found out of order, list them by line.
+	sort.SliceStable(lined, func(i, j int) bool {
+		return lined[i].line < lined[j].line
+	})
+	problems := []string{}
+	for _, p := range lined {
+		problems = append(problems, fmt.Sprintf("line %d: %s", p.line, p.text))
+	}
+	return append(problems, position...), nil
+}
+
+// sandbox returns a copy of the game, played by the same rules, that can be changed without affecting it.
+// The copy doesn't write any output, notify the challenge observers, nor pause for waits. It has its own
+// records, clocks, names and randomness, so that playing it out leaves the game's alone.
+func (g *GG) sandbox() *GG {
+	s := *g
+	s.events = slices.Clone(g.events)
+	s.notes = slices.Clone(g.notes)
+	s.redoMoves = slices.Clone(g.redoMoves)
+	s.timeLeft = maps.Clone(g.timeLeft)
+	s.timeBudgets = maps.Clone(g.timeBudgets)
+	s.names = maps.Clone(g.names)
+	s.flagArrivals = maps.Clone(g.flagArrivals)
+	s.restoreRandomness(g.rngSource.seed, g.rngSource.draws)
+	s.out = DiscardOutput{}
+	s.sleep = func(time.Duration) {}
+	s.challengeObservers = nil
+	s.scoutPractice = false
+	s.autosaver = nil
+	s.trace = nil
+	return &s
+}
+
+// beginGame transitions the game into progress, starting its records from scratch.
+func (g *GG) beginGame() {
+	g.ply = 0
+	g.drawOfferedBy = ""
+	g.flagArrivals = map[GGPlayer]GGFlagArrival{}
+	g.winner = ""
+	g.endReason = ""
+	g.setup = g.board
+	g.events = []GGEvent{}
+	g.notes = []GGNote{}
+	g.redoMoves = nil
+	g.status = gameInProgress
+	g.startedAt = g.timestamp()
+	for player, budget := range g.timeBudgets {
+		g.timeLeft[player] = budget
+	}
+
+	g.openingScout = nil
+	if g.scoutPractice {
+		g.openingScout = g.scout()
+	}
+}
+
+// scout reveals one random enemy piece of the side to move, unless all of them are already known,
+// and returns its square.
+func (g *GG) scout() *[2]int {
+	enemy := g.playerToMove.Opponent()
+	squares := [][2]int{}
+	for x := range g.board {
+		for y := range g.board[x] {
+			if piece := g.board[x][y].piece; piece.player == enemy && !piece.revealed {
+				squares = append(squares, [2]int{x, y})
+			}
+		}
+	}
+
+	if len(squares) == 0 {
+		return nil
+	}
+
+	square := squares[g.rng.Intn(len(squares))]
+	piece := &g.board[square[0]][square[1]].piece
+	piece.revealed = true
+	g.out.Write(fmt.Sprintf("Scouting practice: %s's %s on %s is revealed.\n", enemy, piece.code, g.square(square[0], square[1])))
+	return &square
+}
+
+// revealScouted reveals the piece on the square that scouting practice picked, if any.
+func (g *GG) revealScouted(square *[2]int) {
+	if square != nil {
+		g.board[square[0]][square[1]].piece.revealed = true
+	}
+}
+
+// replay reconstructs the board as it was after the first n moves of the game.
+func (g *GG) replay(n int) GGBoard {
+	board := g.setup
+	for _, e := range g.events[:n] {
+		playMove(&board, e.move, g.rules)
+	}
+
+	return board
+}
+
+// turnStartedAt returns when the side to move's turn started, at the previous move or the start of the game,
+// or when the game was loaded if that's later.
+func (g *GG) turnStartedAt() time.Time {
+	started := g.startedAt
+	if len(g.events) > 0 {
+		started = g.events[len(g.events)-1].time
+	}
+
+	if g.resumedAt.After(started) {
+		return g.resumedAt
+	}
+	return started
+}
+
+// clockLeft returns how much time the player has left, counting the time spent on the current turn.
+func (g *GG) clockLeft(player GGPlayer) time.Duration {
+	left := g.timeLeft[player]
+	if player == g.playerToMove && g.status == gameInProgress {
+		left -= g.timestamp().Sub(g.turnStartedAt())
+	}
+
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// timestamp returns the current time, never earlier than the last recorded move
+// so that the timeline stays monotonic even if the clock jumps back.
+func (g *GG) timestamp() time.Time {
+	now := g.now()
+	if len(g.events) > 0 {
+		if last := g.events[len(g.events)-1].time; now.Before(last) {
+			return last
+		}
+	}
+
+	return now
+}
+
+// Quit allows the game to execute any cleanup routines.
+func (g *GG) Quit() {
+	g.logger.Infof("quitting game.")
+	if g.autosaver != nil {
+		g.autosaver.Wait()
+	}
+}
+
+// ==============================================================================
+// GG handler methods -- as opposed to "main game" methods.
+// These are prefixed by "Handle" and are invoked by user input.
+// ==============================================================================
+
+// HandleExit handles the "exit" command.
+func (g *GG) HandleExit() {
+	g.logger.Infof("exiting game loop.")
+	g.status = gameOver
+}
+
+// HandleInvalid handles a command not supported by the game, suggesting the closest known command if any.
+func (g *GG) HandleInvalid(cmd string) {
+	g.redraw = false
+
+	tokens := tokenize(cmd)
+	if len(tokens) > 0 {
+		if suggestion := closestCommand(tokens[0], g.commandNames()); suggestion != "" {
+			g.out.Write(fmt.Sprintf("Invalid command. Did you mean '%s'?\n", suggestion))
+			return
+		}
+	}
+
+	g.out.Write("Invalid command.\n")
+}
+
+// HandleHelp shows the help message.
+func (g *GG) HandleHelp() {
+	g.redraw = false
+	g.out.Write("Available commands:\n")
+	g.out.Write("\t* SET: Set a piece into the board.\n")
+	g.out.Write("\t\t* Syntax: SET W|P COORD PIECECODE\n")
+	g.out.Write("\t* barrier SQUARE: Make an empty square a barrier that no piece may enter, or a barrier empty again, before the game.\n")
+	g.out.Write("\t* shuffle W|B: Rearrange a side's pieces at random among the squares they're on, during setup.\n")
+	g.out.Write("\t* setup: Enter several SET commands at once, one per line, ending with done.\n")
+	g.out.Write("\t* paste: Replace the board with a drawn one, pasted line by line, ending with done. Pieces belong to the side whose half they're on, unless preceded by their player (ex: B SPY).\n")
+	g.out.Write("\t* atomic, endatomic: Hold the SET commands in between, and place all of them at endatomic or none if one is invalid.\n")
+	g.out.Write("\t* loadsample: Loads a sample game file.\n")
+	g.out.Write("\t* puzzle PATH: Load a puzzle, a position with a goal to reach (ex: #@goal win-in 3).\n")
+	g.out.Write("\t* lint PATH: List every problem in a game file, with its line, without loading it.\n")
+	g.out.Write("\t* start: Start the game once the board is set up.\n")
+	g.out.Write("\t* validate: Check the board for pieces beyond each army's roster, and for sides with more than one flag.\n")
+	g.out.Write("\t* fairness: Check that both armies on the board are made up of the same pieces.\n")
+	g.out.Write("\t* ruleset: Show every optional rule and whether it's in effect.\n")
+	g.out.Write("\t* timeline: List the moves made so far and how long each one took.\n")
+	g.out.Write("\t* suggest: Show the move the AI would make for the side to move, without making it.\n")
+	g.out.Write("\t* battles: List every challenge made so far, with both pieces and the outcome.\n")
+	g.out.Write("\t* try MV FROM TO: Check if a move is legal without making it.\n")
+	g.out.Write("\t* rewind N: Show the board as it was N moves ago.\n")
+	g.out.Write("\t* wait DURATION: Pause for a while (ex: wait 2s), for pacing scripted demos.\n")
+	g.out.Write("\t* compare PATH PATH: Find the first move at which two game files differ.\n")
+	g.out.Write("\t* openings DIR: Tally the first moves of each side across the game files in a directory.\n")
+	g.out.Write("\t* undo: Undo the latest move.\n")
+	g.out.Write("\t* undoto N: Undo every move after the Nth one (0 for the starting position).\n")
+	g.out.Write("\t* redo: Make the latest undone move again.\n")
+	g.out.Write("\t* restart: Go back to the starting position of the game, undoing every move.\n")
+	g.out.Write("\t* stats: Show move and capture statistics of the game so far.\n")
+	g.out.Write("\t* count: Show how many of each piece are still on the board (only the side to move's with the fog of war).\n")
+	g.out.Write("\t* distances: Show how many squares the moves made so far covered.\n")
+	g.out.Write("\t* ai-stats: Show how long the last AI search took and how many positions it evaluated.\n")
+	g.out.Write("\t* heatmap: Show how many of the side to move's pieces can reach each square.\n")
+	g.out.Write("\t* analyze: List the enemy pieces that can beat one of the side to move's pieces (analysis mode only).\n")
+	g.out.Write("\t* forks: List the side to move's pieces that can beat two or more enemy pieces next move (analysis mode only).\n")
+	g.out.Write("\t* eval: Show the AI's score of the position without searching, positive when White is ahead (analysis mode only).\n")
+	g.out.Write("\t* review: List the moves made so far that lost a piece or missed capturing the Flag (analysis mode only).\n")
+	g.out.Write("\t* known: List the enemy pieces revealed to the side to move, by challenges or scouting.\n")
+	g.out.Write("\t* defense: List the side to move's pieces guarding its Flag (defense W|B in analysis mode).\n")
+	g.out.Write("\t* flagthreats: List the enemy pieces that could capture the side to move's Flag next turn (flagthreats W|B in analysis mode).\n")
+	g.out.Write("\t* rank CODE: Show a piece's full name and where it stands in the hierarchy (ex: rank SPY).\n")
+	g.out.Write("\t* fog on|off: Hide or show the enemy pieces of the side to move, between games or in analysis mode.\n")
+	g.out.Write("\t* notation algebraic|numeric: Show squares as files and ranks (B2), or as the board's indexes (1,1).\n")
+	g.out.Write("\t* legend: Show what each symbol on the board stands for, as it's currently drawn.\n")
+	g.out.Write("\t* rotate: Rotate the board 180 degrees, swapping the armies' colors and the turn.\n")
+	g.out.Write("\t* offerdraw: Offer the other side to end the game in a draw, before making your move.\n")
+	g.out.Write("\t* acceptdraw, declinedraw: Respond to the other side's draw offer, instead of moving.\n")
+	g.out.Write("\t* note TEXT: Attach a note to the game after the latest move, shown in the timeline and kept by exports.\n")
+	g.out.Write("\t* swapsides: Give the turn to the other side without moving (analysis mode only).\n")
+	g.out.Write("\t* newgame: Start another game, and switch to it.\n")
+	g.out.Write("\t* game N: Switch to the Nth game.\n")
+	g.out.Write("\t* games: List every game of the session.\n")
+	g.out.Write("\t* savebin PATH: Save the game into a compact binary file.\n")
+	g.out.Write("\t* loadbin PATH: Load a game saved with savebin.\n")
+	g.out.Write("\t* share: Show a token of the current position, which can be pasted into a chat or a URL.\n")
+	g.out.Write("\t* open TOKEN: Load the position of a token shown by share, and continue the game from it.\n")
+	g.out.Write("\t* import json PATH: Load a position from a JSON file, with both armies complete unless imports are lenient.\n")
+	g.out.Write("\t* import pgn PATH: Replay a game from a transcript written by export pgn.\n")
+	g.out.Write("\t* export csv PATH: Export the number of captured pieces per player as CSV.\n")
+	g.out.Write("\t* export json PATH, export gggn PATH: Export the position in the JSON import format, or as a game file.\n")
+	g.out.Write("\t* export pgn PATH: Export the moves as a numbered transcript, with the players, the notes and the result.\n")
+	g.out.Write("\t* export frames DIR: Write the board after every move into a directory, one numbered text file each.\n")
+	g.out.Write("\t* help: Show this help message.\n")
+	g.out.Write("\t* exit: Exit the game.\n")
+}
+
+// HandleSet parses the given command and places the piece into the given coordinates.
+func (g *GG) HandleSet(cmd string) {
+	if err := g.checkSetupSet(cmd); err != nil {
+		g.rejected = true
+		g.out.Write(fmt.Sprintf("Invalid SET command: %v\n", err))
+		return
+	}
+
+	tokens := tokenize(cmd)
+	player, _ := parsePlayer(tokens[1])
+	coordinates := tokens[2]
+	pieceCode := tokens[3]
+
+	x, y := coordinatesToSquareAddress(coordinates)
+	piece := GGPiece{player: player, code: GGPieceCode(pieceCode)}
+	g.board[x][y].piece = piece
+	g.logger.Infof("Player %v places %v on %v", player, pieceCode, coordinates)
+}
+
+// HandleSetup reads SET commands until "done", and places every valid one.
+// Invalid commands are skipped and reported all at once at the end.
+func (g *GG) HandleSetup() {
+	g.out.Write("Enter SET commands, one per line, then done:\n")
+
+	placed := 0
+	errs := []string{}
+	for lineNumber := 1; ; lineNumber++ {
+		cmd := g.in.Read()
+		if cmd == cmdDone || cmd == cmdExit {
+			break
+		}
+
+		if err := g.checkSetupSet(cmd); err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %v", lineNumber, err))
+			continue
+		}
+
+		g.HandleSet(cmd)
+		placed++
+	}
+
+	g.out.Write(fmt.Sprintf("Placed %d pieces.\n", placed))
+	if len(errs) > 0 {
+		g.out.Write(fmt.Sprintf("Skipped %d invalid lines:\n", len(errs)))
+		for _, err := range errs {
+			g.out.Write(fmt.Sprintf("\t%s\n", err))
+		}
+	}
+}
+
+// HandleAtomic opens an atomic block, holding the commands that follow until the block ends.
+func (g *GG) HandleAtomic() {
+	g.redraw = false
+
+	if g.atomic {
+		g.out.Write("An atomic block is already open, end it with endatomic.\n")
+		return
+	}
+
+	g.atomic = true
+	g.atomicCommands = nil
+	g.out.Write("Atomic block opened, enter SET commands then endatomic.\n")
+}
+
+// HandleEndAtomic ends the atomic block, placing the pieces of all of its SET commands. If any of its
+// commands is invalid, the board is rolled back to how it was before the block and none are placed.
+func (g *GG) HandleEndAtomic() {
+	if !g.atomic {
+		g.redraw = false
+		g.out.Write("There is no atomic block to end.\n")
+		return
+	}
+
+	g.atomic = false
+	snapshot := g.board
+	for i, cmd := range g.atomicCommands {
+		if err := g.checkSetupSet(cmd); err != nil {
+			g.board = snapshot
+			g.redraw = false
+			g.out.Write(fmt.Sprintf("Atomic block rolled back, command %d failed: %v\n", i+1, err))
+			return
+		}
+		g.HandleSet(cmd)
+	}
+	g.out.Write(fmt.Sprintf("Atomic block committed, %d commands run.\n", len(g.atomicCommands)))
+}
+
+// checkSetupSet validates a SET command against the current board, like checkSet. During setup, the piece
+// also has to be placed within the ranks its player sets up on. It's the only validation HandleSet makes,
+// so a SET command that passes is always placed.
+func (g *GG) checkSetupSet(cmd string) error {
+	if err := checkSet(g.board, cmd); err != nil {
+		return err
+	}
+
+	if g.status != gameSetup {
+		return nil
+	}
+
+	tokens := tokenize(cmd)
+	player, _ := parsePlayer(tokens[1])
+	x, _, _ := parseCoordinates(tokens[2])
+	if !g.inSetupRanks(player, x) {
+		return fmt.Errorf("%s is outside of %s's first %d ranks", tokens[2], player, g.setupRanks)
+	}
+
+	return nil
+}
+
+// checkSet validates a SET command against the board it would place a piece on, before any piece is
+// placed with it.
+func checkSet(board GGBoard, cmd string) error {
+	tokens := tokenize(cmd)
+	if err := checkArity(tokens, 4); err != nil {
+		return err
+	}
+
+	if tokens[0] != cmdSet {
+		return fmt.Errorf("invalid SET command %q", cmd)
+	}
+
+	if _, err := parsePlayer(tokens[1]); err != nil {
+		return err
+	}
+
+	x, y, err := parseCoordinates(tokens[2])
+	if err != nil {
+		return err
+	}
+
+	if _, ok := roster[GGPieceCode(tokens[3])]; !ok {
+		return fmt.Errorf("unknown piece code in %q", cmd)
+	}
+
+	if board[x][y].barrier {
+		return fmt.Errorf("%s is a barrier", tokens[2])
+	}
+
+	return nil
+}
+
+// HandlePaste reads the lines of a drawn board until "done", and replaces the board with it. Pieces
+// that crossed the center of a drawn board have to be given their player (see parseBoardArt).
+func (g *GG) HandlePaste() {
+	g.out.Write("Paste the board, then done:\n")
+
+	lines := []string{}
+	for {
+		line := g.in.Read()
+		if line == cmdDone || line == cmdExit {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	if err := g.PasteBoard(lines); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to paste the board: %v\n", err))
+		return
+	}
+	g.out.Write("Board successfully pasted\n")
+}
+
+// HandleLoadSample opens a sample .gggn file (GG Game notation) and executes the contents.
+func (g *GG) HandleLoadSample() {
+	if err := g.loadFile(g.sampleFilePath); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to load file %s: %v\n", g.sampleFilePath, err))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("File %s successfully loaded\n", g.sampleFilePath))
+}
+
+// HandlePuzzle loads the puzzle file at the given path.
+func (g *GG) HandlePuzzle(cmd string) {
+	path := tokenize(cmd)[1]
+	if err := g.loadFile(path); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to load file %s: %v\n", path, err))
+		return
+	}
+
+	if g.puzzle == nil {
+		g.out.Write(fmt.Sprintf("File %s successfully loaded, but it has no goal to reach.\n", path))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Puzzle %s loaded: %s.\n", path, g.puzzle))
+}
+
+// HandleLint checks the game file at the given path, listing every problem found in it (see lintFile).
+// The game is left untouched.
+func (g *GG) HandleLint(cmd string) {
+	g.redraw = false
+	path := tokenize(cmd)[1]
+
+	f, err := os.Open(path)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to lint file %s: %v\n", path, err))
+		return
+	}
+	defer f.Close()
+
+	problems, err := g.lintFile(f)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to lint file %s: %v\n", path, err))
+		return
+	}
+
+	if len(problems) == 0 {
+		g.out.Write(fmt.Sprintf("No problems found in %s.\n", path))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Problems found in %s:\n", path))
+	for _, p := range problems {
+		g.out.Write(fmt.Sprintf("\t* %s\n", p))
+	}
+}
+
+// HandleStart validates the board and, if it passes, starts the game.
+func (g *GG) HandleStart() {
+	if g.status != gameSetup {
+		g.out.Write("The game can only be started during setup.\n")
+		return
+	}
+
+	violations := flagViolations(g.board)
+	violations = append(violations, rosterViolations(g.board, g.rosters)...)
+	violations = append(violations, missingPieces(g.board, g.rosters)...)
+	violations = append(violations, g.setupRankViolations(g.board)...)
+	if len(violations) > 0 {
+		g.out.Write("Unable to start the game:\n")
+		for _, v := range violations {
+			g.out.Write(fmt.Sprintf("\t* %s\n", v))
+		}
+		return
+	}
+
+	g.playerToMove = g.firstPlayer
+	g.beginGame()
+}
+
+// HandleRuleSet shows every optional rule and whether it's in effect.
+func (g *GG) HandleRuleSet() {
+	g.redraw = false
+
+	g.out.Write("Rules:\n")
+	for _, t := range g.rules.Toggles() {
+		state := "off"
+		if t.enabled {
+			state = "on"
+		}
+		g.out.Write(fmt.Sprintf("\t* %s: %s\n", t.name, state))
+	}
+}
+
+// HandleValidate reports any roster violations on the current board, including extra flags.
+func (g *GG) HandleValidate() {
+	g.redraw = false
+	violations := flagViolations(g.board)
+	violations = append(violations, rosterViolations(g.board, g.rosters)...)
+	if len(violations) == 0 {
+		g.out.Write("No roster violations found.\n")
+		return
+	}
+
+	g.out.Write("Roster violations:\n")
+	for _, v := range violations {
+		g.out.Write(fmt.Sprintf("\t* %s\n", v))
+	}
+}
+
+// HandleExportCSV writes the number of captured pieces per player into a CSV file,
+// with a row for each piece code of the graveyard (see graveyardCodes).
+func (g *GG) HandleExportCSV(cmd string) {
+	g.redraw = false
+	path := tokenize(cmd)[2]
+
+	f, err := os.Create(path)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to export to %s: %v\n", path, err))
+		return
+	}
+	defer f.Close()
+
+	captured := g.graveyard()
+	w := csv.NewWriter(f)
+	w.Write([]string{"piece", "white", "black"})
+	for _, code := range g.graveyardCodes() {
+		w.Write([]string{
+			string(code),
+			strconv.Itoa(captured[playerWhite][code]),
+			strconv.Itoa(captured[playerBlack][code]),
+		})
+	}
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to export to %s: %v\n", path, err))
+		return
+	}
+	g.out.Write(fmt.Sprintf("Captured pieces exported to %s\n", path))
+}
+
+// HandleRotate moves every piece to its mirrored square across the center of the board, and hands
+// each army over to the other color along with its clock and name, as well as the turn, so that the
+// game carries on exactly as before, only seen from the other side. Rotating twice restores the game.
+func (g *GG) HandleRotate() {
+	g.board = rotateBoard(g.board)
+	g.playerToMove = g.playerToMove.Opponent()
+
+	// Keep the records in the rotated coordinates, so that they can still be replayed.
+	g.setup = rotateBoard(g.setup)
+	g.openingScout = rotateSquare(g.openingScout)
+	for i := range g.events {
+		e := &g.events[i]
+		e.move = rotateMove(e.move)
+		e.player = e.player.Opponent()
+		e.challenger.player = e.challenger.player.Opponent()
+		if !e.target.IsEmpty() {
+			e.target.player = e.target.player.Opponent()
+		}
+		e.scouted = rotateSquare(e.scouted)
+	}
+	for i := range g.redoMoves {
+		g.redoMoves[i] = rotateMove(g.redoMoves[i])
+	}
+
+	// Whatever belonged to a side, from its clock to its name, goes along with its army. The names are
+	// swapped in place, since the default result formatter shares them.
+	g.names[playerWhite], g.names[playerBlack] = g.names[playerBlack], g.names[playerWhite]
+	g.timeBudgets = swapPlayers(g.timeBudgets)
+	g.timeLeft = swapPlayers(g.timeLeft)
+	g.rosters = swapPlayers(g.rosters)
+	g.handicaps = swapPlayers(g.handicaps)
+	g.flagArrivals = swapPlayers(g.flagArrivals)
+	for player, arrival := range g.flagArrivals {
+		arrival.x, arrival.y = rows-1-arrival.x, files-1-arrival.y
+		g.flagArrivals[player] = arrival
+	}
+	if g.drawOfferedBy != "" {
+		g.drawOfferedBy = g.drawOfferedBy.Opponent()
+	}
+	if g.winner != "" {
+		g.winner = g.winner.Opponent()
+	}
+	if g.puzzle != nil {
+		g.puzzle.solver = g.puzzle.solver.Opponent()
+	}
+
+	g.out.Write(fmt.Sprintf("Board rotated, %s to move.\n", g.playerToMove))
+}
+
+// HandleTry reports whether a move would be legal, and what would come of it, without making it.
+// With the fog of war, the outcome of challenging a hidden piece is left unknown.
+func (g *GG) HandleTry(cmd string) {
+	g.redraw = false
+
+	tokens := tokenize(cmd)
+	move := newMove(tokens[2], tokens[3])
+	moveType, err := validateMove(g.board, g.playerToMove, move, g.rules)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("%s is invalid: %v.\n", g.moveString(move), err))
+		return
+	}
+
+	if moveType == moveMove {
+		g.out.Write(fmt.Sprintf("%s is a legal move.\n", g.moveString(move)))
+		return
+	}
+
+	// The outcome can only be told if the side to move knows what it's challenging.
+	challenger := g.board[move.fromX][move.fromY].piece
+	target := g.view(g.board)[move.toX][move.toY].piece
+	if target.code == hidden {
+		g.out.Write(fmt.Sprintf("%s is a legal challenge against a piece hidden by the fog of war.\n", g.moveString(move)))
+		return
+	}
+	result := resolveChallenge(challenger, target)
+	g.out.Write(fmt.Sprintf("%s is a legal challenge: %s vs %s, %s.\n", g.moveString(move), challenger.code, target.code, describeResult(result)))
+}
+
+// HandleSuggest shows the move the AI would make for the side to move. Outside of analysis mode, the AI
+// only knows what the side to move knows: the enemy pieces that aren't revealed are guessed.
+func (g *GG) HandleSuggest() {
+	g.redraw = false
+
+	if g.status != gameInProgress {
+		g.out.Write("Moves can only be suggested during the game.\n")
+		return
+	}
+
+	engine := NewGGEngine(g.playerToMove, suggestBudget)
+	engine.SetSeed(g.rng.Int63())
+	engine.SetFog(!g.analysis)
+
+	move, ok := engine.BestMove(g.board, g.rules)
+	g.recordSearch(engine.stats)
+	if !ok {
+		g.out.Write(fmt.Sprintf("%s has no legal moves.\n", g.playerToMove))
+		return
+	}
+	g.out.Write(fmt.Sprintf("Suggested move: %s\n", g.moveString(move)))
+}
+
+// recordSearch keeps the stats of an AI search for the ai-stats command, and logs them.
+func (g *GG) recordSearch(stats GGSearchStats) {
+	g.lastSearch = &stats
+	g.logger.Infof("AI search: %s", stats)
+}
+
+// HandleAIStats shows how long the last AI search took, how deep it got and how many positions it evaluated.
+func (g *GG) HandleAIStats() {
+	g.redraw = false
+
+	if g.lastSearch == nil {
+		g.out.Write("The AI hasn't searched yet.\n")
+		return
+	}
+	g.out.Write(fmt.Sprintf("Last AI search: %s\n", g.lastSearch))
+}
+
+// HandleSaveBin saves the game into the binary file at the given path.
+func (g *GG) HandleSaveBin(cmd string) {
+	g.redraw = false
+	path := tokenize(cmd)[1]
+
+	f, err := os.Create(path)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to save to %s: %v\n", path, err))
+		return
+	}
+	defer f.Close()
+
+	if err := g.EncodeBinary(f); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to save to %s: %v\n", path, err))
+		return
+	}
+	g.out.Write(fmt.Sprintf("Game saved to %s\n", path))
+}
+
+// HandleLoadBin loads the game from the binary file at the given path.
+func (g *GG) HandleLoadBin(cmd string) {
+	path := tokenize(cmd)[1]
+
+	f, err := os.Open(path)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to load file %s: %v\n", path, err))
+		return
+	}
+	defer f.Close()
+
+	if err := g.decodeBinary(f); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to load file %s: %v\n", path, err))
+		return
+	}
+	g.out.Write(fmt.Sprintf("File %s successfully loaded\n", path))
+}
+
+// HandleImportJSON loads the position from the JSON file at the given path, and starts the game.
+func (g *GG) HandleImportJSON(cmd string) {
+	path := tokenize(cmd)[2]
+
+	f, err := os.Open(path)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to import file %s: %v\n", path, err))
+		return
+	}
+	defer f.Close()
+
+	if err := g.ImportJSON(f); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to import file %s: %v\n", path, err))
+		return
+	}
+	g.out.Write(fmt.Sprintf("File %s successfully imported\n", path))
+}
+
+// HandleImportPGN replays the game in the transcript at the given path (see ImportPGN).
+func (g *GG) HandleImportPGN(cmd string) {
+	path := tokenize(cmd)[2]
+
+	f, err := os.Open(path)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to import file %s: %v\n", path, err))
+		return
+	}
+	defer f.Close()
+
+	if err := g.ImportPGN(f); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to import file %s: %v\n", path, err))
+		return
+	}
+	g.out.Write(fmt.Sprintf("File %s successfully imported\n", path))
+}
+
+// HandleShare shows the current position as a share token. The token gives away every piece,
+// so positions can't be shared while the fog of war is on.
+func (g *GG) HandleShare() {
+	g.redraw = false
+
+	if g.fog {
+		g.out.Write("Positions can't be shared while the fog of war is on.\n")
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Share token: %s\n", shareToken(g.board, g.playerToMove)))
+}
+
+// HandleOpen loads the position of the given share token, and starts the game from it.
+func (g *GG) HandleOpen(cmd string) {
+	token := tokenize(cmd)[1]
+	if err := g.OpenShareToken(token); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to open token: %v\n", err))
+		return
+	}
+	g.out.Write("Shared position successfully opened\n")
+}
+
+// HandleExportPosition writes the position into the file at the given path, in the JSON import format
+// or as a .gggn game file depending on the command.
+func (g *GG) HandleExportPosition(cmd string) {
+	g.redraw = false
+	tokens := tokenize(cmd)
+	format, path := tokens[1], tokens[2]
+
+	f, err := os.Create(path)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to export to %s: %v\n", path, err))
+		return
+	}
+	defer f.Close()
+
+	export := g.ExportJSON
+	if format == "gggn" {
+		export = g.ExportGGGN
+	}
+	if err := export(f); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to export to %s: %v\n", path, err))
+		return
+	}
+	g.out.Write(fmt.Sprintf("Position exported to %s\n", path))
+}
+
+// HandleExportTranscript writes the game's moves into a transcript file (see ExportPGN).
+func (g *GG) HandleExportTranscript(cmd string) {
+	g.redraw = false
+	path := tokenize(cmd)[2]
+
+	f, err := os.Create(path)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to export to %s: %v\n", path, err))
+		return
+	}
+	defer f.Close()
+
+	if err := g.ExportPGN(f); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to export to %s: %v\n", path, err))
+		return
+	}
+	g.out.Write(fmt.Sprintf("Moves exported to %s\n", path))
+}
+
+// HandleExportFrames writes the board as the GUI draws it into the given directory, once for the
+// starting position and once after every move, for assembling into an animated replay. The directory
+// is created if needed, but frames are never overwritten: the export fails if there are some already.
+func (g *GG) HandleExportFrames(cmd string) {
+	g.redraw = false
+	dir := tokenize(cmd)[2]
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to export to %s: %v\n", dir, err))
+		return
+	}
+
+	existing, err := filepath.Glob(filepath.Join(dir, framePrefix+"*"+frameExtension))
+	if err != nil || len(existing) > 0 {
+		g.out.Write(fmt.Sprintf("Unable to export to %s: it already has frames.\n", dir))
+		return
+	}
+
+	// Number the frames with as many digits as the last one needs, so that they sort by name.
+	digits := len(strconv.Itoa(len(g.events)))
+	for n := 0; n <= len(g.events); n++ {
+		path := filepath.Join(dir, fmt.Sprintf("%s%0*d%s", framePrefix, digits, n, frameExtension))
+		if err := os.WriteFile(path, []byte(g.gui.Render(g.view(g.replay(n)))), 0o644); err != nil {
+			g.out.Write(fmt.Sprintf("Unable to export to %s: %v\n", dir, err))
+			return
+		}
+	}
+	g.out.Write(fmt.Sprintf("Exported %d frames to %s\n", len(g.events)+1, dir))
+}
+
+// HandleRewind shows the board as it was the given number of moves ago, without changing the game.
+func (g *GG) HandleRewind(cmd string) {
+	g.redraw = false
+
+	n, _ := strconv.Atoi(tokenize(cmd)[1])
+	if n > len(g.events) {
+		g.out.Write(fmt.Sprintf("Can only rewind up to %d moves.\n", len(g.events)))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Board as of %d moves ago:\n", n))
+	g.gui.Draw(g.view(g.replay(len(g.events) - n)))
+}
+
+// HandleRestart puts the board back to how it was set up, undoing every move made since.
+func (g *GG) HandleRestart() {
+	if g.status != gameInProgress {
+		g.out.Write("Only a game in progress can be restarted.\n")
+		return
+	}
+
+	g.undoTo(0)
+	g.out.Write(fmt.Sprintf("Game restarted, %s to move.\n", g.playerToMove))
+}
+
+// HandleUndoTo undoes every move after the given one, so that they can be redone later.
+func (g *GG) HandleUndoTo(cmd string) {
+	n, _ := strconv.Atoi(tokenize(cmd)[1])
+	g.undoToMove(n)
+}
+
+// HandleUndo undoes the latest move, so that it can be redone later.
+func (g *GG) HandleUndo() {
+	g.undoToMove(len(g.events) - 1)
+}
+
+// undoToMove undoes every move after the nth one, if the game has come that far.
+func (g *GG) undoToMove(n int) {
+	if g.status != gameInProgress {
+		g.out.Write("Moves can only be undone during the game.\n")
+		return
+	}
+
+	if len(g.events) == 0 {
+		g.out.Write("No moves have been made yet.\n")
+		return
+	}
+
+	if n < 0 || n >= len(g.events) {
+		g.out.Write(fmt.Sprintf("Can only undo back to a move from 0 to %d.\n", len(g.events)-1))
+		return
+	}
+
+	g.undoTo(n)
+	g.out.Write(fmt.Sprintf("Back to move %d, %s to move.\n", n, g.playerToMove))
+}
+
+// HandleRedo makes the latest undone move again.
+func (g *GG) HandleRedo() {
+	if len(g.redoMoves) == 0 {
+		g.out.Write("There are no undone moves to redo.\n")
+		return
+	}
+
+	if err := g.makeMove(g.redoMoves[0]); err != nil {
+		g.out.Write(fmt.Sprintf("Unable to redo %s: %v.\n", g.redoMoves[0], err))
+		return
+	}
+	g.redoMoves = g.redoMoves[1:]
+}
+
+// undoTo reverts the game to how it was after its first n moves, by replaying them from the setup.
+// The moves after those are kept, in order, to be redone.
+func (g *GG) undoTo(n int) {
+	events, notes, startedAt := g.events, g.notes, g.startedAt
+	timeLeft := map[GGPlayer]time.Duration{}
+	for player, left := range g.timeLeft {
+		timeLeft[player] = left
+	}
+	redo := []GGMove{}
+	for _, e := range events[n:] {
+		redo = append(redo, e.move)
+	}
+	redo = append(redo, g.redoMoves...)
+
+	// Whoever made the first move is the one to move first again.
+	if len(events) > 0 {
+		g.playerToMove = events[0].player
+	}
+
+	// Replaying the moves shouldn't notify anyone of their challenges again, scout anew, nor trace them.
+	// The pieces that were scouted are revealed again as they were.
+	observers, scouting, trace := g.challengeObservers, g.scoutPractice, g.trace
+	g.challengeObservers, g.scoutPractice, g.trace = nil, false, nil
+	openingScout := g.openingScout
+
+	g.board = g.setup
+	g.beginGame()
+	g.openingScout = openingScout
+	g.revealScouted(openingScout)
+	for i, e := range events[:n] {
+		g.makeMove(e.move)
+		g.events[i].scouted = e.scouted
+		g.revealScouted(e.scouted)
+	}
+
+	g.challengeObservers, g.scoutPractice, g.trace = observers, scouting, trace
+
+	// What's kept of the records stays as it was.
+	g.startedAt = startedAt
+	for i := range g.events {
+		g.events[i].time = events[i].time
+	}
+	for _, note := range notes {
+		if note.ply <= n {
+			g.notes = append(g.notes, note)
+		}
+	}
+	g.redoMoves = redo
+
+	// Undoing moves doesn't give back the time spent on them.
+	for player, left := range timeLeft {
+		g.timeLeft[player] = left
+	}
+
+	// The puzzle can be attempted again.
+	if g.puzzle != nil {
+		g.puzzle.outcome = ""
+		g.puzzle.reported = false
+	}
+}
+
+// HandleCompare loads two game files, and shows both boards as of the first move at which they differ.
+// The game itself is left untouched.
+func (g *GG) HandleCompare(cmd string) {
+	g.redraw = false
+
+	tokens := tokenize(cmd)
+	games := []*GG{}
+	for _, path := range tokens[1:] {
+		game := g.sandbox()
+		game.board = GGBoard{}
+		if err := game.loadFile(path); err != nil {
+			g.out.Write(fmt.Sprintf("Unable to load file %s: %v\n", path, err))
+			return
+		}
+		games = append(games, game)
+	}
+
+	a, b := games[0], games[1]
+	if a.setup != b.setup {
+		g.out.Write("The games start from different setups.\n")
+		g.gui.Draw(g.view(a.setup))
+		g.gui.Draw(g.view(b.setup))
+		return
+	}
+
+	n := 0
+	for n < len(a.events) && n < len(b.events) && a.events[n].move == b.events[n].move {
+		n++
+	}
+
+	if n == len(a.events) && n == len(b.events) {
+		g.out.Write(fmt.Sprintf("The games are the same, with %d moves.\n", n))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("The games differ at move %d:\n", n+1))
+	for i, game := range games {
+		next := "the game ends"
+		if n < len(game.events) {
+			next = game.events[n].move.String()
+		}
+		g.out.Write(fmt.Sprintf("\t%s: %s\n", tokens[i+1], next))
+	}
+
+	g.out.Write("Boards before the move:\n")
+	g.gui.Draw(g.view(a.replay(n)))
+	g.gui.Draw(g.view(b.replay(n)))
+}
+
+// HandleOpenings tallies the first few moves of each side across every game file in the given directory,
+// and shows how often each of them was played. Files that can't be loaded are reported and skipped.
+// The game itself is left untouched.
+func (g *GG) HandleOpenings(cmd string) {
+	g.redraw = false
+
+	dir := tokenize(cmd)[1]
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Unable to read directory %s: %v\n", dir, err))
+		return
+	}
+
+	// The number of times each move was played, by side and by move number.
+	tallies := map[GGPlayer][openingMoves]map[GGMove]int{}
+	for _, player := range []GGPlayer{playerWhite, playerBlack} {
+		t := [openingMoves]map[GGMove]int{}
+		for i := range t {
+			t[i] = map[GGMove]int{}
+		}
+		tallies[player] = t
+	}
+
+	games := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != gggnExtension {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		game := g.sandbox()
+		game.board = GGBoard{}
+		if err := game.loadFile(path); err != nil {
+			g.out.Write(fmt.Sprintf("Skipping %s: %v\n", path, err))
+			continue
+		}
+		games++
+
+		played := map[GGPlayer]int{}
+		for _, e := range game.events {
+			if n := played[e.player]; n < openingMoves {
+				tallies[e.player][n][e.move]++
+				played[e.player]++
+			}
+		}
+	}
+
+	if games == 0 {
+		g.out.Write(fmt.Sprintf("No games found in %s.\n", dir))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Openings of %d games:\n", games))
+	for _, player := range []GGPlayer{playerWhite, playerBlack} {
+		for i, counts := range tallies[player] {
+			if len(counts) == 0 {
+				continue
+			}
+
+			// The most played moves come first, ties in the order of their notation.
+			moves := []GGMove{}
+			for m := range counts {
+				moves = append(moves, m)
+			}
+			sort.Slice(moves, func(a, b int) bool {
+				if counts[moves[a]] != counts[moves[b]] {
+					return counts[moves[a]] > counts[moves[b]]
+				}
+				return moves[a].String() < moves[b].String()
+			})
+
+			g.out.Write(fmt.Sprintf("%s's move %d:\n", player, i+1))
+			for _, m := range moves {
+				g.out.Write(fmt.Sprintf("\t%s: %d\n", m, counts[m]))
+			}
+		}
+	}
+}
+
+// HandleStats shows aggregate statistics of the moves made so far, computed from the recorded events.
+func (g *GG) HandleStats() {
+	g.redraw = false
+
+	challenges := 0
+	distance := 0
+	for _, e := range g.events {
+		if e.moveType == moveChallenge {
+			challenges++
+		}
+		distance += moveDistance(e.move)
+	}
+
+	g.out.Write("Stats:\n")
+	g.out.Write(fmt.Sprintf("\tMoves: %d (%d plain, %d challenges)\n", len(g.events), len(g.events)-challenges, challenges))
+	if len(g.events) > 0 {
+		g.out.Write(fmt.Sprintf("\tAverage move distance: %.2f\n", float64(distance)/float64(len(g.events))))
+	}
+
+	captured := g.graveyard()
+	g.out.Write("\tCaptured pieces:\n")
+	for _, code := range g.graveyardCodes() {
+		white, black := captured[playerWhite][code], captured[playerBlack][code]
+		if white+black > 0 {
+			g.out.Write(fmt.Sprintf("\t\t%s: %d White, %d Black\n", code, white, black))
+		}
+	}
+}
+
+// HandleCount shows how many of each piece both sides still have on the board, complementing the
+// captured pieces of the stats command. With the fog of war, only the side to move's pieces are counted,
+// unless in analysis mode.
+func (g *GG) HandleCount() {
+	g.redraw = false
+
+	counts := map[GGPlayer]map[GGPieceCode]int{playerWhite: {}, playerBlack: {}}
+	for x := range g.board {
+		for y := range g.board[x] {
+			if piece := g.board[x][y].piece; !piece.IsEmpty() {
+				counts[piece.player][piece.code]++
+			}
+		}
+	}
+
+	if g.fog && !g.analysis {
+		g.out.Write(fmt.Sprintf("%s's pieces on the board:\n", g.playerToMove))
+		for _, code := range pieceCodes {
+			if n := counts[g.playerToMove][code]; n > 0 {
+				g.out.Write(fmt.Sprintf("\t%s: %d\n", code, n))
+			}
+		}
+		return
+	}
+
+	g.out.Write("Pieces on the board:\n")
+	for _, code := range pieceCodes {
+		white, black := counts[playerWhite][code], counts[playerBlack][code]
+		if white+black > 0 {
+			g.out.Write(fmt.Sprintf("\t%s: %d White, %d Black\n", code, white, black))
+		}
+	}
+}
+
+// HandleDistances shows how many of the moves made so far covered each distance, in squares along
+// ranks and files. Pieces only move one square at a time in the standard game, so this mostly matters
+// for games played with longer moves.
+func (g *GG) HandleDistances() {
+	g.redraw = false
+
+	if len(g.events) == 0 {
+		g.out.Write("No moves have been made yet.\n")
+		return
+	}
+
+	counts := map[int]int{}
+	longest := 0
+	for _, e := range g.events {
+		d := moveDistance(e.move)
+		counts[d]++
+		if d > longest {
+			longest = d
+		}
+	}
+
+	if longest == 1 {
+		g.out.Write(fmt.Sprintf("All moves were single-square (%d in total).\n", len(g.events)))
+		return
+	}
+
+	g.out.Write("Move distances:\n")
+	for d := 1; d <= longest; d++ {
+		if counts[d] > 0 {
+			g.out.Write(fmt.Sprintf("\t%d-square moves: %d\n", d, counts[d]))
+		}
+	}
+}
+
+// HandleHeatmap shows, for each square, how many of the side to move's pieces attack it (can move into or
+// challenge it) or defend it (are next to it, if it's one of their own). Only their own pieces are considered.
+func (g *GG) HandleHeatmap() {
+	g.redraw = false
+
+	counts := influence(g.board, g.playerToMove, g.rules)
+	g.out.Write(fmt.Sprintf("Heatmap for %s:\n", g.playerToMove))
+	g.out.Write("     A B C D E F G H I\n")
+	for x := rows - 1; x >= 0; x-- {
+		g.out.Write(fmt.Sprintf("  %d ", x+1))
+		for y := 0; y < files; y++ {
+			if counts[x][y] == 0 {
+				g.out.Write(" .")
+			} else {
+				g.out.Write(fmt.Sprintf(" %d", counts[x][y]))
+			}
+		}
+		g.out.Write("\n")
+	}
+}
+
+// HandleLegend shows the piece code each symbol on the board stands for, in the active render mode.
+func (g *GG) HandleLegend() {
+	g.redraw = false
+
+	codes := pieceCodes
+	if g.fog {
+		codes = append(append([]GGPieceCode{}, pieceCodes...), hidden)
+	}
+
+	g.out.Write("Legend:\n")
+	for _, e := range g.gui.Legend(codes) {
+		if e.code == hidden {
+			g.out.Write(fmt.Sprintf("\t* %s: an enemy piece hidden by the fog of war\n", e.symbol))
+			continue
+		}
+		g.out.Write(fmt.Sprintf("\t* %s: %s\n", e.symbol, e.code))
+	}
+	g.out.Write("Both players' pieces are drawn alike, so the board doesn't tell them apart.\n")
+}
+
+// HandleKnown lists the enemy pieces whose identity the side to move has found out.
+func (g *GG) HandleKnown() {
+	g.redraw = false
+
+	enemy := g.playerToMove.Opponent()
+	known := []string{}
+	for x := range g.board {
+		for y := range g.board[x] {
+			if piece := g.board[x][y].piece; piece.player == enemy && piece.revealed {
+				known = append(known, fmt.Sprintf("%s on %s", piece.code, g.square(x, y)))
+			}
+		}
+	}
+
+	if len(known) == 0 {
+		g.out.Write(fmt.Sprintf("None of %s's pieces are known.\n", enemy))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Known %s pieces:\n", enemy))
+	for _, k := range known {
+		g.out.Write(fmt.Sprintf("\t%s\n", k))
+	}
+}
+
+// HandleDefense lists the pieces next to a player's Flag, which guard it and can recapture on its square.
+// Outside of analysis mode, players can only look into their own Flag.
+func (g *GG) HandleDefense(cmd string) {
+	g.redraw = false
+
+	player := g.playerToMove
+	if tokens := tokenize(cmd); len(tokens) > 1 {
+		if !g.analysis {
+			g.out.Write("Only the side to move's Flag can be looked into outside of analysis mode.\n")
+			return
+		}
+		player = GGPlayer(tokens[1])
+	}
+
+	flagX, flagY, ok := findPiece(g.board, player, flag)
+	if !ok {
+		g.out.Write(fmt.Sprintf("%s has no Flag on the board.\n", player))
+		return
+	}
+
+	defense := influence(g.board, player, g.rules)[flagX][flagY]
+	attack := influence(g.board, player.Opponent(), g.rules)[flagX][flagY]
+	g.out.Write(fmt.Sprintf("%s's Flag on %s: %d defenders, %d attackers.\n", player, g.square(flagX, flagY), defense, attack))
+	for _, d := range directions {
+		x, y := flagX+d[0], flagY+d[1]
+		if isOnBoard(x, y) && g.board[x][y].piece.player == player {
+			g.out.Write(fmt.Sprintf("\t%s on %s\n", g.board[x][y].piece.code, g.square(x, y)))
+		}
+	}
+}
+
+// HandleFlagThreats lists the enemy pieces that could capture a player's Flag on their next move.
+// Outside of analysis mode, players can only look into their own Flag, and only as far as they can
+// see: enemy pieces hidden by the fog of war are listed as possible threats.
+func (g *GG) HandleFlagThreats(cmd string) {
+	g.redraw = false
+
+	player := g.playerToMove
+	board := g.view(g.board)
+	if tokens := tokenize(cmd); len(tokens) > 1 {
+		if !g.analysis {
+			g.out.Write("Only the side to move's Flag can be looked into outside of analysis mode.\n")
+			return
+		}
+		player = GGPlayer(tokens[1])
+	}
+	if g.analysis {
+		board = g.board
+	}
+
+	flagX, flagY, ok := findPiece(board, player, flag)
+	if !ok {
+		g.out.Write(fmt.Sprintf("%s has no Flag on the board.\n", player))
+		return
+	}
+
+	threatened := []string{}
+	for _, m := range legalMoves(board, player.Opponent(), g.rules) {
+		if m.toX != flagX || m.toY != flagY {
+			continue
+		}
+
+		attacker := board[m.fromX][m.fromY].piece
+		from := g.square(m.fromX, m.fromY)
+		switch {
+		case attacker.code == hidden:
+			threatened = append(threatened, fmt.Sprintf("\t* Unknown piece on %s might capture it\n", from))
+		case resolveChallenge(attacker, board[flagX][flagY].piece) == resChallengerWins:
+			threatened = append(threatened, fmt.Sprintf("\t* %s on %s captures it\n", attacker.code, from))
+		}
+	}
+
+	flagSquare := g.square(flagX, flagY)
+	if len(threatened) == 0 {
+		g.out.Write(fmt.Sprintf("%s's Flag on %s is safe for now.\n", player, flagSquare))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Threats against %s's Flag on %s:\n", player, flagSquare))
+	for _, t := range threatened {
+		g.out.Write(t)
+	}
+}
+
+// HandleAnalyze lists the enemy pieces that could challenge and beat one of the side to move's pieces
+// on their next move, and the pieces they threaten. It gives away the enemy's pieces, so it's only
+// available in analysis mode.
+func (g *GG) HandleAnalyze() {
+	g.redraw = false
+
+	if !g.analysis {
+		g.out.Write("Threats can only be analyzed in analysis mode.\n")
+		return
+	}
+
+	player := g.playerToMove
+	moves := threats(g.board, player, g.rules)
+	if len(moves) == 0 {
+		g.out.Write(fmt.Sprintf("None of %s's pieces are under threat.\n", player))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Threats against %s:\n", player))
+	threatened := []string{}
+	seen := map[string]bool{}
+	for _, m := range moves {
+		attacker := g.board[m.fromX][m.fromY].piece
+		target := g.board[m.toX][m.toY].piece
+		to := g.square(m.toX, m.toY)
+		g.out.Write(fmt.Sprintf("\t* %s on %s beats %s on %s\n", attacker.code, g.square(m.fromX, m.fromY), target.code, to))
+
+		if !seen[to] {
+			seen[to] = true
+			threatened = append(threatened, fmt.Sprintf("%s on %s", target.code, to))
+		}
+	}
+	g.out.Write(fmt.Sprintf("Under threat: %s.\n", strings.Join(threatened, ", ")))
+}
+
+// HandleForks lists the side to move's pieces that have two or more enemy pieces they could challenge
+// and beat on their next move, along with those targets. Like analyze, it needs every piece known, so
+// it's only available in analysis mode.
+func (g *GG) HandleForks() {
+	g.redraw = false
+
+	if !g.analysis {
+		g.out.Write("Forks can only be looked for in analysis mode.\n")
+		return
+	}
+
+	player := g.playerToMove
+	attackers := [][2]int{}
+	targets := map[[2]int][]string{}
+	for _, m := range threats(g.board, player.Opponent(), g.rules) {
+		from := [2]int{m.fromX, m.fromY}
+		if _, ok := targets[from]; !ok {
+			attackers = append(attackers, from)
+		}
+		target := g.board[m.toX][m.toY].piece
+		targets[from] = append(targets[from], fmt.Sprintf("%s on %s", target.code, g.square(m.toX, m.toY)))
+	}
+
+	forks := []string{}
+	for _, from := range attackers {
+		if len(targets[from]) < 2 {
+			continue
+		}
+		attacker := g.board[from[0]][from[1]].piece
+		forks = append(forks, fmt.Sprintf("\t* %s on %s forks %s\n", attacker.code, g.square(from[0], from[1]), strings.Join(targets[from], " and ")))
+	}
+
+	if len(forks) == 0 {
+		g.out.Write(fmt.Sprintf("%s has no forks.\n", player))
+		return
+	}
+
+	g.out.Write(fmt.Sprintf("Forks for %s:\n", player))
+	for _, f := range forks {
+		g.out.Write(f)
+	}
+}
+
+// HandleEval shows how the AI scores the position as it stands, without searching any moves ahead.
+// The score is from White's point of view: positive when White is ahead, negative when Black is.
+// It counts every piece, hidden or not, so it's only available in analysis mode.
+func (g *GG) HandleEval() {
+	g.redraw = false
+
+	if !g.analysis {
+		g.out.Write("The position can only be evaluated in analysis mode.\n")
+		return
+	}
+
+	score := evaluate(g.board, playerWhite)
+	switch {
+	case score > 0:
+		g.out.Write(fmt.Sprintf("Evaluation: %+d, %s is ahead.\n", score, playerWhite))
+	case score < 0:
+		g.out.Write(fmt.Sprintf("Evaluation: %+d, %s is ahead.\n", score, playerBlack))
+	default:
+		g.out.Write("Evaluation: 0, the position is even.\n")
+	}
+}
+
+// HandleReview replays the moves made so far, listing the blunders among them: the challenges a side
+// lost, the pieces it left open to a winning challenge, and the enemy Flags it could have captured
+// but didn't. Like analyze, it judges with every piece known, so it's only available in analysis mode.
+func (g *GG) HandleReview() {
+	g.redraw = false
+
+	if !g.analysis {
+		g.out.Write("Games can only be reviewed in analysis mode.\n")
+		return
+	}
+
+	if len(g.events) == 0 {
+		g.out.Write("No moves have been made yet.\n")
+		return
+	}
+
+	blunders := 0
+	board := g.setup
+	for _, e := range g.events {
+		for _, reason := range reviewMove(board, e.move, g.rules, g.square) {
+			if blunders == 0 {
+				g.out.Write("Blunders:\n")
+			}
+			blunders++
+			g.out.Write(fmt.Sprintf("\t%d. %s %s: %s.\n", e.ply, e.player, g.moveString(e.move), reason))
+		}
+		playMove(&board, e.move, g.rules)
+	}
+
+	if blunders == 0 {
+		g.out.Write(fmt.Sprintf("No blunders found in %d moves.\n", len(g.events)))
+	}
+}
+
+// HandleRank shows the full name of the given piece code, its place in the hierarchy and its power,
+// along with any exception to the hierarchy that applies to it.
+func (g *GG) HandleRank(cmd string) {
+	g.redraw = false
+
+	code := GGPieceCode(tokenize(cmd)[1])
+	name, ok := pieceNames[code]
+	if !ok {
+		g.out.Write(fmt.Sprintf("Unknown piece code %q.\n", code))
+		return
+	}
+
+	place := 0
+	for i, c := range pieceCodes {
+		if c == code {
+			place = i + 1
+		}
+	}
+
+	g.out.Write(fmt.Sprintf("%s (%s): %d of %d in the hierarchy, power %d.\n", code, name, place, len(pieceCodes), GGPiece{code: code}.Power()))
+	if rule, ok := pieceRules[code]; ok {
+		g.out.Write(fmt.Sprintf("%s\n", rule))
+	}
+}
+
+// HandleFairness reports any difference between the compositions of the two armies on the board.
+func (g *GG) HandleFairness() {
+	g.redraw = false
+
+	asymmetries := armyAsymmetries(g.board)
+	if len(asymmetries) == 0 {
+		g.out.Write("Both armies are made up of the same pieces.\n")
+		return
+	}
+
+	g.out.Write("The armies differ:\n")
+	for _, a := range asymmetries {
+		g.out.Write(fmt.Sprintf("\t* %s\n", a))
+	}
+}
+
+// HandleOfferDraw has the side to move offer a draw to the other side.
+func (g *GG) HandleOfferDraw() {
+	g.redraw = false
+
+	if g.status != gameInProgress {
+		g.out.Write("A draw can only be offered during the game.\n")
+		return
+	}
+
+	if g.drawOfferedBy != "" {
+		g.out.Write(fmt.Sprintf("%s's draw offer is still pending.\n", g.drawOfferedBy))
+		return
+	}
+
+	g.drawOfferedBy = g.playerToMove
+}
+
+// HandleFog turns the fog of war on or off. So that it can't be used to peek at the enemy pieces,
+// it can't be toggled during a game outside of analysis mode.
+func (g *GG) HandleFog(cmd string) {
+	if g.status == gameInProgress && !g.analysis {
+		g.redraw = false
+		g.out.Write("The fog of war can only be toggled between games or in analysis mode.\n")
+		return
+	}
+
+	g.fog = tokenize(cmd)[1] == "on"
+}
+
+// HandleNotation switches how squares are shown to the players.
+func (g *GG) HandleNotation(cmd string) {
+	g.redraw = false
+	g.notation = GGNotation(tokenize(cmd)[1])
+	g.out.Write(fmt.Sprintf("Squares are now shown in %s notation (ex: %s).\n", g.notation, g.square(1, 1)))
+}
+
+// square returns how the square at the given index is shown to the players, in the game's notation.
+func (g *GG) square(x int, y int) string {
+	if g.notation == notationNumeric {
+		return squareAddressToNumeric(x, y)
+	}
+
+	return squareAddressToCoordinates(x, y)
+}
+
+// moveString returns how the move is shown to the players, in the game's notation.
+func (g *GG) moveString(m GGMove) string {
+	return fmt.Sprintf("%s %s %s", cmdMove, g.square(m.fromX, m.fromY), g.square(m.toX, m.toY))
+}
+
+// HandleBarrier turns the given empty square into a barrier, or a barrier back into an empty square.
+// Barriers are part of the board's layout, so they can only be changed before the game starts.
+func (g *GG) HandleBarrier(cmd string) {
+	if g.status == gameInProgress {
+		g.redraw = false
+		g.out.Write("Barriers can only be changed before the game starts.\n")
+		return
+	}
+
+	coordinates := tokenize(cmd)[1]
+	x, y := coordinatesToSquareAddress(coordinates)
+	square := &g.board[x][y]
+	if !square.IsEmpty() {
+		g.redraw = false
+		g.out.Write(fmt.Sprintf("%s is occupied, only empty squares can be barriers.\n", coordinates))
+		return
+	}
+
+	square.barrier = !square.barrier
+	if square.barrier {
+		g.out.Write(fmt.Sprintf("%s is now a barrier.\n", coordinates))
+		return
+	}
+	g.out.Write(fmt.Sprintf("%s is no longer a barrier.\n", coordinates))
+}
+
+// HandleShuffle rearranges the given side's pieces at random among the squares they're on, for practicing
+// against setups that aren't known in advance. The same pieces stay on the same squares, so the army and
+// the ranks it's set up on are kept. Pass -seed to shuffle the same way every time.
+func (g *GG) HandleShuffle(cmd string) {
+	if g.status != gamePreSetup && g.status != gameSetup {
+		g.redraw = false
+		g.out.Write("Pieces can only be shuffled during setup.\n")
+		return
+	}
+
+	player := GGPlayer(tokenize(cmd)[1])
+	squares := [][2]int{}
+	pieces := []GGPiece{}
+	for x := range g.board {
+		for y := range g.board[x] {
+			piece := g.board[x][y].piece
+			if piece.player != player {
+				continue
+			}
+			if !g.inSetupRanks(player, x) {
+				g.redraw = false
+				g.out.Write(fmt.Sprintf("%s's %s on %s is outside of its first %d ranks, unable to shuffle.\n", player, piece.code, g.square(x, y), g.setupRanks))
+				return
+			}
+			squares = append(squares, [2]int{x, y})
+			pieces = append(pieces, piece)
+		}
+	}
+
+	if len(pieces) < 2 {
+		g.redraw = false
+		g.out.Write(fmt.Sprintf("%s doesn't have enough pieces to shuffle.\n", player))
+		return
+	}
+
+	g.rng.Shuffle(len(pieces), func(i, j int) {
+		pieces[i], pieces[j] = pieces[j], pieces[i]
+	})
+	for i, square := range squares {
+		g.board[square[0]][square[1]].piece = pieces[i]
+	}
+	g.out.Write(fmt.Sprintf("Shuffled %s's %d pieces.\n", player, len(pieces)))
+}
+
+// HandleWait pauses for the duration in the given command (ex: "wait 1.5s").
+func (g *GG) HandleWait(cmd string) {
+	g.redraw = false
+
+	d, err := parseWait(tokenize(cmd)[1])
+	if err != nil {
+		g.out.Write(fmt.Sprintf("Invalid wait command: %v\n", err))
+		return
+	}
+	g.sleep(d)
+}
+
+// parseWait reads how long to wait for, which can't be negative.
+func parseWait(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q, expected one such as 2s or 500ms", value)
+	}
+
+	return d, nil
+}
+
+// HandleSwapSides gives the turn to the other side, so that its replies can be explored.
+func (g *GG) HandleSwapSides() {
+	if !g.analysis {
+		g.out.Write("Sides can only be swapped in analysis mode.\n")
+		return
+	}
+
+	if g.status != gameInProgress {
+		g.out.Write("Sides can only be swapped during the game.\n")
+		return
+	}
+
+	g.playerToMove = g.playerToMove.Opponent()
+}
+
+// HandleRespondDraw has the side that was offered a draw accept or decline it. The offer is made on the
+// offering side's turn, so it can only be responded to once that side has moved.
+func (g *GG) HandleRespondDraw(accept bool) {
+	if g.status != gameInProgress || g.drawOfferedBy == "" {
+		g.out.Write("There is no draw offer to respond to.\n")
+		return
+	}
+
+	if g.playerToMove == g.drawOfferedBy {
+		g.redraw = false
+		g.out.Write(fmt.Sprintf("The draw was offered by %s, only %s can respond to it after %s's move.\n",
+			g.drawOfferedBy, g.drawOfferedBy.Opponent(), g.drawOfferedBy))
+		return
+	}
+
+	g.drawOfferedBy = ""
+	if accept {
+		g.status = gameOver
+		g.endReason = endAgreement
+	}
+}
+
+// HandleMove moves a piece into the target square.
+func (g *GG) HandleMove(cmd string) {
+	tokens := tokenize(cmd)
+	if err := checkArity(tokens, 3); err != nil {
+		g.rejected = true
+		g.out.Write(fmt.Sprintf("Invalid MV command: %v\n", err))
+		return
+	}
+	from := tokens[1]
+	to := tokens[2]
+
+	player := g.playerToMove
+	guarded := g.isFlagGuarded(player)
+	if err := g.makeMove(newMove(from, to)); err != nil {
+		g.rejected = true
+		g.out.Write(fmt.Sprintf("Invalid move: %v.\n", err))
+		return
+	}
+
+	if g.rules.flagGuardWarning && guarded && !g.isFlagGuarded(player) {
+		x, y, _ := findPiece(g.board, player, flag)
+		g.out.Write(fmt.Sprintf("Careful, %s's Flag on %s has no pieces guarding it anymore.\n", player, g.square(x, y)))
+	}
+
+	// A new move takes the place of the undone ones.
+	g.redoMoves = nil
+	g.autosave()
+}
+
+// isFlagGuarded checks if the player's Flag has any of the player's pieces next to it, as counted by
+// the defense command. A captured Flag isn't guarded.
+func (g *GG) isFlagGuarded(player GGPlayer) bool {
+	x, y, ok := findPiece(g.board, player, flag)
+	return ok && influence(g.board, player, g.rules)[x][y] > 0
+}
+
+// autosave hands the game over to the autosaver if enough moves were made since its last save.
+// The file is written in the background, so that a slow disk doesn't hold up the game.
+func (g *GG) autosave() {
+	if g.autosaver == nil || g.ply%g.autosaver.every != 0 {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := g.EncodeBinary(buf); err != nil {
+		g.logger.Errorf("unable to autosave: %v", err)
+		return
+	}
+	g.autosaver.Save(buf.Bytes())
+}
+
+// makeMove validates and makes the move for the side to move, recording it and switching sides.
+func (g *GG) makeMove(move GGMove) error {
+	fromX, fromY, toX, toY := move.fromX, move.fromY, move.toX, move.toY
+
+	moveType, err := validateMove(g.board, g.playerToMove, move, g.rules)
+	if err != nil {
+		return err
+	}
+
+	// The clock runs until the move is made.
+	now := g.timestamp()
+	if g.timeBudgets != nil {
+		g.timeLeft[g.playerToMove] -= now.Sub(g.turnStartedAt())
+		if g.timeLeft[g.playerToMove] <= 0 {
+			return errors.New("out of time")
+		}
+	}
+
+	g.logger.Debugf("Handling move type %v\n", moveType)
+	challenger := g.board[fromX][fromY].piece
+	target := g.board[toX][toY].piece
+	result := playMove(&g.board, move, g.rules)
+	if moveType == moveChallenge {
+		g.logger.Debugf("%v vs %v: %v\n", challenger.code, target.code, result)
+		for _, observer := range g.challengeObservers {
+			observer(challenger, target, result)
+		}
+
+		// The piece left standing gave itself away, unless the rules keep challenges secret.
+		if !g.board[toX][toY].IsEmpty() && !g.rules.hideChallenges {
+			g.board[toX][toY].piece.revealed = true
+		}
+
+		// Whoever loses their Flag in a challenge loses the game.
+		if target.code == flag && result == resChallengerWins {
+			g.winner = challenger.player
+			g.status = gameOver
+			g.endReason = endFlagCaptured
+		} else if challenger.code == flag && result != resChallengerWins {
+			g.winner = target.player
+			g.status = gameOver
+			g.endReason = endFlagCaptured
+		}
+	}
+
+	// Moving instead of responding declines the draw offer.
+	if g.drawOfferedBy == g.playerToMove.Opponent() {
+		g.drawOfferedBy = ""
+	}
+
+	// Switch sides after every valid move.
+	g.ply++
+	g.events = append(g.events, GGEvent{
+		ply:        g.ply,
+		player:     g.playerToMove,
+		move:       move,
+		moveType:   moveType,
+		challenger: challenger,
+		target:     target,
+		result:     result,
+		time:       now,
+	})
+	g.playerToMove = g.playerToMove.Opponent()
+	g.writeTrace()
+
+	if g.scoutPractice && g.status == gameInProgress {
+		g.events[len(g.events)-1].scouted = g.scout()
+	}
+	return nil
+}
+
+// writeTrace appends the position string to the trace, if tracing is enabled. It's written right away,
+// so that the trace is complete up to the last move even if the game crashes.
+func (g *GG) writeTrace() {
+	if g.trace == nil {
+		return
+	}
+
+	if _, err := io.WriteString(g.trace, positionString(g.board, g.playerToMove)+"\n"); err != nil {
+		g.logger.Errorf("unable to trace: %v", err)
+	}
+}
+
+// HandleTimeline lists every move made so far, along with how long each one took, and the notes between them.
+func (g *GG) HandleTimeline() {
+	g.redraw = false
+	if len(g.events) == 0 && len(g.notes) == 0 {
+		g.out.Write("No moves have been made yet.\n")
+		return
+	}
+
+	g.out.Write("Timeline:\n")
+	g.writeNotes(0)
+	previous := g.startedAt
+	for _, e := range g.events {
+		elapsed := e.time.Sub(previous).Round(time.Millisecond)
+		g.out.Write(fmt.Sprintf("\t%d. %s %s (+%s)\n", e.ply, g.playerName(e.player), e.move, elapsed))
+		g.writeNotes(e.ply)
+		previous = e.time
+	}
+}
+
+// HandleBattles lists every challenge made so far, in order. Both pieces of a challenge are known to
+// both players once it's made, so they're shown even with the fog of war -- unless the rules keep
+// challenges secret, in which case the enemy pieces stay hidden.
+func (g *GG) HandleBattles() {
+	g.redraw = false
+
+	battles := 0
+	for _, e := range g.events {
+		if e.moveType != moveChallenge {
+			continue
+		}
+
+		if battles == 0 {
+			g.out.Write("Battles:\n")
+		}
+		battles++
+		g.out.Write(fmt.Sprintf(
+			"\t%d. %s %s from %s vs %s %s on %s: %s\n",
+			e.ply, e.player, g.challengeCode(e.challenger), g.square(e.move.fromX, e.move.fromY),
+			e.target.player, g.challengeCode(e.target), g.square(e.move.toX, e.move.toY), describeResult(e.result),
+		))
+	}
+
+	if battles == 0 {
+		g.out.Write("No challenges have been made yet.\n")
+	}
+}
+
+// writeNotes writes the notes attached after the given number of moves, in the order they were made.
+func (g *GG) writeNotes(ply int) {
+	for _, n := range g.notes {
+		if n.ply == ply {
+			g.out.Write(fmt.Sprintf("\t# %s\n", n.text))
+		}
+	}
+}
+
+// parseNote parses the value of a note directive: the number of moves it comes after, if given, and its text.
+// example: "2 a bold opening" -> GGNote{ply: 2, text: "a bold opening"}
+func parseNote(value string) GGNote {
+	if ply, text, ok := strings.Cut(value, " "); ok {
+		if n, err := strconv.Atoi(ply); err == nil && n >= 0 {
+			return GGNote{ply: n, text: strings.TrimSpace(text)}
+		}
+	}
+
+	return GGNote{text: value}
+}
+
+// attachNotes attaches the notes read from a file to the game that was just replayed from it. Notes after
+// moves that the file doesn't include (ex: an exported position) are attached after its last move.
+func (g *GG) attachNotes(notes []GGNote) {
+	for _, n := range notes {
+		n.ply = min(n.ply, g.ply)
+		n.time = g.startedAt
+		if n.ply > 0 {
+			n.time = g.events[n.ply-1].time
+		}
+		g.notes = append(g.notes, n)
+	}
+}
+
+// HandleNote attaches a note to the game after the latest move.
+func (g *GG) HandleNote(cmd string) {
+	g.redraw = false
+	text := strings.TrimPrefix(cmd, cmdNote+" ")
+	g.notes = append(g.notes, GGNote{ply: g.ply, text: text, time: g.timestamp()})
+}
+
+// ==============================================================================
+// Binary save format definitions and methods.
+// ==============================================================================
+
+// binaryGame is the binary save format's layout of a game. Its fields are exported for encoding/gob.
+type binaryGame struct {
+	Board        [rows][files]binaryPiece
+	Setup        [rows][files]binaryPiece
+	Status       GGGameState
+	Winner       GGPlayer
+	EndReason    GGEndReason
+	PlayerToMove GGPlayer
+	Ply          int
+	StartedAt    time.Time
+	Events       []binaryEvent
+	Notes        []binaryNote
+	Names        map[GGPlayer]string
+
+	// The game's randomness, as its seed and the numbers drawn from it so far. Older saves don't have it.
+	Seed  int64
+	Draws uint64
+
+	// The squares that are barriers. Older saves don't have any.
+	Barriers []string
+
+	// The square that scouting practice revealed at the start of the game, empty if none.
+	OpeningScout string
+
+	// The clocks, if the game is timed: each side's budget, and what it had left when the game was saved.
+	// Older saves don't have them.
+	TimeBudgets map[GGPlayer]time.Duration
+	TimeLeft    map[GGPlayer]time.Duration
+}
+
+// binaryPiece is the binary save format's layout of a piece.
+type binaryPiece struct {
+	Code     GGPieceCode
+	Player   GGPlayer
+	Revealed bool
+	Frozen   bool
+}
+
+// binaryEvent is the binary save format's layout of an event.
+type binaryEvent struct {
+	Ply        int
+	Player     GGPlayer
+	Move       [4]int
+	MoveType   GGMoveType
+	Challenger binaryPiece
+	Target     binaryPiece
+	Result     GGChallengeResult
+	Time       time.Time
+
+	// The square that scouting practice revealed after the move, empty if none.
+	Scouted string
+}
+
+// binaryNote is the binary save format's layout of a note.
+type binaryNote struct {
+	Ply  int
+	Text string
+	Time time.Time
+}
+
+// EncodeBinary writes the board, turn, status, move history, notes, player names and clocks in the binary
+// save format.
+func (g *GG) EncodeBinary(w io.Writer) error {
+	save := binaryGame{
+		Status:       g.status,
+		Winner:       g.winner,
+		EndReason:    g.endReason,
+		PlayerToMove: g.playerToMove,
+		Ply:          g.ply,
+		StartedAt:    g.startedAt,
+		Names:        g.names,
+		Seed:         g.rngSource.seed,
+		Draws:        g.rngSource.draws,
+		Barriers:     barrierSquares(g.board),
+		OpeningScout: scoutedCoordinates(g.openingScout),
+		TimeBudgets:  g.timeBudgets,
+	}
+
+	// The time spent on the turn in progress counts too.
+	if g.timeBudgets != nil {
+		save.TimeLeft = map[GGPlayer]time.Duration{}
+		for player := range g.timeBudgets {
+			save.TimeLeft[player] = g.clockLeft(player)
+		}
+	}
+
+	for x := range g.board {
+		for y := range g.board[x] {
+			piece := g.board[x][y].piece
+			save.Board[x][y] = binaryPiece{Code: piece.code, Player: piece.player, Revealed: piece.revealed, Frozen: piece.frozen}
+			save.Setup[x][y] = binaryPiece{Code: g.setup[x][y].piece.code, Player: g.setup[x][y].piece.player}
+		}
+	}
+
+	for _, e := range g.events {
+		save.Events = append(save.Events, binaryEvent{
+			Ply:        e.ply,
+			Player:     e.player,
+			Move:       [4]int{e.move.fromX, e.move.fromY, e.move.toX, e.move.toY},
+			MoveType:   e.moveType,
+			Challenger: binaryPiece{Code: e.challenger.code, Player: e.challenger.player},
+			Target:     binaryPiece{Code: e.target.code, Player: e.target.player},
+			Result:     e.result,
+			Time:       e.time,
+			Scouted:    scoutedCoordinates(e.scouted),
+		})
+	}
+
+	for _, n := range g.notes {
+		save.Notes = append(save.Notes, binaryNote{Ply: n.ply, Text: n.text, Time: n.time})
+	}
+
+	// The version lets future formats tell older files apart.
+	if _, err := w.Write(append([]byte(binaryMagic), binaryVersion)); err != nil {
+		return err
+	}
+
+	return gob.NewEncoder(w).Encode(save)
+}
+
+// scoutedCoordinates returns the coordinates of the square that scouting practice revealed, empty if none.
+func scoutedCoordinates(square *[2]int) string {
+	if square == nil {
+		return ""
+	}
+
+	return squareAddressToCoordinates(square[0], square[1])
+}
+
+// parseScouted parses the coordinates of the square that scouting practice revealed, which are empty if none.
+func parseScouted(coordinates string) (*[2]int, error) {
+	if coordinates == "" {
+		return nil, nil
+	}
+
+	x, y, err := parseCoordinates(coordinates)
+	if err != nil {
+		return nil, err
+	}
+	return &[2]int{x, y}, nil
+}
+
+// DecodeBinary reads a game in the binary save format into a new game. The game has no input nor GUI,
+// and discards its output and logs: it's meant for looking into saves, while loadbin loads them into the
+// game being played (see decodeBinary).
+func DecodeBinary(r io.Reader) (*GG, error) {
+	g := NewGG(log.New(io.Discard, "", 0), nil, DiscardOutput{}, nil)
+	if err := g.decodeBinary(r); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// decodeBinary replaces the game's state with one read in the binary save format.
+// The game is left untouched if the input can't be decoded.
+func (g *GG) decodeBinary(r io.Reader) error {
+	header := make([]byte, len(binaryMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+
+	if string(header[:len(binaryMagic)]) != binaryMagic {
+		return errors.New("not a binary save file")
+	}
+
+	if version := header[len(binaryMagic)]; version != binaryVersion {
+		return fmt.Errorf("unsupported binary save version %d", version)
+	}
+
+	save := binaryGame{}
+	if err := gob.NewDecoder(r).Decode(&save); err != nil {
+		return fmt.Errorf("decoding game: %w", err)
+	}
+
+	board := GGBoard{}
+	setup := GGBoard{}
+	for x := range save.Board {
+		for y := range save.Board[x] {
+			piece := save.Board[x][y]
+			board[x][y].piece = GGPiece{code: piece.Code, player: piece.Player, revealed: piece.Revealed, frozen: piece.Frozen}
+			setup[x][y].piece = GGPiece{code: save.Setup[x][y].Code, player: save.Setup[x][y].Player}
+		}
+	}
+
+	// Barriers never move, so they're on the same squares from the setup onwards.
+	for _, coordinates := range save.Barriers {
+		x, y, err := parseCoordinates(coordinates)
+		if err != nil {
+			return fmt.Errorf("decoding game: barrier: %w", err)
+		}
+		board[x][y].barrier = true
+		setup[x][y].barrier = true
+	}
+
+	openingScout, err := parseScouted(save.OpeningScout)
+	if err != nil {
+		return fmt.Errorf("decoding game: scouted square: %w", err)
+	}
+
+	events := []GGEvent{}
+	for _, e := range save.Events {
+		scouted, err := parseScouted(e.Scouted)
+		if err != nil {
+			return fmt.Errorf("decoding game: scouted square: %w", err)
+		}
+		events = append(events, GGEvent{
+			ply:        e.Ply,
+			player:     e.Player,
+			move:       GGMove{fromX: e.Move[0], fromY: e.Move[1], toX: e.Move[2], toY: e.Move[3]},
+			moveType:   e.MoveType,
+			challenger: GGPiece{code: e.Challenger.Code, player: e.Challenger.Player},
+			target:     GGPiece{code: e.Target.Code, player: e.Target.Player},
+			result:     e.Result,
+			time:       e.Time,
+			scouted:    scouted,
+		})
+	}
+
+	notes := []GGNote{}
+	for _, n := range save.Notes {
+		notes = append(notes, GGNote{ply: n.Ply, text: n.Text, time: n.Time})
+	}
+
+	g.board = board
+	g.setup = setup
+	g.status = save.Status
+	g.winner = save.Winner
+	g.endReason = save.EndReason
+	g.playerToMove = save.PlayerToMove
+	g.ply = save.Ply
+	g.startedAt = save.StartedAt
+	g.events = events
+	g.notes = notes
+	g.openingScout = openingScout
+	// Nothing else of the game that was on the board carries over into the loaded one.
+	g.redoMoves = nil
+	g.drawOfferedBy = ""
+	g.flagArrivals = map[GGPlayer]GGFlagArrival{}
+	g.puzzle = nil
+	g.atomic = false
+	g.atomicCommands = nil
+	// Only the save names the players, so a side it leaves unnamed goes by its color. The names are
+	// replaced in place, since the default result formatter shares them.
+	clear(g.names)
+	for player, name := range save.Names {
+		if name != "" {
+			g.names[player] = name
+		}
+	}
+	if save.Seed != 0 || save.Draws != 0 {
+		g.restoreRandomness(save.Seed, save.Draws)
+	}
+	// The clocks pick up where they were saved, starting the turn in progress over. A save without them
+	// keeps the game's own time control, with the whole budgets left.
+	if save.TimeBudgets != nil {
+		g.timeBudgets = save.TimeBudgets
+		g.timeLeft = save.TimeLeft
+	} else {
+		for player, budget := range g.timeBudgets {
+			g.timeLeft[player] = budget
+		}
+	}
+	g.resumedAt = g.timestamp()
+	return nil
+}
+
+// GGAutosaver writes saved games into a file in the background, one at a time.
+// Only the latest save is kept when the disk can't keep up with the game.
+type GGAutosaver struct {
+	path   string
+	every  int
+	logger *GGLogger
+
+	mu      sync.Mutex
+	pending []byte
+	writing bool
+	done    sync.WaitGroup
+}
+
+// NewGGAutosaver initializes a GGAutosaver that saves into the given path every given number of moves.
+func NewGGAutosaver(path string, every int, logger *GGLogger) *GGAutosaver {
+	return &GGAutosaver{path: path, every: every, logger: logger}
+}
+
+// Save writes the saved game into the autosave file in the background, replacing any older one
+// still waiting to be written.
+func (a *GGAutosaver) Save(data []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pending = data
+	if a.writing {
+		return
+	}
+	a.writing = true
+	a.done.Add(1)
+	go a.flush()
+}
+
+// Wait blocks until every save has been written.
+func (a *GGAutosaver) Wait() {
+	a.done.Wait()
+}
+
+// flush writes the pending saves until there are none left.
+func (a *GGAutosaver) flush() {
+	defer a.done.Done()
+	for {
+		a.mu.Lock()
+		data := a.pending
+		a.pending = nil
+		if data == nil {
+			a.writing = false
+			a.mu.Unlock()
+			return
+		}
+		a.mu.Unlock()
+
+		// Write into a temporary file first, so that a crash mid-write doesn't corrupt the last save.
+		tmp := a.path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0o644); err != nil {
+			a.logger.Errorf("unable to autosave to %s: %v", a.path, err)
+			continue
+		}
+		if err := os.Rename(tmp, a.path); err != nil {
+			a.logger.Errorf("unable to autosave to %s: %v", a.path, err)
+			continue
+		}
+		a.logger.Debugf("game autosaved to %s", a.path)
+	}
+}
+
+// ==============================================================================
+// JSON import format definitions and methods.
+// ==============================================================================
+
+// jsonPosition is the JSON import format's layout of a position, also used for exporting positions.
+// example: {"first": "B", "pieces": [{"player": "W", "square": "A1", "code": "FLG"}]}
+type jsonPosition struct {
+	First  GGPlayer    `json:"first"`
+	Pieces []jsonPiece `json:"pieces"`
+}
+
+// jsonPiece is the JSON import format's layout of a piece and the square it's on.
+type jsonPiece struct {
+	Player GGPlayer    `json:"player"`
+	Square string      `json:"square"`
+	Code   GGPieceCode `json:"code"`
+}
+
+// ImportJSON replaces the board with a position read in the JSON import format, and starts the game.
+// Unless imports are lenient, both armies must be complete. The game is left untouched if the
+// position can't be imported.
+func (g *GG) ImportJSON(r io.Reader) error {
+	position := jsonPosition{}
+	if err := json.NewDecoder(r).Decode(&position); err != nil {
+		return fmt.Errorf("decoding position: %w", err)
+	}
+
+	first := g.firstPlayer
+	if position.First != "" {
+		if position.First != playerWhite && position.First != playerBlack {
+			return fmt.Errorf("invalid starting player %q", position.First)
+		}
+		first = position.First
+	}
+
+	board := GGBoard{}
+	for i, p := range position.Pieces {
+		if p.Player != playerWhite && p.Player != playerBlack {
+			return fmt.Errorf("invalid player %q (piece %d)", p.Player, i+1)
+		}
+
+		x, y, err := parseCoordinates(p.Square)
+		if err != nil {
+			return fmt.Errorf("%v (piece %d)", err, i+1)
+		}
+
+		if _, ok := roster[p.Code]; !ok {
+			return fmt.Errorf("unknown piece code %q (piece %d)", p.Code, i+1)
+		}
+
+		if !board[x][y].IsEmpty() {
+			return fmt.Errorf("duplicate placement at %s (piece %d)", p.Square, i+1)
+		}
+		board[x][y].piece = GGPiece{code: p.Code, player: p.Player}
+	}
+
+	violations := flagViolations(board)
+	violations = append(violations, rosterViolations(board, g.rosters)...)
+	if !g.lenientImport {
+		violations = append(violations, missingPieces(board, g.rosters)...)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("invalid position: %s", strings.Join(violations, "; "))
+	}
+
+	g.board = board
+	g.playerToMove = first
+	g.puzzle = nil
+	g.beginGame()
+	return nil
+}
+
+// ExportJSON writes the position in the JSON import format, with the side to move first.
+// Pieces are listed in the order of their squares (see sortedPlacements), so that exporting the
+// same position always gives the same output.
+func (g *GG) ExportJSON(w io.Writer) error {
+	position := jsonPosition{First: g.playerToMove, Pieces: []jsonPiece{}}
+	for _, p := range sortedPlacements(g.board) {
+		position.Pieces = append(position.Pieces, jsonPiece{Player: p.piece.player, Square: p.coordinates, Code: p.piece.code})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(position)
+}
+
+// ExportGGGN writes the position as a game file, with a SET line per piece and the side to move first.
+// The pieces each player has seen are kept in #@revealed directives, as the moves that led to the position
+// (and the challenges that revealed them) aren't included. The notes are kept in #@note directives with
+// the number of moves they come after. Pieces are listed in the order of their squares (see
+// sortedPlacements), so that exporting the same position always gives the same output.
+func (g *GG) ExportGGGN(w io.Writer) error {
+	lines := []string{fmt.Sprintf("%s%s %s", directivePrefix, directiveFirst, string(g.playerToMove))}
+	if barriers := barrierSquares(g.board); len(barriers) > 0 {
+		lines = append(lines, fmt.Sprintf("%s%s %s", directivePrefix, directiveBarrier, strings.Join(barriers, " ")))
+	}
+	for _, player := range []GGPlayer{playerWhite, playerBlack} {
+		if revealed := revealedSquares(g.board, player); len(revealed) > 0 {
+			lines = append(lines, fmt.Sprintf("%s%s %s %s", directivePrefix, directiveRevealed, string(player), strings.Join(revealed, " ")))
+		}
+	}
+	for _, n := range g.notes {
+		lines = append(lines, fmt.Sprintf("%s%s %d %s", directivePrefix, directiveNote, n.ply, n.text))
+	}
+	for _, p := range sortedPlacements(g.board) {
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", cmdSet, string(p.piece.player), p.coordinates, p.piece.code))
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// A transcript follows the structure of a chess PGN: a header of tags, one per line, then a blank line
+// and the moves. Tags are written as [Name "value"], in this order:
+//   - White, Black: the players' names, or their colors if they don't have any.
+//   - Date: the day the game started, as YYYY.MM.DD (or ????.??.?? if it hasn't).
+//   - Result: 1-0 if White won, 0-1 if Black won, 1/2-1/2 for a draw, or * if the game isn't over.
+//   - Termination: why the game ended, only for finished games.
+//   - Position: the position string of the setup, and the side that moved first (see positionString).
+//   - Barriers: the barrier squares, only if there are any.
+//
+// The moves are numbered in pairs of White's and Black's, written from and to in algebraic notation,
+// joined by "-" for moves and "x" for challenges. A game where Black moves first starts with "1...".
+// Notes are written as {comments} after the move they come after, or before the first one, and Black's
+// move following a comment is numbered again with "...". A closing brace in a note is written as a
+// parenthesis, since it would end the comment. The result comes after the last move. Transcripts are
+// read back by ImportPGN.
+// example: "1. A3-A4 {a bold opening} 1... B6-B5 2. A4xA5 1-0"
+
+// pgnDate is how the Date tag is written.
+const pgnDate = "2006.01.02"
+
+// ExportPGN writes the game's moves as a transcript, from the setup to the current position.
+func (g *GG) ExportPGN(w io.Writer) error {
+	date := "????.??.??"
+	if !g.startedAt.IsZero() {
+		date = g.startedAt.Format(pgnDate)
+	}
+
+	result := "*"
+	if g.status == gameOver {
+		switch g.winner {
+		case playerWhite:
+			result = "1-0"
+		case playerBlack:
+			result = "0-1"
+		default:
+			result = "1/2-1/2"
+		}
+	}
+
+	tag := func(name, value string) string {
+		return fmt.Sprintf("[%s %q]", name, value)
+	}
+	playerTag := func(p GGPlayer) string {
+		if name := g.names[p]; name != "" {
+			return tag(p.String(), name)
+		}
+		return tag(p.String(), p.String())
+	}
+
+	lines := []string{playerTag(playerWhite), playerTag(playerBlack), tag("Date", date), tag("Result", result)}
+	if g.status == gameOver && g.endReason != "" {
+		lines = append(lines, tag("Termination", string(g.endReason)))
+	}
+	// Loaded games don't always start with the usual side to move.
+	first := g.playerToMove
+	if len(g.events) > 0 {
+		first = g.events[0].player
+	}
+	lines = append(lines, tag("Position", positionString(g.setup, first)))
+	if barriers := barrierSquares(g.setup); len(barriers) > 0 {
+		lines = append(lines, tag("Barriers", strings.Join(barriers, " ")))
+	}
+
+	tokens := []string{}
+	comments := func(ply int) {
+		for _, n := range g.notes {
+			if n.ply == ply {
+				tokens = append(tokens, "{"+strings.ReplaceAll(n.text, "}", ")")+"}")
+			}
+		}
+	}
+	comments(0)
+	for i, e := range g.events {
+		number := i/2 + 1
+		if first == playerBlack {
+			number = (i+1)/2 + 1
+		}
+		if e.player == playerWhite {
+			tokens = append(tokens, fmt.Sprintf("%d.", number))
+		} else if i == 0 || strings.HasPrefix(tokens[len(tokens)-1], "{") {
+			tokens = append(tokens, fmt.Sprintf("%d...", number))
+		}
+
+		separator := "-"
+		if e.moveType == moveChallenge {
+			separator = "x"
+		}
+		tokens = append(tokens, squareAddressToCoordinates(e.move.fromX, e.move.fromY)+separator+squareAddressToCoordinates(e.move.toX, e.move.toY))
+		comments(e.ply)
+	}
+	tokens = append(tokens, result)
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n\n"+strings.Join(tokens, " ")+"\n")
+	return err
+}
+
+// ImportPGN starts the game from the setup in a transcript, and replays its moves along with its notes.
+// Tags that can't be read are skipped with a warning, and the ones other than the players, the position
+// and the barriers are ignored: the result comes from replaying the moves. Without a position there's
+// nothing to play, and an invalid move stops the import. The game is left untouched if the transcript
+// can't be imported.
+func (g *GG) ImportPGN(r io.Reader) error {
+	var board GGBoard
+	var first GGPlayer
+	names := map[GGPlayer]string{}
+	barriers := []string{}
+	hasPosition := false
+	movetext := ""
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		currentLine := strings.TrimSpace(scanner.Text())
+		lineNumber++
+
+		if !strings.HasPrefix(currentLine, "[") || movetext != "" {
+			movetext += currentLine + " "
+			continue
+		}
+
+		match := pgnTagRegex.FindStringSubmatch(currentLine)
+		if match == nil {
+			g.out.Write(fmt.Sprintf("Ignoring malformed tag %q (line %d)\n", currentLine, lineNumber))
+			continue
+		}
+
+		name, value := match[1], match[2]
+		switch name {
+		case playerWhite.String(), playerBlack.String():
+			if player := GGPlayer(name[:1]); value != player.String() {
+				names[player] = value
+			}
+		case "Position":
+			b, p, err := parsePosition(value)
+			if err != nil {
+				g.out.Write(fmt.Sprintf("Ignoring invalid position %q (line %d): %v\n", value, lineNumber, err))
+				continue
+			}
+			board, first, hasPosition = b, p, true
+		case "Barriers":
+			squares := strings.Fields(value)
+			for _, coordinates := range squares {
+				if _, _, err := parseCoordinates(coordinates); err != nil {
+					g.out.Write(fmt.Sprintf("Ignoring invalid barriers %q (line %d): %v\n", value, lineNumber, err))
+					squares = nil
+					break
+				}
+			}
+			barriers = squares
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if !hasPosition {
+		return errors.New("no position to start from")
+	}
+
+	for _, coordinates := range barriers {
+		x, y := coordinatesToSquareAddress(coordinates)
+		if !board[x][y].IsEmpty() {
+			return fmt.Errorf("barrier on occupied square %s", coordinates)
+		}
+		board[x][y].barrier = true
+	}
+
+	if violations := flagViolations(board); len(violations) > 0 {
+		return fmt.Errorf("impossible position: %s", strings.Join(violations, "; "))
+	}
+
+	// Check the moves on a copy of the board, so that an illegal one aborts the import before the game begins.
+	tokens, err := pgnTokens(movetext)
+	if err != nil {
+		return err
+	}
+	check := board
+	player := first
+	number := 1
+	moves := []GGMove{}
+	notes := []GGNote{}
+	for _, token := range tokens {
+		if text, ok := strings.CutPrefix(token, "{"); ok {
+			notes = append(notes, GGNote{ply: len(moves), text: strings.TrimSpace(strings.TrimSuffix(text, "}"))})
+			continue
+		}
+		if match := pgnNumberRegex.FindStringSubmatch(token); match != nil {
+			number, _ = strconv.Atoi(match[1])
+			continue
+		}
+		if token == "1-0" || token == "0-1" || token == "1/2-1/2" || token == "*" {
+			break
+		}
+
+		match := pgnMoveRegex.FindStringSubmatch(token)
+		if match == nil {
+			return fmt.Errorf("invalid move %q (move %d)", token, number)
+		}
+
+		m := newMove(match[1], match[3])
+		moveType, err := validateMove(check, player, m, g.rules)
+		if err != nil {
+			return fmt.Errorf("invalid move %s (move %d): %v", token, number, err)
+		}
+		separator := "-"
+		if moveType == moveChallenge {
+			separator = "x"
+		}
+		if match[2] != separator {
+			return fmt.Errorf("invalid move %s (move %d): expected %s%s%s", token, number, match[1], separator, match[3])
+		}
+		playMove(&check, m, g.rules)
+		moves = append(moves, m)
+		player = player.Opponent()
+	}
+
+	g.board = board
+	g.playerToMove = first
+	g.puzzle = nil
+	// Only the transcript names the players, so names from an earlier game don't carry over. The names
+	// are replaced in place, since the default result formatter shares them.
+	clear(g.names)
+	maps.Copy(g.names, names)
+	g.beginGame()
+
+	// The moves were checked above, so none of them can fail.
+	for _, m := range moves {
+		g.makeMove(m)
+	}
+	g.attachNotes(notes)
+	return nil
+}
+
+// pgnTokens splits the moves of a transcript into move numbers, moves, comments (with their braces)
+// and the result.
+// example: "1. A3-A4 {a bold opening} 1-0" -> ["1.", "A3-A4", "{a bold opening}", "1-0"]
+func pgnTokens(movetext string) ([]string, error) {
+	tokens := []string{}
+	for {
+		movetext = strings.TrimLeft(movetext, " \t")
+		if movetext == "" {
+			return tokens, nil
+		}
+
+		end := strings.IndexAny(movetext, " \t{")
+		if movetext[0] == '{' {
+			end = strings.IndexByte(movetext, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment %q", movetext)
+			}
+			end++
+		} else if end < 0 {
+			end = len(movetext)
+		}
+		tokens = append(tokens, movetext[:end])
+		movetext = movetext[end:]
+	}
+}
+
+// ==============================================================================
+// Position string definitions and methods. Used for sharing positions as text.
+// ==============================================================================
+
+// A position string lists the ranks from the 8th down to the 1st, separated by slashes, followed by
+// the side to move. Each piece is written as its player and its glyph, and each run of empty squares
+// as its length.
+// example: "8BF/9/9/9/9/9/9/WF8 W"
+
+// positionString returns the position string of the board with the given side to move.
+func positionString(board GGBoard, toMove GGPlayer) string {
+	ranks := []string{}
+	for x := rows - 1; x >= 0; x-- {
+		rank := ""
+		empty := 0
+		for y := 0; y < files; y++ {
+			piece := board[x][y].piece
+			if piece.IsEmpty() {
+				empty++
+				continue
+			}
+
+			if empty > 0 {
+				rank += strconv.Itoa(empty)
+				empty = 0
+			}
+			rank += string(piece.player) + string(glyph(piece.code))
+		}
+		if empty > 0 {
+			rank += strconv.Itoa(empty)
+		}
+		ranks = append(ranks, rank)
+	}
+
+	return strings.Join(ranks, "/") + " " + string(toMove)
+}
+
+// parsePosition reads a position string into a board and the side to move.
+func parsePosition(position string) (GGBoard, GGPlayer, error) {
+	board := GGBoard{}
+
+	fields := strings.Fields(position)
+	if len(fields) != 2 {
+		return board, "", errors.New("expected the ranks followed by the side to move")
+	}
+
+	toMove := GGPlayer(fields[1])
+	if toMove != playerWhite && toMove != playerBlack {
+		return board, "", fmt.Errorf("invalid side to move %q", fields[1])
+	}
+
+	ranks := strings.Split(fields[0], "/")
+	if len(ranks) != rows {
+		return board, "", fmt.Errorf("expected %d ranks, got %d", rows, len(ranks))
+	}
+
+	for i, rank := range ranks {
+		x := rows - 1 - i
+		y := 0
+		for j := 0; j < len(rank); j++ {
+			c := rank[j]
+			switch {
+			case c >= '1' && c <= '9':
+				y += int(c - '0')
+			case GGPlayer(c) == playerWhite || GGPlayer(c) == playerBlack:
+				if j+1 == len(rank) {
+					return board, "", fmt.Errorf("missing piece after %c (rank %d)", c, x+1)
+				}
+				j++
+				code, ok := glyphCode(rune(rank[j]))
+				if !ok {
+					return board, "", fmt.Errorf("unknown glyph %q (rank %d)", rank[j], x+1)
+				}
+				if y >= files {
+					return board, "", fmt.Errorf("too many squares (rank %d)", x+1)
+				}
+				board[x][y].piece = GGPiece{code: code, player: GGPlayer(c)}
+				y++
+			default:
+				return board, "", fmt.Errorf("unexpected %q (rank %d)", c, x+1)
+			}
+		}
+
+		if y != files {
+			return board, "", fmt.Errorf("expected %d squares, got %d (rank %d)", files, y, x+1)
+		}
+	}
+
+	return board, toMove, nil
+}
+
+// shareToken encodes the position string of the board into a token that's safe to paste into a URL.
+func shareToken(board GGBoard, toMove GGPlayer) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(positionString(board, toMove)))
+}
+
+// OpenShareToken replaces the board with the position of a share token, and starts the game.
+// The position may be missing pieces, as it's usually taken in the middle of a game. The game is
+// left untouched if the token can't be opened.
+func (g *GG) OpenShareToken(token string) error {
+	position, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("decoding token: %w", err)
+	}
+
+	board, toMove, err := parsePosition(string(position))
+	if err != nil {
+		return fmt.Errorf("invalid position: %w", err)
+	}
+
+	violations := flagViolations(board)
+	violations = append(violations, rosterViolations(board, g.rosters)...)
+	if len(violations) > 0 {
+		return fmt.Errorf("invalid position: %s", strings.Join(violations, "; "))
+	}
+
+	g.board = board
+	g.playerToMove = toMove
+	g.puzzle = nil
+	g.beginGame()
+	return nil
+}
+
+// ==============================================================================
+// Board paste definitions and methods. Used for setting up positions from drawn boards.
+// ==============================================================================
+
+// A pasted board is read from the lines that have squares on them, between vertical borders of either
+// theme; the edges, rules and blank lines are skipped, so a board drawn by the ConsoleGUI can be pasted
+// as is. The first line is the 8th rank. Each square holds a piece code or, as drawn compactly, a glyph,
+// optionally after its player (ex: "B SPY"); barriers are filled in with "#". Pieces without a player
+// belong to the side whose half of the board they're on. The ConsoleGUI doesn't draw the players, so
+// only boards where no piece has crossed the center, such as fresh setups, paste back exactly: crossed
+// pieces need their player added.
+// example: "|  W FLG  |  SPY  |       |       |       |       |       |       |       |"
+
+// parseBoardArt reads the lines of a drawn board into a board, reporting the first malformed square.
+func parseBoardArt(lines []string) (GGBoard, error) {
+	board := GGBoard{}
+
+	ranks := [][]string{}
+	for _, line := range lines {
+		line = strings.TrimSpace(strings.ReplaceAll(line, boardThemes["unicode"].vertical, asciiTheme.vertical))
+		if !strings.HasPrefix(line, asciiTheme.vertical) {
+			continue
+		}
+		ranks = append(ranks, strings.Split(strings.TrimSuffix(strings.TrimPrefix(line, asciiTheme.vertical), asciiTheme.vertical), asciiTheme.vertical))
+	}
+
+	if len(ranks) != rows {
+		return board, fmt.Errorf("expected %d ranks, got %d", rows, len(ranks))
+	}
+
+	for i, squares := range ranks {
+		x := rows - 1 - i
+		if len(squares) != files {
+			return board, fmt.Errorf("expected %d squares, got %d (rank %d)", files, len(squares), x+1)
+		}
+
+		for y, square := range squares {
+			player := playerWhite
+			if x >= rows/2 {
+				player = playerBlack
+			}
+
+			// Barriers are drawn filled in, without any piece on them.
+			if text := strings.TrimSpace(square); text != "" && strings.Trim(text, barrierFill) == "" {
+				board[x][y].barrier = true
+				continue
+			}
+
+			tokens := strings.Fields(square)
+			switch len(tokens) {
+			case 0:
+				continue
+			case 2:
+				player = GGPlayer(strings.ToUpper(tokens[0]))
+				if player != playerWhite && player != playerBlack {
+					return board, fmt.Errorf("invalid player %q (%s)", tokens[0], squareAddressToCoordinates(x, y))
+				}
+				tokens = tokens[1:]
+			case 1:
+			default:
+				return board, fmt.Errorf("unexpected %q (%s)", strings.TrimSpace(square), squareAddressToCoordinates(x, y))
+			}
+
+			code := GGPieceCode(tokens[0])
+			if runes := []rune(tokens[0]); len(runes) == 1 {
+				var ok bool
+				if code, ok = glyphCode(runes[0]); !ok {
+					return board, fmt.Errorf("unknown glyph %q (%s)", tokens[0], squareAddressToCoordinates(x, y))
+				}
+			} else if _, ok := roster[code]; !ok {
+				return board, fmt.Errorf("unknown piece code %q (%s)", tokens[0], squareAddressToCoordinates(x, y))
+			}
+			board[x][y].piece = GGPiece{code: code, player: player}
+		}
+	}
+
+	return board, nil
+}
+
+// PasteBoard replaces the board with the drawn board in the given lines, and starts the game with the
+// usual first player. Like share tokens, the board may be missing pieces. The game is left untouched
+// if the board can't be read.
+func (g *GG) PasteBoard(lines []string) error {
+	board, err := parseBoardArt(lines)
+	if err != nil {
+		return err
+	}
+
+	violations := flagViolations(board)
+	violations = append(violations, rosterViolations(board, g.rosters)...)
+	if len(violations) > 0 {
+		return fmt.Errorf("invalid position: %s", strings.Join(violations, "; "))
+	}
+
+	g.board = board
+	g.playerToMove = g.firstPlayer
+	g.puzzle = nil
+	g.beginGame()
+	return nil
+}
+
+// ==============================================================================
+// GGManager definitions and methods. Used for playing several games in one session.
+// ==============================================================================
+
+// GGManager holds every game of the session, only one of which is played at a time.
+type GGManager struct {
+	games   []*GG
+	current int
+	newGame func() *GG
+
+	// Overrides the GUI of every game once set.
+	gui GUI
+}
+
+// NewGGManager initializes a GGManager, starting its first game right away.
+// newGame is used to create every game of the session.
+func NewGGManager(newGame func() *GG) *GGManager {
+	m := &GGManager{newGame: newGame}
+	m.add()
+	return m
+}
+
+// Current returns the game being played.
+func (m *GGManager) Current() *GG {
+	return m.games[m.current]
+}
+
+// SetGUI switches every game of the session to drawing with the given GUI, including the games
+// started from now on.
+func (m *GGManager) SetGUI(gui GUI) {
+	m.gui = gui
+	for _, g := range m.games {
+		g.SetGUI(gui)
+	}
+}
+
+// Quit allows every game to execute any cleanup routines.
+func (m *GGManager) Quit() {
+	for _, g := range m.games {
+		g.Quit()
+	}
+}
+
+// Play runs the game loop on whichever game is being played, until it's over. With retryInvalid, an unknown
+// command or a rejected move prompts again right away, without showing the result, unless it ended the game.
+func (m *GGManager) Play(retryInvalid bool) {
+	for m.Current().MainLoop() {
+		gg := m.Current()
+		gg.DrawBoard()
+		gg.GetCommand()
+		resolved := gg.ResolveCommand()
+
+		// The command may have switched to another game.
+		gg = m.Current()
+		gg.DetermineResult()
+		if !resolved && retryInvalid && gg.MainLoop() {
+			// Prompt again right away. A rejected move can still run out the clock, but then the game is over.
+			continue
+		}
+		gg.ShowResult()
+	}
+}
+
+// RunScript runs every command in the file at the given path, one per line, as if it was entered.
+// Empty lines and comments are skipped, and directives are applied to the game as they're reached (see
+// runDirective). Commands that read more lines from the input (setup and paste) can't be run, since the
+// script isn't the input.
+// Whatever a command writes is prefixed with the file and line it came from, so that errors can be
+// traced back to them.
+func (m *GGManager) RunScript(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		lineNumber++
+		if cmd == "" || (cmd[0] == '#' && !strings.HasPrefix(cmd, directivePrefix)) {
+			continue
+		}
+
+		// The command may switch to another game, whose output is left alone.
+		g := m.Current()
+		out := g.out
+		g.out = PrefixOutput{out: out, prefix: fmt.Sprintf("%s line %d: ", path, lineNumber)}
+		if strings.HasPrefix(cmd, directivePrefix) {
+			g.runDirective(cmd)
+			g.DetermineResult()
+			g.out = out
+			continue
+		}
+		if cmd == cmdSetup || cmd == cmdPaste {
+			g.out = out
+			return fmt.Errorf("%s line %d: %s reads its lines from the input, list them in the script instead", path, lineNumber, cmd)
+		}
+		g.commandStack.Append(cmd)
+		g.ResolveCommand()
+		g.DetermineResult()
+		g.out = out
+	}
+
+	return scanner.Err()
+}
+
+// runDirective applies a game file directive from a script to the game, the way loading the file would:
+//   - first: the side that moves first, in this game and the ones loaded or started after it, as long as
+//     no move is made yet.
+//   - seed: seeds the game's randomness.
+//   - note: attaches a note to the game, after its latest move at most.
+//   - wait: pauses before the next line, like the wait command.
+//   - barrier: makes the squares barriers, as long as the game hasn't started yet.
+//
+// A puzzle's goal and the pieces revealed by the end of a file only make sense for a game loaded as a
+// whole, so those directives are reported as ignored.
+func (g *GG) runDirective(line string) {
+	key, value := parseDirective(line)
+	switch key {
+	case directiveFirst:
+		player, err := parsePlayer(value)
+		if err != nil {
+			g.out.Write(fmt.Sprintf("Invalid starting player %q.\n", value))
+			return
+		}
+		if g.ply > 0 {
+			g.out.Write("The side that moves first can't change once moves are made.\n")
+			return
+		}
+		g.SetFirstPlayer(player)
+	case directiveSeed:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			g.out.Write(fmt.Sprintf("Invalid seed %q.\n", value))
+			return
+		}
+		g.SetSeed(n)
+	case directiveNote:
+		g.attachNotes([]GGNote{parseNote(value)})
+	case directiveWait:
+		d, err := parseWait(value)
+		if err != nil {
+			g.out.Write(fmt.Sprintf("Invalid wait directive: %v\n", err))
+			return
+		}
+		g.sleep(d)
+	case directiveBarrier:
+		if g.status == gameInProgress || g.status == gameOver {
+			g.out.Write("Barriers can only be changed before the game starts.\n")
+			return
+		}
+		for _, coordinates := range strings.Fields(value) {
+			x, y, err := parseCoordinates(coordinates)
+			if err != nil {
+				g.out.Write(fmt.Sprintf("Invalid barrier: %v\n", err))
+				continue
+			}
+			if !g.board[x][y].IsEmpty() {
+				g.out.Write(fmt.Sprintf("%s is occupied, only empty squares can be barriers.\n", coordinates))
+				continue
+			}
+			g.board[x][y].barrier = true
+		}
+	default:
+		g.out.Write(fmt.Sprintf("Ignoring the %s%s directive, it only applies to loaded game files.\n", directivePrefix, key))
+	}
+}
+
+// add creates and starts a new game, and switches to it.
+func (m *GGManager) add() {
+	g := m.newGame()
+	if m.gui != nil {
+		g.SetGUI(m.gui)
+	}
+
+	// The manager's commands are available from within every game.
+	g.RegisterCommand(cmdNewGame, func(*GG, string) { m.HandleNewGame() })
+	g.RegisterCommand(cmdGame, func(g *GG, cmd string) { m.HandleGame(g, cmd) })
+	g.RegisterCommand(cmdGames, func(g *GG, _ string) { m.HandleGames(g) })
+
+	m.games = append(m.games, g)
+	m.current = len(m.games) - 1
+	g.Start()
+}
+
+// HandleNewGame handles the "newgame" command.
+func (m *GGManager) HandleNewGame() {
+	m.add()
+	m.Current().out.Write(fmt.Sprintf("Switched to new game %d.\n", m.current+1))
+}
+
+// HandleGame switches to the game numbered in the given command (ex: "game 2").
+func (m *GGManager) HandleGame(g *GG, cmd string) {
+	tokens := tokenize(cmd)
+	if err := checkArity(tokens, 2); err != nil {
+		g.out.Write(fmt.Sprintf("Invalid game command: %v\n", err))
+		return
+	}
+
+	n, err := strconv.Atoi(tokens[1])
+	if err != nil || n < 1 || n > len(m.games) {
+		g.out.Write(fmt.Sprintf("There is no game %s, see the games command.\n", tokens[1]))
+		return
+	}
+
+	m.current = n - 1
+	m.Current().redraw = true
+	m.Current().out.Write(fmt.Sprintf("Switched to game %d.\n", n))
+}
+
+// HandleGames lists every game of the session.
+func (m *GGManager) HandleGames(g *GG) {
+	g.redraw = false
+
+	g.out.Write("Games:\n")
+	for i, game := range m.games {
+		marker := " "
+		if i == m.current {
+			marker = "*"
+		}
+		if game.status == gameOver && game.endReason != "" {
+			g.out.Write(fmt.Sprintf("\t%s %d. %s, %s\n", marker, i+1, game.status, game.endReason))
+			continue
+		}
+		g.out.Write(fmt.Sprintf("\t%s %d. %s, %s to move\n", marker, i+1, game.status, game.playerToMove))
+	}
+}
+
+// ==============================================================================
+// Logging definitions and methods.
+// ==============================================================================
+
+// GGLogLevel represents how verbose a log message is.
+type GGLogLevel int
+
+// Log levels, from the least verbose to the most.
+const (
+	logError GGLogLevel = iota
+	logInfo
+	logDebug
+)
+
+// GGLogger is a leveled wrapper around log.Logger, discarding messages more verbose than its level.
+type GGLogger struct {
+	logger *log.Logger
+	level  GGLogLevel
+}
+
+// NewGGLogger initializes a GGLogger.
+func NewGGLogger(logger *log.Logger, level GGLogLevel) *GGLogger {
+	return &GGLogger{logger: logger, level: level}
+}
+
+// Errorf logs a message about something that went wrong.
+func (l *GGLogger) Errorf(format string, v ...any) {
+	l.logf(logError, format, v...)
+}
+
+// Infof logs a message about a notable game event.
+func (l *GGLogger) Infof(format string, v ...any) {
+	l.logf(logInfo, format, v...)
+}
+
+// Debugf logs a message useful while tracing the game's inner workings.
+func (l *GGLogger) Debugf(format string, v ...any) {
+	l.logf(logDebug, format, v...)
+}
+
+// logf logs the message if its level is within the logger's.
+func (l *GGLogger) logf(level GGLogLevel, format string, v ...any) {
+	if level > l.level {
+		return
+	}
+
+	// Skip logf and its caller so that the message reports the line that logged it.
+	l.logger.Output(3, fmt.Sprintf(format, v...))
+}
+
+// parseLogLevel converts a log level name (error, info, or debug) to its GGLogLevel.
+func parseLogLevel(name string) (GGLogLevel, error) {
+	switch name {
+	case "error":
+		return logError, nil
+	case "info":
+		return logInfo, nil
+	case "debug":
+		return logDebug, nil
+	}
+
+	return 0, fmt.Errorf("invalid log level %q, expected error, info, or debug", name)
+}
+
+// ==============================================================================
+// IO definitions and methods. Used for managing input and output.
+// ==============================================================================
+
+// Input is the interface for fetching input from the outside world.
+type Input interface {
+	Read() string
+}
+
+// StdinInput allows fetching of input from Stdin.
+type StdinInput struct {
+	reader *bufio.Reader
+}
+
+// Read takes in a string from Stdin, cleans it, and returns it.
+func (i *StdinInput) Read() string {
+	cmd, err := i.reader.ReadString('\n')
+	if err != nil {
+		// Nothing more will ever be read once Stdin is closed.
+		if err == io.EOF && strings.TrimSpace(cmd) == "" {
+			return cmdExit
+		}
+		if err != io.EOF {
+			return cmdInvalid
+		}
+	}
+	return strings.Join(tokenize(cmd), " ")
+}
+
+// NewStdinInput initializes a new StdinInput.
+func NewStdinInput() *StdinInput {
+	return &StdinInput{reader: bufio.NewReader(os.Stdin)}
+}
+
+// InteractiveInput reads MV and SET commands token by token, guiding the user through the missing ones.
+// Every other command is read as a whole line from the underlying Input.
+type InteractiveInput struct {
+	in  Input
+	out Output
+}
+
+// Read takes in lines from the underlying Input until a whole command is entered.
+func (i *InteractiveInput) Read() string {
+	parser := &GGCommandParser{}
+	for {
+		line := i.in.Read()
+		tokens := tokenize(line)
+		if len(parser.tokens) == 0 && (len(tokens) == 0 || !isTokenizedCommand(tokens[0])) {
+			return line
+		}
+
+		for _, token := range tokens {
+			if err := parser.Feed(token); err != nil {
+				i.out.Write(fmt.Sprintf("%v.\nEnter command: ", err))
+				parser = &GGCommandParser{}
+				break
+			}
+		}
+
+		if parser.Done() {
+			return parser.String()
+		}
+		if len(parser.tokens) > 0 {
+			i.out.Write(fmt.Sprintf("%s (%s): ", parser, parser.Guidance()))
+		}
+	}
+}
+
+// NewInteractiveInput initializes a new InteractiveInput that reads lines from in and writes guidance to out.
+func NewInteractiveInput(in Input, out Output) *InteractiveInput {
+	return &InteractiveInput{in: in, out: out}
+}
+
+// GGCommandParser validates a MV or SET command one token at a time.
+type GGCommandParser struct {
+	tokens []string
+}
+
+// Feed validates the next token of the command and, if it's valid, adds it to the command.
+func (p *GGCommandParser) Feed(token string) error {
+	if p.Done() {
+		return fmt.Errorf("unexpected %q after %s", token, p)
+	}
+
+	valid := false
+	switch p.Guidance() {
+	case guideCommand:
+		valid = isTokenizedCommand(token)
+	case guidePlayer:
+		_, err := parsePlayer(token)
+		valid = err == nil
+	case guideOrigin, guideDestination, guideSquare:
+		token = normalizeSquare(token)
+		valid = coordinatesRegex.MatchString(token)
+	case guidePiece:
+		_, valid = roster[GGPieceCode(token)]
+	}
+
+	if !valid {
+		return fmt.Errorf("invalid %q, expected to %s", token, p.Guidance())
+	}
+
+	p.tokens = append(p.tokens, token)
+	return nil
+}
+
+// Guidance describes the token the command expects next, if any.
+func (p *GGCommandParser) Guidance() string {
+	if len(p.tokens) == 0 {
+		return guideCommand
+	}
+
+	grammar := map[string][]string{
+		cmdMove: {guideOrigin, guideDestination},
+		cmdSet:  {guidePlayer, guideSquare, guidePiece},
+	}[p.tokens[0]]
+
+	if len(p.tokens) > len(grammar) {
+		return ""
+	}
+	return grammar[len(p.tokens)-1]
+}
+
+// Done checks if every token of the command has been entered.
+func (p *GGCommandParser) Done() bool {
+	return len(p.tokens) > 0 && p.Guidance() == ""
+}
+
+// String returns the command entered so far.
+func (p *GGCommandParser) String() string {
+	return strings.Join(p.tokens, " ")
+}
+
+// isTokenizedCommand checks if the command is one that InteractiveInput reads token by token.
+func isTokenizedCommand(name string) bool {
+	return name == cmdMove || name == cmdSet
+}
+
+// Output is the interface for writing output to the outside world.
+type Output interface {
+	Write(s string)
+}
+
+// StdoutOutput allows writing of output to Stdout.
+type StdoutOutput struct{}
+
+// Write prints the given string to Stdout.
+func (o *StdoutOutput) Write(s string) {
+	fmt.Print(s)
+}
+
+// GUI is the interface for handling interactable game elements.
+type GUI interface {
+	Draw(GGBoard)
+
+	// Render returns the drawing of the board as text, for writing it elsewhere than the GUI.
+	Render(GGBoard) string
+
+	// Legend lists the symbol each of the piece codes is drawn with, as the board would currently be drawn.
+	Legend(codes []GGPieceCode) []GGLegendEntry
+}
+
+// GGLegendEntry pairs a piece code with the symbol it's drawn with.
+type GGLegendEntry struct {
+	symbol string
+	code   GGPieceCode
+}
+
+// ConsoleGUI is a GUI implemented via console.
+type ConsoleGUI struct {
+	out  *StdoutOutput
+	opts ConsoleGUIOptions
+}
+
+// ConsoleGUIOptions configures how a ConsoleGUI draws the board.
+type ConsoleGUIOptions struct {
+	mode GGRenderMode
+
+	// Used by the auto mode, which draws compactly on terminals narrower than compactBelow.
+	terminal     Terminal
+	compactBelow int
+
+	// How many columns each square takes, zero for the mode's default.
+	cellWidth int
+
+	// The characters the borders are drawn with, the zero value for the ASCII theme.
+	theme GGBoardTheme
+}
+
+// GGBoardTheme holds the characters the board's borders are drawn with. Each must take a single column.
+type GGBoardTheme struct {
+	// The top and bottom edges of the squares.
+	horizontal string
+	// The left and right edges of the squares.
+	vertical string
+	// Where the edges of the squares meet.
+	corner string
+	// The rules drawn above and below the board.
+	rule string
+}
+
+// GGRenderMode represents how the board is drawn.
+type GGRenderMode string
+
+// GGNotation represents how squares are written.
+type GGNotation string
+
+// NewConsoleGUI initializes a ConsoleGUI.
+func NewConsoleGUI(out *StdoutOutput, opts ConsoleGUIOptions) GUI {
+	return &ConsoleGUI{out: out, opts: opts}
+}
+
+// isCompact checks if the board should be drawn with single-character glyphs instead of piece codes.
+func (g ConsoleGUI) isCompact() bool {
+	switch g.opts.mode {
+	case renderCompact:
+		return true
+	case renderAuto:
+		width, ok := g.terminalWidth()
+		return ok && width < g.opts.compactBelow
+	}
+
+	return false
+}
+
+// terminalWidth returns the number of columns of the terminal, and whether it could be determined.
+func (g ConsoleGUI) terminalWidth() (int, bool) {
+	if g.opts.terminal == nil {
+		return 0, false
+	}
+
+	return g.opts.terminal.Width()
+}
+
+// theme returns the characters to draw the borders with, falling back to the ASCII theme.
+func (g ConsoleGUI) theme() GGBoardTheme {
+	if g.opts.theme == (GGBoardTheme{}) {
+		return asciiTheme
+	}
+
+	return g.opts.theme
+}
+
+// dimensions returns how many columns each square and the whole board take, given the render mode's defaults.
+// The squares are as wide as the configured cell width if any, and the board is widened or narrowed along with them.
+func (g ConsoleGUI) dimensions(defaultCellWidth int, defaultBoardWidth int) (int, int) {
+	cellWidth := defaultCellWidth
+	if g.opts.cellWidth > 0 {
+		cellWidth = g.opts.cellWidth
+	}
+
+	return cellWidth, defaultBoardWidth + files*(cellWidth-defaultCellWidth)
+}
+
+// Terminal is the interface for querying the terminal the game is played on.
+type Terminal interface {
+	// Width returns the number of columns of the terminal, and whether it could be determined.
+	Width() (int, bool)
+}
+
+// EnvTerminal determines the terminal's size from the environment variables set by the shell.
+type EnvTerminal struct{}
+
+// Width returns the number of columns in the COLUMNS environment variable. Note that some shells
+// don't export it by default, in which case the width can't be determined.
+func (t EnvTerminal) Width() (int, bool) {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		return 0, false
+	}
+
+	return width, true
+}
+
+// Draw draws the given board to the console. If even the compact board doesn't fit into the terminal,
+// a message asking for a wider terminal is shown instead of garbled output.
+func (g ConsoleGUI) Draw(board GGBoard) {
+	drawing := g.Render(board)
+	if g.isCompact() {
+		needed := widestLine(drawing)
+		if width, ok := g.terminalWidth(); ok && width < needed {
+			g.out.Write(fmt.Sprintf("The terminal is too narrow to draw the board (%d columns, %d needed), please widen it.\n", width, needed))
+			return
+		}
+	}
+
+	g.out.Write(drawing)
+}
+
+// widestLine returns the number of columns taken by the widest line of the text.
+func widestLine(text string) int {
+	widest := 0
+	for _, line := range strings.Split(text, "\n") {
+		widest = max(widest, utf8.RuneCountInString(line))
+	}
+
+	return widest
+}
+
+// Render returns the drawing of the board as text, as it would be drawn to the console.
+func (g ConsoleGUI) Render(board GGBoard) string {
+	buf := &BufferOutput{}
+	g.render(buf, board)
+	return buf.String()
+}
+
+// render draws the board into the given output, in the active render mode.
+func (g ConsoleGUI) render(out Output, board GGBoard) {
+	if g.isCompact() {
+		g.drawGrid(out, board, compactCellWidth, compactBoardWidth, g.label)
+		return
+	}
+
+	g.drawGrid(out, board, fullCellWidth, fullBoardWidth, g.label)
+}
+
+// Legend lists the symbol each of the piece codes is drawn with in the active render mode.
+func (g ConsoleGUI) Legend(codes []GGPieceCode) []GGLegendEntry {
+	legend := []GGLegendEntry{}
+	for _, code := range codes {
+		legend = append(legend, GGLegendEntry{symbol: g.label(code), code: code})
+	}
+
+	return legend
+}
+
+// label returns what a piece is drawn as: a single-character glyph when drawing compactly,
+// and its piece code otherwise.
+func (g ConsoleGUI) label(code GGPieceCode) string {
+	if g.isCompact() {
+		return string(glyph(code))
+	}
+
+	return string(code)
+}
+
+// drawGrid draws the given board into the given output, with each piece labeled in the middle of its square.
+// The squares are as wide as the configured cell width if any, and defaultCellWidth otherwise; the
+// header and footer are widened or narrowed along with them.
+func (g ConsoleGUI) drawGrid(out Output, board GGBoard, defaultCellWidth int, defaultBoardWidth int, label func(GGPieceCode) string) {
+	cellWidth, boardWidth := g.dimensions(defaultCellWidth, defaultBoardWidth)
+	theme := g.theme()
+
+	// The ASCII theme's corners are blank, don't leave one dangling at the end of the line.
+	edge := strings.TrimRight(strings.Repeat(theme.corner+strings.Repeat(theme.horizontal, cellWidth), files)+theme.corner, " ")
+
+	// Draw header
+	out.Write(fmt.Sprintf("%s\n", strings.Repeat(theme.rule, boardWidth)))
+
+	// Draw actual board.
+	out.Write("\n")
+	for i := len(board) - 1; i >= 0; i-- {
+		// Draw top edge.
+		out.Write(fmt.Sprintf("    %s\n", edge))
+
+		// Draw each square.
+		out.Write("    ")
+		for j := 0; j < len(board[i]); j++ {
+			text := ""
+			if code := board[i][j].piece.code; code != "" {
+				text = label(code)
+			}
+			if board[i][j].barrier {
+				text = strings.Repeat(barrierFill, cellWidth)
+			}
+			out.Write(fmt.Sprintf("%s%s", theme.vertical, centered(text, cellWidth)))
+		}
+		out.Write(fmt.Sprintf("%s\n", theme.vertical))
+
+		if i == 0 {
+			// Draw bottom edge.
+			out.Write(fmt.Sprintf("    %s\n", edge))
+		}
+	}
+
+	// Draw footer
+	out.Write("\n")
+	out.Write(fmt.Sprintf("%s\n", strings.Repeat(theme.rule, boardWidth)))
+	out.Write("\n")
+}
+
+// NewStdoutOutput initializes a new StdoutOutput.
+func NewStdoutOutput() *StdoutOutput {
+	return &StdoutOutput{}
+}
+
+// PrefixOutput writes everything to another output, prefixed with some text.
+type PrefixOutput struct {
+	out    Output
+	prefix string
+}
+
+// Write writes s to the underlying output, after the prefix.
+func (o PrefixOutput) Write(s string) {
+	o.out.Write(o.prefix + s)
+}
+
+// BufferOutput keeps everything written to it in memory.
+type BufferOutput struct {
+	strings.Builder
+}
+
+// Write appends s to the buffer.
+func (o *BufferOutput) Write(s string) {
+	o.WriteString(s)
+}
+
+// DiscardOutput throws away everything written to it.
+type DiscardOutput struct{}
+
+// Write does nothing.
+func (o DiscardOutput) Write(s string) {}
+
+// ResultFormatter is the interface for announcing the result of a finished game.
+// The winner is empty if the game is a draw.
+type ResultFormatter interface {
+	FormatResult(winner GGPlayer, reason GGEndReason) string
+}
+
+// DefaultResultFormatter announces the result in English, along with the reason the game ended.
+// The winner is shown with their name, if they have one.
+type DefaultResultFormatter struct {
+	names map[GGPlayer]string
+}
+
+// FormatResult returns the announcement of the result (ex: "White wins! (flag captured)").
+func (f DefaultResultFormatter) FormatResult(winner GGPlayer, reason GGEndReason) string {
+	if winner == "" {
+		return fmt.Sprintf("Draw: %s.", reason)
+	}
+
+	if reason == "" {
+		return fmt.Sprintf("%s wins!", displayName(winner, f.names))
+	}
+
+	return fmt.Sprintf("%s wins! (%s)", displayName(winner, f.names), reason)
+}
+
+// ==============================================================================
+// AI definitions and methods. Used for letting the computer play a side.
+// ==============================================================================
+
+// GGEngine is a minimax AI that plays one side of the game.
+type GGEngine struct {
+	player GGPlayer
+	budget time.Duration
+	now    func() time.Time
+
+	// Breaks ties between equally good moves, and guesses the hidden enemy pieces.
+	rng *rand.Rand
+
+	// Only lets the engine see the enemy pieces that are revealed.
+	fog bool
+
+	// State of the ongoing search.
+	rules    GGRuleSet
+	deadline time.Time
+
+	// Stats of the last (or ongoing) search.
+	stats GGSearchStats
+}
+
+// GGSearchStats describes a search made by the engine, for tuning its time budget.
+type GGSearchStats struct {
+	// Deepest search that finished before the time budget ran out.
+	depth int
+	// Positions visited, including those of the search that was cut short.
+	nodes   int
+	elapsed time.Duration
+}
+
+// String returns a user-friendly summary of the search.
+func (s GGSearchStats) String() string {
+	return fmt.Sprintf("%d positions evaluated in %v, reaching depth %d", s.nodes, s.elapsed.Round(time.Millisecond), s.depth)
+}
+
+// NewGGEngine initializes a GGEngine playing the given side, thinking for up to budget per move.
+func NewGGEngine(player GGPlayer, budget time.Duration) *GGEngine {
+	return &GGEngine{
+		player: player,
+		budget: budget,
+		now:    time.Now,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetSeed makes the engine break ties between equally good moves the same way every time.
+func (e *GGEngine) SetSeed(seed int64) {
+	e.rng = rand.New(rand.NewSource(seed))
+}
+
+// SetFog enables or disables the fog of war for the engine, so that it plays on the enemy pieces that
+// are revealed and guesses the others.
+func (e *GGEngine) SetFog(enabled bool) {
+	e.fog = enabled
+}
+
+// BestMove searches the board one depth at a time, returning the best move of the deepest search that
+// finished before the time budget ran out. It reports false if the engine has no legal moves.
+func (e *GGEngine) BestMove(board GGBoard, rules GGRuleSet) (GGMove, bool) {
+	start := e.now()
+	e.rules = rules
+	e.stats = GGSearchStats{}
+	defer func() {
+		e.stats.elapsed = e.now().Sub(start)
+	}()
+
+	if e.fog {
+		board = e.guessHidden(fogView(board, e.player))
+	}
+	moves := legalMoves(board, e.player, rules)
+	if len(moves) == 0 {
+		return GGMove{}, false
+	}
+
+	// Search in a stable order, so that the seed alone decides between equally good moves.
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].String() < moves[j].String()
+	})
+
+	// Even if the very first search is cut short, there's always a legal move to fall back to.
+	e.deadline = e.now().Add(e.budget)
+	best := moves[:1]
+	for depth := 1; depth <= maxSearchDepth; depth++ {
+		ties, ok := e.searchRoot(board, moves, depth)
+		if !ok {
+			break
+		}
+		best = ties
+		e.stats.depth = depth
+	}
+
+	return best[e.rng.Intn(len(best))], true
+}
+
+// guessHidden fills the enemy pieces hidden by the fog of war with a random guess, drawn from the pieces
+// of a full army that aren't revealed yet. The guess can't be right about captured pieces, as the
+// engine doesn't know which those are.
+func (e *GGEngine) guessHidden(board GGBoard) GGBoard {
+	enemy := e.player.Opponent()
+	pool := map[GGPieceCode]int{}
+	for code, n := range roster {
+		pool[code] = n
+	}
+
+	hiddenSquares := [][2]int{}
+	for x := range board {
+		for y := range board[x] {
+			piece := board[x][y].piece
+			switch {
+			case piece.player != enemy:
+			case piece.code == hidden:
+				hiddenSquares = append(hiddenSquares, [2]int{x, y})
+			default:
+				pool[piece.code]--
+			}
+		}
+	}
+
+	// Draw in a stable order, so that the seed alone decides the guess.
+	guesses := []GGPieceCode{}
+	for _, code := range pieceCodes {
+		for i := 0; i < pool[code]; i++ {
+			guesses = append(guesses, code)
+		}
+	}
+	e.rng.Shuffle(len(guesses), func(i, j int) {
+		guesses[i], guesses[j] = guesses[j], guesses[i]
+	})
+
+	for i, square := range hiddenSquares {
+		code := private
+		if i < len(guesses) {
+			code = guesses[i]
+		}
+		board[square[0]][square[1]].piece.code = code
+	}
+
+	return board
+}
+
+// searchRoot finds the best of the given moves at the given depth, in order, reporting false if the search timed out.
+func (e *GGEngine) searchRoot(board GGBoard, moves []GGMove, depth int) ([]GGMove, bool) {
+	var best []GGMove
+	bestScore := -maxScore
+	for _, m := range moves {
+		next := board
+		playMove(&next, m, e.rules)
+
+		// Widen the window by one so that moves as good as the best one get their exact score.
+		score, ok := e.negamax(next, e.player.Opponent(), depth-1, -maxScore, -bestScore+1)
+		if !ok {
+			return nil, false
+		}
+
+		switch {
+		case -score > bestScore:
+			best = []GGMove{m}
+			bestScore = -score
+		case -score == bestScore:
+			best = append(best, m)
+		}
+	}
+
+	return best, true
+}
+
+// negamax scores the board from the given player's point of view, reporting false if the search timed out.
+func (e *GGEngine) negamax(board GGBoard, player GGPlayer, depth int, alpha int, beta int) (int, bool) {
+	if e.now().After(e.deadline) {
+		return 0, false
+	}
+	e.stats.nodes++
+
+	// Prefer quicker wins and slower losses.
+	if winner := boardWinner(board, player.Opponent(), e.rules); winner != "" {
+		if winner == player {
+			return winScore + depth, true
+		}
+		return -winScore - depth, true
+	}
+
+	if depth == 0 {
+		return evaluate(board, player), true
+	}
+
+	moves := legalMoves(board, player, e.rules)
+	if len(moves) == 0 {
+		return evaluate(board, player), true
+	}
+
+	for _, m := range moves {
+		next := board
+		playMove(&next, m, e.rules)
+
+		score, ok := e.negamax(next, player.Opponent(), depth-1, -beta, -alpha)
+		if !ok {
+			return 0, false
+		}
+
+		if -score >= beta {
+			return beta, true
+		}
+		if -score > alpha {
+			alpha = -score
+		}
+	}
+
+	return alpha, true
+}
+
+// evaluate statically scores the board from the given player's point of view, by material.
+func evaluate(board GGBoard, player GGPlayer) int {
+	score := 0
+	for _, row := range board {
+		for _, square := range row {
+			if square.IsEmpty() {
+				continue
+			}
+
+			if square.piece.player == player {
+				score += pieceValue(square.piece.code)
+			} else {
+				score -= pieceValue(square.piece.code)
+			}
+		}
+	}
+
+	return score
+}
+
+// pieceValue returns how much a piece is worth to the AI.
+// Unlike GGPiece.Power, the Spy isn't treated as the strongest piece and the Flag is
+// worthless since losing it is scored as a loss instead.
+func pieceValue(code GGPieceCode) int {
+	switch code {
+	case spy:
+		return 10
+	case flag:
+		return 0
+	}
+
+	return GGPiece{code: code}.Power() + 1
+}
+
+// ==============================================================================
+// Utility / helper functions.
+// ==============================================================================
+
+// squareAddressToCoordinates is a helper function to convert a square's index to its readable coordinate.
+// example: (0, 3) -> D1, (7, 5) -> F8.
+func squareAddressToCoordinates(x int, y int) string {
+	if !isOnBoard(x, y) {
+		return ""
+	}
+
+	alpha := []string{"A", "B", "C", "D", "E", "F", "G", "H", "I"}
+	return fmt.Sprintf("%s%d", alpha[y], x+1)
+}
+
+// squareAddressToNumeric converts a square's index to the numeric debug notation.
+// example: (0, 3) -> (0,3)
+func squareAddressToNumeric(x int, y int) string {
+	return fmt.Sprintf("(%d,%d)", x, y)
+}
+
+// normalizeCoordinates rewrites the squares of a command written in the numeric notation into the
+// algebraic one, so that commands can be matched the same way whichever notation they use. Only the
+// tokens that the command takes squares in are rewritten (see squareTokens), so that paths and notes
+// are left as is, and so is the command if none of them are numeric.
+// example: "MV (1,1) (2,1)" -> "MV B2 B3"
+func normalizeCoordinates(cmd string) string {
+	tokens := tokenize(cmd)
+	if len(tokens) == 0 {
+		return cmd
+	}
+
+	normalized := false
+	for _, i := range squareTokens[tokens[0]] {
+		if i < len(tokens) {
+			if square := normalizeSquare(tokens[i]); square != tokens[i] {
+				tokens[i] = square
+				normalized = true
+			}
+		}
+	}
+
+	if !normalized {
+		return cmd
+	}
+	return strings.Join(tokens, " ")
+}
+
+// normalizeSquare rewrites a square written in the numeric notation into the algebraic one. Anything
+// else, including squares that aren't on the board, is left as is.
+// example: "(1,1)" -> "B2"
+func normalizeSquare(token string) string {
+	groups := numericSquareRegex.FindStringSubmatch(token)
+	if groups == nil {
+		return token
+	}
+
+	x, _ := strconv.Atoi(groups[1])
+	y, _ := strconv.Atoi(groups[2])
+	if !isOnBoard(x, y) {
+		return token
+	}
+	return squareAddressToCoordinates(x, y)
+}
+
+// parsePlayer converts a player token to its player, in either case (ex: "w" -> White).
+func parsePlayer(token string) (GGPlayer, error) {
+	switch player := GGPlayer(strings.ToUpper(token)); player {
+	case playerWhite, playerBlack:
+		return player, nil
+	}
+
+	return "", fmt.Errorf("invalid player %q, expected W or B", token)
+}
+
+// parseCoordinates validates a coordinate string and converts it to its board index.
+func parseCoordinates(coordinates string) (int, int, error) {
+	if !coordinatesRegex.MatchString(coordinates) {
+		return 0, 0, fmt.Errorf("invalid coordinates %q, expected a file A-I and a rank 1-8 (ex: B7)", coordinates)
+	}
+
+	x, y := coordinatesToSquareAddress(coordinates)
+	return x, y, nil
+}
+
+// coordinatesToSquareAddress converts a coordinate string to its actual board index.
+// example: B7 -> (6, 1)
+func coordinatesToSquareAddress(coordinates string) (int, int) {
+	rowNumber, _ := strconv.Atoi(string(coordinates[1]))
+	fileName := string(coordinates[0])
+
+	filesMap := map[string]int{
+		"A": 0,
+		"B": 1,
+		"C": 2,
+		"D": 3,
+		"E": 4,
+		"F": 5,
+		"G": 6,
+		"H": 7,
+		"I": 8,
+	}
+
+	return rowNumber - 1, filesMap[fileName]
+}
+
+// tokenize splits a command into its tokens, treating any run of whitespace as a single separator.
+// example: "MV  A3\tA4 " -> ["MV", "A3", "A4"]
+func tokenize(cmd string) []string {
+	return strings.Fields(cmd)
+}
+
+// checkArity ensures that a tokenized command has exactly n tokens.
+func checkArity(tokens []string, n int) error {
+	if len(tokens) != n {
+		return fmt.Errorf("expected %d tokens, got %d", n, len(tokens))
+	}
+
+	return nil
+}
+
+// centered pads the text on both sides to the given width, cutting it short if it's too long.
+// example: ("PVT", 7) -> "  PVT  "
+func centered(text string, width int) string {
+	if len(text) > width {
+		return text[:width]
+	}
+
+	left := (width - len(text)) / 2
+	return strings.Repeat(" ", left) + text + strings.Repeat(" ", width-len(text)-left)
+}
+
+// glyph returns the single-character representation of a piece code, used by compact renderings.
+// Generals are shown by their number of stars, and unknown codes as '?'.
+func glyph(code GGPieceCode) rune {
+	glyphMap := map[GGPieceCode]rune{
+		fiveStarGeneral:  '5',
+		fourStarGeneral:  '4',
+		threeStarGeneral: '3',
+		twoStarGeneral:   '2',
+		oneStarGeneral:   '1',
+		colonel:          'C',
+		ltColonel:        'L',
+		major:            'M',
+		captain:          'K',
+		firstLt:          'T',
+		secondLt:         't',
+		sergeant:         'N',
+		private:          'P',
+		spy:              'S',
+		flag:             'F',
+	}
+
+	if g, ok := glyphMap[code]; ok {
+		return g
+	}
+	return '?'
+}
+
+// displayName returns the player's name from the given names along with their color (ex: "Alice (White)"),
+// or just their color if they don't have a name.
+func displayName(p GGPlayer, names map[GGPlayer]string) string {
+	if name := names[p]; name != "" {
+		return fmt.Sprintf("%s (%s)", name, p)
+	}
+
+	return p.String()
+}
+
+// placement is a piece along with the coordinates of the square it's on.
+type placement struct {
+	coordinates string
+	piece       GGPiece
+}
+
+// sortedPlacements lists every piece on the board, sorted by the coordinates of their squares: by file,
+// then by rank (ex: A1, A2, ..., A8, B1, ...). Empty squares are left out.
+func sortedPlacements(board GGBoard) []placement {
+	placements := []placement{}
+	for x := range board {
+		for y := range board[x] {
+			if piece := board[x][y].piece; !piece.IsEmpty() {
+				placements = append(placements, placement{coordinates: squareAddressToCoordinates(x, y), piece: piece})
+			}
+		}
+	}
+
+	// Coordinates are a file letter and a single rank digit, so they sort as strings.
+	sort.Slice(placements, func(i, j int) bool {
+		return placements[i].coordinates < placements[j].coordinates
+	})
+
+	return placements
+}
+
+// barrierSquares lists the coordinates of the board's barriers, in the same order as sortedPlacements.
+func barrierSquares(board GGBoard) []string {
+	barriers := []string{}
+	for x := range board {
+		for y := range board[x] {
+			if board[x][y].barrier {
+				barriers = append(barriers, squareAddressToCoordinates(x, y))
+			}
+		}
+	}
+	sort.Strings(barriers)
+
+	return barriers
+}
+
+// revealedSquares lists the coordinates of the player's pieces that the other player has seen, in the same
+// order as barrierSquares.
+func revealedSquares(board GGBoard, player GGPlayer) []string {
+	revealed := []string{}
+	for x := range board {
+		for y := range board[x] {
+			if piece := board[x][y].piece; piece.player == player && piece.revealed {
+				revealed = append(revealed, squareAddressToCoordinates(x, y))
+			}
+		}
+	}
+	sort.Strings(revealed)
+
+	return revealed
+}
+
+// glyphCode returns the piece code that the given glyph stands for, the reverse of glyph.
+func glyphCode(g rune) (GGPieceCode, bool) {
+	for _, code := range pieceCodes {
+		if glyph(code) == g {
+			return code, true
+		}
+	}
+
+	return "", false
+}
+
+// closestCommand returns the name closest to the given command, or an empty string if none are close enough.
+// A name is close enough if it's within one edit for every three characters of it (but at least one edit),
+// so that short names aren't suggested for just any short input. Ties go to the name that comes first.
+func closestCommand(cmd string, names []string) string {
+	closest := ""
+	closestDistance := -1
+	for _, name := range names {
+		d := levenshtein(cmd, name)
+		if d > max(1, len(name)/3) {
+			continue
+		}
+
+		if closestDistance == -1 || d < closestDistance {
+			closest = name
+			closestDistance = d
+		}
+	}
+
+	return closest
+}
+
+// levenshtein returns the edit distance between two strings,
+// i.e. the number of single-character insertions, deletions, or substitutions to turn one into the other.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	// Only the previous row of the distance matrix is needed.
+	previous := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current := make([]int, len(rb)+1)
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+
+	return previous[len(rb)]
+}
+
+// parseDirective splits a directive line into its key and value.
+// example: "#@first B" -> ("first", "B")
+func parseDirective(line string) (string, string) {
+	key, value, _ := strings.Cut(strings.TrimPrefix(line, directivePrefix), " ")
+	return strings.TrimSpace(key), strings.TrimSpace(value)
+}
+
+// moveDistance returns how many squares a move covers, along ranks and files.
+func moveDistance(m GGMove) int {
+	return abs(m.toX-m.fromX) + abs(m.toY-m.fromY)
+}
+
+// abs returns the absolute value of n.
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
+
+// rotateBoard returns the board rotated by 180 degrees, with the pieces handed over to the other player.
+// example: White's piece on A1 ends up as Black's piece on I8, and Black's piece on C7 as White's on G2.
+func rotateBoard(board GGBoard) GGBoard {
+	rotated := GGBoard{}
+	for x := range board {
+		for y := range board[x] {
+			square := board[x][y]
+			if !square.IsEmpty() {
+				square.piece.player = square.piece.player.Opponent()
+			}
+			rotated[rows-1-x][files-1-y] = square
+		}
+	}
+
+	return rotated
+}
+
+// flipBoard returns the board turned by 180 degrees, as it's seen from the other side. Unlike rotateBoard,
+// the pieces keep their colors: only the drawing changes, not the game.
+func flipBoard(board GGBoard) GGBoard {
+	flipped := GGBoard{}
+	for x := range board {
+		for y := range board[x] {
+			flipped[rows-1-x][files-1-y] = board[x][y]
+		}
+	}
+
+	return flipped
+}
+
+// rotateMove returns the move as it would be made on a board rotated by 180 degrees.
+func rotateMove(m GGMove) GGMove {
+	return GGMove{
+		fromX: rows - 1 - m.fromX,
+		fromY: files - 1 - m.fromY,
+		toX:   rows - 1 - m.toX,
+		toY:   files - 1 - m.toY,
+	}
+}
+
+// swapPlayers returns a copy of the per-player map with White's and Black's entries swapped, or nil if there's none.
+func swapPlayers[V any](m map[GGPlayer]V) map[GGPlayer]V {
+	if m == nil {
+		return nil
+	}
+
+	swapped := make(map[GGPlayer]V, len(m))
+	for player, v := range m {
+		swapped[player.Opponent()] = v
+	}
+
+	return swapped
+}
+
+// rotateSquare returns the square mirrored the way rotateBoard mirrors it, or nil if there's none.
+func rotateSquare(square *[2]int) *[2]int {
+	if square == nil {
+		return nil
+	}
+
+	return &[2]int{rows - 1 - square[0], files - 1 - square[1]}
+}
+
+// rosterViolations lists every piece on the board that its player's army can't have,
+// either because the piece code is unknown or because there are too many of them.
+// Extra flags are left to flagViolations.
+func rosterViolations(board GGBoard, rosters map[GGPlayer]map[GGPieceCode]int) []string {
+	violations := []string{}
+	for _, player := range []GGPlayer{playerWhite, playerBlack} {
+		// Collect the coordinates of each of the player's pieces.
+		placements := map[GGPieceCode][]string{}
+		unknown := []string{}
+		for x := range board {
+			for y := range board[x] {
+				piece := board[x][y].piece
+				if piece.player != player {
+					continue
+				}
+
+				coordinates := squareAddressToCoordinates(x, y)
+				if _, ok := roster[piece.code]; !ok {
+					unknown = append(unknown, fmt.Sprintf("%s at %s", piece.code, coordinates))
+					continue
+				}
+				placements[piece.code] = append(placements[piece.code], coordinates)
+			}
+		}
+
+		for _, code := range pieceCodes {
+			if code == flag {
+				continue
+			}
+			if max := rosters[player][code]; len(placements[code]) > max {
+				violations = append(violations, fmt.Sprintf(
+					"%s has %d %s (max %d): %s",
+					player, len(placements[code]), code, max, strings.Join(placements[code], ", "),
+				))
+			}
+		}
+
+		for _, u := range unknown {
+			violations = append(violations, fmt.Sprintf("%s has an unknown piece %s", player, u))
+		}
+	}
+
+	return violations
+}
+
+// flagViolations lists every player with more than one flag on the board, which makes the position impossible.
+func flagViolations(board GGBoard) []string {
+	violations := []string{}
+	for _, player := range []GGPlayer{playerWhite, playerBlack} {
+		flags := []string{}
+		for x := range board {
+			for y := range board[x] {
+				if piece := board[x][y].piece; piece.player == player && piece.code == flag {
+					flags = append(flags, squareAddressToCoordinates(x, y))
+				}
+			}
+		}
+
+		if len(flags) > 1 {
+			violations = append(violations, fmt.Sprintf(
+				"%s has %d %s (only one allowed): %s", player, len(flags), flag, strings.Join(flags, ", "),
+			))
+		}
+	}
+
+	return violations
+}
+
+// missingPieces lists the pieces of each player's army that haven't been placed on the board yet.
+func missingPieces(board GGBoard, rosters map[GGPlayer]map[GGPieceCode]int) []string {
+	missing := []string{}
+	for _, player := range []GGPlayer{playerWhite, playerBlack} {
+		counts := armyCounts(board, player)
+		for _, code := range pieceCodes {
+			if n := rosters[player][code] - counts[code]; n > 0 {
+				missing = append(missing, fmt.Sprintf("%s is missing %d %s", player, n, code))
+			}
+		}
 	}
+
+	return missing
 }
 
-// Quit allows the game to execute any cleanup routines.
-func (g *GG) Quit() {
-	g.logger.Println("quitting game.")
+// setupRankViolations lists every piece on the board that is outside of the ranks its player sets up on.
+func (g *GG) setupRankViolations(board GGBoard) []string {
+	violations := []string{}
+	for x := range board {
+		for y := range board[x] {
+			piece := board[x][y].piece
+			if board[x][y].IsEmpty() || g.inSetupRanks(piece.player, x) {
+				continue
+			}
+			violations = append(violations, fmt.Sprintf(
+				"%s's %s on %s is outside of its first %d ranks",
+				piece.player, piece.code, squareAddressToCoordinates(x, y), g.setupRanks,
+			))
+		}
+	}
+
+	return violations
 }
 
-// ==============================================================================
-// GG handler methods -- as opposed to "main game" methods.
-// These are prefixed by "Handle" and are invoked by user input.
-// ==============================================================================
+// armyCounts counts each of the player's pieces on the board, by piece code.
+func armyCounts(board GGBoard, player GGPlayer) map[GGPieceCode]int {
+	counts := map[GGPieceCode]int{}
+	for _, row := range board {
+		for _, square := range row {
+			if square.piece.player == player {
+				counts[square.piece.code]++
+			}
+		}
+	}
 
-// HandleExit handles the "exit" command.
-func (g *GG) HandleExit() {
-	g.logger.Println("exiting game loop.")
-	g.status = gameOver
+	return counts
 }
 
-// HandleInvalid handles a command not supported by the game.
-func (g *GG) HandleInvalid() {
-	fmt.Println("Invalid command.")
+// armyAsymmetries lists every piece code that the two players have a different number of on the board.
+func armyAsymmetries(board GGBoard) []string {
+	white := armyCounts(board, playerWhite)
+	black := armyCounts(board, playerBlack)
+
+	asymmetries := []string{}
+	for _, code := range pieceCodes {
+		if white[code] != black[code] {
+			asymmetries = append(asymmetries, fmt.Sprintf("%s: %d for White, %d for Black", code, white[code], black[code]))
+		}
+	}
+
+	return asymmetries
 }
 
-// HandleHelp shows the help message.
-func (g *GG) HandleHelp() {
-	g.out.Write("Available commands:\n")
-	g.out.Write("\t* SET: Set a piece into the board.\n")
-	g.out.Write("\t\t* Syntax: SET W|P COORD PIECECODE\n")
-	g.out.Write("\t* loadsample: Loads a sample game file.\n")
-	g.out.Write("\t* help: Show this help message.\n")
-	g.out.Write("\t* exit: Exit the game.\n")
+// standardRosters returns a fresh copy of the standard roster for each player.
+func standardRosters() map[GGPlayer]map[GGPieceCode]int {
+	rosters := map[GGPlayer]map[GGPieceCode]int{}
+	for _, player := range []GGPlayer{playerWhite, playerBlack} {
+		rosters[player] = map[GGPieceCode]int{}
+		for code, n := range roster {
+			rosters[player][code] = n
+		}
+	}
+
+	return rosters
 }
 
-// HandleSet parses the given command and places the piece into the given coordinates.
-func (g *GG) HandleSet(cmd string) {
-	tokens := strings.Split(cmd, " ")
-	// TODO : Validate these inputs.
-	player := tokens[1]
-	coordinates := tokens[2]
-	pieceCode := tokens[3]
+// parseTimeControl parses how long each side has for its moves, either the same for both or White's then Black's.
+// Each time is either a number of seconds or a duration.
+// example: "5m" -> (5m, 5m), "300:120" -> (5m, 2m).
+func parseTimeControl(value string) (time.Duration, time.Duration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("invalid time control %q, expected TIME or WHITE:BLACK", value)
+	}
 
-	x, y := coordinatesToSquareAddress(coordinates)
-	piece := GGPiece{player: GGPlayer(player), code: GGPieceCode(pieceCode)}
-	g.board[x][y].piece = piece
-	g.logger.Printf("Player %v places %v on %v", player, pieceCode, coordinates)
+	times := []time.Duration{}
+	for _, part := range parts {
+		d, err := time.ParseDuration(part)
+		if seconds, atoiErr := strconv.Atoi(part); atoiErr == nil {
+			d, err = time.Duration(seconds)*time.Second, nil
+		}
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("invalid time %q in time control %q, expected a positive number of seconds or a duration", part, value)
+		}
+		times = append(times, d)
+	}
+
+	if len(times) == 1 {
+		return times[0], times[0], nil
+	}
+	return times[0], times[1], nil
 }
 
-// HandleLoadSample opens a sample .gggn file (GG Game notation) and executes the contents.
-func (g *GG) HandleLoadSample() {
-	f, _ := os.Open(sampleGggnFile)
-	defer f.Close()
+// parsePuzzleGoal parses the value of a goal directive into a puzzle.
+// example: "capture-flag-in 3" -> capture the enemy Flag within 3 moves.
+func parsePuzzleGoal(value string) (*GGPuzzle, error) {
+	tokens := tokenize(value)
+	if err := checkArity(tokens, 2); err != nil {
+		return nil, fmt.Errorf("invalid goal %q: %v", value, err)
+	}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		currentLine := scanner.Text()
+	goal := GGGoalType(tokens[0])
+	if goal != goalCaptureFlag && goal != goalWin {
+		return nil, fmt.Errorf("invalid goal %q, expected %s or %s", value, goalCaptureFlag, goalWin)
+	}
 
-		// Skip empty lines.
-		if currentLine == "" {
-			continue
-		}
+	moves, err := strconv.Atoi(tokens[1])
+	if err != nil || moves < 1 {
+		return nil, fmt.Errorf("invalid goal %q, expected a positive number of moves", value)
+	}
 
-		// Ignore comments.
-		if currentLine[0] == '#' {
-			continue
-		}
+	return &GGPuzzle{goal: goal, moves: moves}, nil
+}
 
-		g.HandleSet(currentLine)
+// parseHandicap parses a handicap option into the handicapped player and the pieces they play without.
+// example: "W:2*G,COL" -> (W, [2*G COL])
+func parseHandicap(s string) (GGPlayer, []GGPieceCode, error) {
+	player, list, ok := strings.Cut(s, ":")
+	if !ok || (player != string(playerWhite) && player != string(playerBlack)) {
+		return "", nil, fmt.Errorf("invalid handicap %q, expected W|B:CODE,CODE", s)
 	}
 
-	g.status = gameInProgress
-	g.out.Write(fmt.Sprintf("File %s successfully loaded\n", f.Name()))
+	codes := []GGPieceCode{}
+	for _, code := range strings.Split(list, ",") {
+		codes = append(codes, GGPieceCode(strings.TrimSpace(code)))
+	}
+
+	return GGPlayer(player), codes, nil
 }
 
-// HandleMove moves a piece into the target square.
-func (g *GG) HandleMove(cmd string) {
-	tokens := strings.Split(cmd, " ")
-	// TODO : Validate these inputs.
-	from := tokens[1]
-	to := tokens[2]
+// validateMove checks if the given player can make the move on the board, returning the type of the move.
+func validateMove(board GGBoard, player GGPlayer, m GGMove, rules GGRuleSet) (GGMoveType, error) {
+	if m.fromX == m.toX && m.fromY == m.toY {
+		return moveInvalid, errors.New("origin and destination are the same")
+	}
 
-	fromX, fromY := coordinatesToSquareAddress(from)
-	toX, toY := coordinatesToSquareAddress(to)
+	if !isOneSquareAway(m.fromX, m.fromY, m.toX, m.toY) {
+		return moveInvalid, errors.New("can only move one square forward, backward, or sideways")
+	}
 
-	if !isOneSquareAway(fromX, fromY, toX, toY) {
-		g.out.Write("Invalid move: can only move one square at a time.\n")
-		return
+	fromSquare := board[m.fromX][m.fromY]
+	toSquare := board[m.toX][m.toY]
+
+	if toSquare.barrier {
+		return moveInvalid, errors.New("can't move into a barrier")
 	}
 
-	// Create reference variables for convenience.
-	fromSquare := &g.board[fromX][fromY]
-	toSquare := &g.board[toX][toY]
+	if fromSquare.piece.player != player {
+		return moveInvalid, fmt.Errorf("it is %s's turn to move", player)
+	}
 
-	if fromSquare.piece.player != g.playerToMove {
-		g.out.Write(fmt.Sprintf("Invalid move: it is %s's turn to move.\n", g.playerToMove))
-		return
+	moveType := fromSquare.To(toSquare)
+	if moveType == moveInvalid {
+		return moveInvalid, errors.New("can't challenge an allied piece")
 	}
 
-	moveType := fromSquare.To(*toSquare)
+	if rules.flagChallengeBan && moveType == moveChallenge && fromSquare.piece.code == flag {
+		return moveInvalid, errors.New("the Flag can't challenge under the current rules")
+	}
 
-	g.logger.Printf("Handling move type %v\n", moveType)
-	switch moveType {
-	case moveMove:
-		// Move to the target square and clear out the origin square.
-		toSquare.piece = fromSquare.piece
-		fromSquare.Clear()
-	case moveChallenge:
-		result := resolveChallenge(fromSquare.piece, toSquare.piece)
-		g.logger.Printf("%v vs %v: %v\n", fromSquare.piece.code, toSquare.piece.code, result)
+	if rules.freezeWinners && fromSquare.piece.frozen {
+		return moveInvalid, errors.New("the piece won a challenge last turn, and is frozen for this one")
+	}
 
-		switch result {
-		case resChallengerWins:
-			toSquare.piece = fromSquare.piece
-			fromSquare.Clear()
-		case resChallengerLoses:
-			fromSquare.Clear()
-		case resDraw:
-			fromSquare.Clear()
-			toSquare.Clear()
+	return moveType, nil
+}
+
+// playMove carries out an already validated move like applyMove, then applies the rules that follow a move.
+func playMove(board *GGBoard, m GGMove, rules GGRuleSet) GGChallengeResult {
+	player := board[m.fromX][m.fromY].piece.player
+	result := applyMove(board, m)
+
+	// The side's pieces frozen on its last turn sat this one out, and are free again.
+	if rules.freezeWinners {
+		for x := range board {
+			for y := range board[x] {
+				if board[x][y].piece.player == player {
+					board[x][y].piece.frozen = false
+				}
+			}
 		}
-	case moveInvalid:
-		g.out.Write("Invalid move.\n")
-	}
 
-	// Switch sides after every valid move.
-	if moveType != moveInvalid {
-		if g.playerToMove == playerWhite {
-			g.playerToMove = playerBlack
-		} else {
-			g.playerToMove = playerWhite
+		if result == resChallengerWins {
+			board[m.toX][m.toY].piece.frozen = true
 		}
 	}
+
+	return result
 }
 
-// ==============================================================================
-// IO definitions and methods. Used for managing input and output.
-// ==============================================================================
+// applyMove carries out an already validated move on the board, returning the challenge result if any.
+func applyMove(board *GGBoard, m GGMove) GGChallengeResult {
+	// Create reference variables for convenience.
+	fromSquare := &board[m.fromX][m.fromY]
+	toSquare := &board[m.toX][m.toY]
 
-// Input is the interface for fetching input from the outside world.
-type Input interface {
-	Read() string
+	// Move to the target square and clear out the origin square.
+	if toSquare.IsEmpty() {
+		toSquare.piece = fromSquare.piece
+		fromSquare.Clear()
+		return ""
+	}
+
+	result := resolveChallenge(fromSquare.piece, toSquare.piece)
+	switch result {
+	case resChallengerWins:
+		toSquare.piece = fromSquare.piece
+		fromSquare.Clear()
+	case resChallengerLoses:
+		fromSquare.Clear()
+	case resDraw:
+		fromSquare.Clear()
+		toSquare.Clear()
+	}
+
+	return result
 }
 
-// StdinInput allows fetching of input from Stdin.
-type StdinInput struct{}
+// legalMoves lists every valid move the given player can make on the board.
+func legalMoves(board GGBoard, player GGPlayer, rules GGRuleSet) []GGMove {
+	moves := []GGMove{}
+	own := board.Occupancy(player)
+	for _, square := range own.Squares() {
+		x, y := square[0], square[1]
+		for _, d := range directions {
+			// Allied pieces can't be challenged, no need to validate moves into them.
+			if own.Has(x+d[0], y+d[1]) {
+				continue
+			}
 
-// Read takes in a string from Stdin, cleans it, and returns it.
-func (i *StdinInput) Read() string {
-	reader := bufio.NewReader(os.Stdin)
-	cmd, err := reader.ReadString('\n')
-	if err != nil {
-		return cmdInvalid
+			m := GGMove{fromX: x, fromY: y, toX: x + d[0], toY: y + d[1]}
+			if _, err := validateMove(board, player, m, rules); err == nil {
+				moves = append(moves, m)
+			}
+		}
 	}
-	trimmedCmd := strings.TrimSpace(cmd)
-	singleSpacedCmd := strings.Join(strings.Fields(trimmedCmd), " ")
-	return singleSpacedCmd
-}
 
-// NewStdinInput initializes a new StdinInput.
-func NewStdinInput() *StdinInput {
-	return &StdinInput{}
+	return moves
 }
 
-// Output is the interface for writing output to the outside world.
-type Output interface {
-	Write(s string)
-}
+// influence counts, for each square, the player's pieces that attack or defend it.
+// A piece attacks the squares it can legally move into, and defends the allied pieces next to it.
+func influence(board GGBoard, player GGPlayer, rules GGRuleSet) [rows][files]int {
+	counts := [rows][files]int{}
+	for _, m := range legalMoves(board, player, rules) {
+		counts[m.toX][m.toY]++
+	}
 
-// StdoutOutput allows writing of output to Stdout.
-type StdoutOutput struct{}
+	for x := range board {
+		for y := range board[x] {
+			if board[x][y].piece.player != player {
+				continue
+			}
 
-// Write prints the given string to Stdout.
-func (o *StdoutOutput) Write(s string) {
-	fmt.Print(s)
+			for _, d := range directions {
+				nx, ny := x+d[0], y+d[1]
+				if isOnBoard(nx, ny) && board[nx][ny].piece.player == player {
+					counts[nx][ny]++
+				}
+			}
+		}
+	}
+
+	return counts
 }
 
-// GUI is the interface for handling interactable game elements.
-type GUI interface {
-	Draw(GGBoard)
+// threats lists the opponent's legal challenges that would beat one of the player's pieces.
+func threats(board GGBoard, player GGPlayer, rules GGRuleSet) []GGMove {
+	winning := []GGMove{}
+	for _, m := range legalMoves(board, player.Opponent(), rules) {
+		target := board[m.toX][m.toY].piece
+		if target.player != player {
+			continue
+		}
+
+		if resolveChallenge(board[m.fromX][m.fromY].piece, target) == resChallengerWins {
+			winning = append(winning, m)
+		}
+	}
+
+	return winning
 }
 
-// ConsoleGUI is a GUI implemented via console.
-type ConsoleGUI struct {
-	out *StdoutOutput
+// reviewMove explains what's wrong with making the given move on the board, if anything: losing the
+// challenge it makes, leaving the moved piece open to a winning challenge, or passing up capturing the
+// enemy Flag. A move that wins the game is never a blunder. Squares are written with the given function.
+func reviewMove(board GGBoard, m GGMove, rules GGRuleSet, square func(x int, y int) string) []string {
+	piece := board[m.fromX][m.fromY].piece
+	player := piece.player
+	target := board[m.toX][m.toY].piece
+	to := square(m.toX, m.toY)
+
+	after := board
+	result := playMove(&after, m, rules)
+	if boardWinner(after, player, rules) == player {
+		return nil
+	}
+
+	reasons := []string{}
+	if result == resChallengerLoses {
+		reasons = append(reasons, fmt.Sprintf("%s lost a challenge against the %s on %s", piece.code, target.code, to))
+	}
+
+	for _, t := range threats(after, player, rules) {
+		if t.toX == m.toX && t.toY == m.toY {
+			attacker := after[t.fromX][t.fromY].piece
+			reasons = append(reasons, fmt.Sprintf("left %s on %s open to the %s on %s", piece.code, to, attacker.code, square(t.fromX, t.fromY)))
+			break
+		}
+	}
+
+	for _, c := range legalMoves(board, player, rules) {
+		enemy := board[c.toX][c.toY].piece
+		if enemy.player != player.Opponent() || enemy.code != flag {
+			continue
+		}
+
+		if resolveChallenge(board[c.fromX][c.fromY].piece, enemy) == resChallengerWins {
+			reasons = append(reasons, fmt.Sprintf("missed capturing the Flag on %s from %s", square(c.toX, c.toY), square(c.fromX, c.fromY)))
+			break
+		}
+	}
+
+	return reasons
 }
 
-// NewConsoleGUI initializes a ConsoleGUI.
-func NewConsoleGUI(out *StdoutOutput) GUI {
-	return &ConsoleGUI{out: out}
+// boardWinner returns the player who has won on the given board, right after the given player moved, if any.
+// This mirrors the checks of GG.DetermineResult for an in-progress game.
+func boardWinner(board GGBoard, lastMover GGPlayer, rules GGRuleSet) GGPlayer {
+	whiteFlagFound := false
+	blackFlagFound := false
+
+	for _, row := range board {
+		for _, square := range row {
+			if square.piece.code == flag {
+				if square.piece.player == playerWhite {
+					whiteFlagFound = true
+				} else if square.piece.player == playerBlack {
+					blackFlagFound = true
+				}
+			}
+		}
+	}
+
+	if whiteFlagFound && !blackFlagFound {
+		return playerWhite
+	} else if blackFlagFound && !whiteFlagFound {
+		return playerBlack
+	}
+
+	// The engine can't tell how long a Flag has been home, so one that's next to an enemy piece
+	// doesn't count yet with the home-run survival rule.
+	home := func(player GGPlayer) bool {
+		if !isFlagHome(board, player) {
+			return false
+		}
+		x, y, _ := findPiece(board, player, flag)
+		return !rules.homeSurvival || !isFlagExposed(board, x, y)
+	}
+	whiteHome := home(playerWhite)
+	blackHome := home(playerBlack)
+	switch {
+	case whiteHome && blackHome:
+		// A draw isn't a win for either side.
+		if rules.dualHomeDraw {
+			return ""
+		}
+		return lastMover
+	case whiteHome:
+		return playerWhite
+	case blackHome:
+		return playerBlack
+	}
+
+	if rules.loneFlagLoss {
+		if winner, ok := blockedFlagWinner(board); ok {
+			return winner
+		}
+	}
+
+	return ""
 }
 
-// Draw draws the given board to the console.
-func (g ConsoleGUI) Draw(board GGBoard) {
-	// Draw header
-	g.out.Write(fmt.Sprintf("%s\n", strings.Repeat("=", 80)))
+// isFlagHome checks if the player's Flag is on the far rank, the 8th for White and the 1st for Black.
+func isFlagHome(board GGBoard, player GGPlayer) bool {
+	rank := rows - 1
+	if player == playerBlack {
+		rank = 0
+	}
 
-	// Draw actual board.
-	g.out.Write("\n")
-	for i := len(board) - 1; i >= 0; i-- {
-		g.out.Write("    ")
-		// Draw top edge.
-		for j := 0; j < len(board[i]); j++ {
-			g.out.Write(" -------")
+	for _, square := range board[rank] {
+		if square.piece.player == player && square.piece.code == flag {
+			return true
 		}
-		g.out.Write("\n")
+	}
 
-		// Draw each square.
-		g.out.Write("    ")
-		for j := 0; j < len(board[i]); j++ {
-			code := board[i][j].piece.code
-			if code == "" {
-				g.out.Write("|       ")
-			} else {
-				g.out.Write(fmt.Sprintf("|  %s  ", code))
+	return false
+}
+
+// isFlagExposed checks if the Flag on the given square is next to an enemy piece.
+func isFlagExposed(board GGBoard, x int, y int) bool {
+	player := board[x][y].piece.player
+	for _, d := range directions {
+		nx, ny := x+d[0], y+d[1]
+		if isOnBoard(nx, ny) && !board[nx][ny].IsEmpty() && board[nx][ny].piece.player != player {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fogView returns the board as the viewer sees it, with the enemy pieces that aren't revealed hidden.
+func fogView(board GGBoard, viewer GGPlayer) GGBoard {
+	for x := range board {
+		for y := range board[x] {
+			if piece := &board[x][y].piece; !piece.IsEmpty() && piece.player != viewer && !piece.revealed {
+				piece.code = hidden
 			}
 		}
-		g.out.Write("|\n")
+	}
 
-		if i == 0 {
-			// Draw bottom edge.
-			g.out.Write("    ")
-			for j := 0; j < len(board[i]); j++ {
-				g.out.Write(" -------")
+	return board
+}
+
+// findPiece returns the square address of the first of the player's pieces with the given code, if any.
+func findPiece(board GGBoard, player GGPlayer, code GGPieceCode) (int, int, bool) {
+	for x := range board {
+		for y := range board[x] {
+			if board[x][y].piece.player == player && board[x][y].piece.code == code {
+				return x, y, true
 			}
-			g.out.Write("\n")
 		}
 	}
 
-	// Draw footer
-	g.out.Write("\n")
-	g.out.Write(fmt.Sprintf("%s\n", strings.Repeat("=", 80)))
-	g.out.Write("\n")
+	return 0, 0, false
 }
 
-// NewStdoutOutput initializes a new StdoutOutput.
-func NewStdoutOutput() *StdoutOutput {
-	return &StdoutOutput{}
+// blockedFlagWinner returns the winner of a game where a lone Flag can't reach the other end: the side that
+// still has a way forward, or nobody for a draw if both Flags are blocked. It reports false if neither is.
+func blockedFlagWinner(board GGBoard) (GGPlayer, bool) {
+	whiteBlocked := isLoneFlagBlocked(board, playerWhite)
+	blackBlocked := isLoneFlagBlocked(board, playerBlack)
+	switch {
+	case whiteBlocked && blackBlocked:
+		return "", true
+	case whiteBlocked:
+		return playerBlack, true
+	case blackBlocked:
+		return playerWhite, true
+	}
+
+	return "", false
 }
 
-// ==============================================================================
-// Utility / helper functions.
-// ==============================================================================
+// isLoneFlagBlocked checks if the player's only remaining piece is the Flag, and if it has no path to
+// the opposite end of the board. The flag can walk through empty squares and take the enemy flag, but
+// challenging anything else loses it, so every other piece is a wall, as are the barriers.
+func isLoneFlagBlocked(board GGBoard, player GGPlayer) bool {
+	flagX, flagY := -1, -1
+	for x := range board {
+		for y := range board[x] {
+			piece := board[x][y].piece
+			if piece.player != player {
+				continue
+			}
+			if piece.code != flag {
+				return false
+			}
+			flagX, flagY = x, y
+		}
+	}
 
-// squareAddressToCoordinates is a helper function to a square's index to its readable coordinate.
-// example: 03 -> A4, 57 -> F8.
-func squareAddressToCoordinates(x int, y int) string {
-	if x > rows || y > files {
-		return ""
+	if flagX == -1 {
+		return false
 	}
 
-	alpha := []string{"A", "B", "C", "D", "E", "F", "G", "H", "I"}
-	return fmt.Sprintf("%s%d", alpha[x], y+1)
-}
+	// White heads for the 8th rank, Black for the 1st.
+	goal := rows - 1
+	if player == playerBlack {
+		goal = 0
+	}
 
-// coordinatesToSquareAddress converts a coordinate string to its actual board index.
-// example: B7 -> (1, 6)
-func coordinatesToSquareAddress(coordinates string) (int, int) {
-	rowNumber, _ := strconv.Atoi(string(coordinates[1]))
-	fileName := string(coordinates[0])
+	visited := [rows][files]bool{}
+	visited[flagX][flagY] = true
+	queue := [][2]int{{flagX, flagY}}
+	for len(queue) > 0 {
+		x, y := queue[0][0], queue[0][1]
+		queue = queue[1:]
+		if x == goal {
+			return false
+		}
 
-	filesMap := map[string]int{
-		"A": 0,
-		"B": 1,
-		"C": 2,
-		"D": 3,
-		"E": 4,
-		"F": 5,
-		"G": 6,
-		"H": 7,
-		"I": 8,
+		for _, d := range directions {
+			nx, ny := x+d[0], y+d[1]
+			if !isOnBoard(nx, ny) || visited[nx][ny] {
+				continue
+			}
+
+			square := board[nx][ny]
+			if square.barrier || (!square.IsEmpty() && (square.piece.player == player || square.piece.code != flag)) {
+				continue
+			}
+
+			visited[nx][ny] = true
+			queue = append(queue, [2]int{nx, ny})
+		}
 	}
 
-	return rowNumber - 1, filesMap[fileName]
+	return true
+}
+
+// describeResult returns a user-friendly description of a challenge result.
+func describeResult(result GGChallengeResult) string {
+	switch result {
+	case resChallengerWins:
+		return "the challenger wins"
+	case resChallengerLoses:
+		return "the challenger loses"
+	case resDraw:
+		return "both pieces are eliminated"
+	}
+
+	return ""
 }
 
 // resolveChallenge determines the result of a piece challenge.
@@ -688,10 +6892,20 @@ func resolveChallenge(challenger GGPiece, target GGPiece) GGChallengeResult {
 	return resChallengerLoses
 }
 
-// isOneSquareAway checks if the two given coordinates are one square apart.
+// isOneSquareAway checks if the two given coordinates are on the board and exactly one square
+// apart, either along a rank or a file (pieces can't move diagonally).
 func isOneSquareAway(fromX, fromY, toX, toY int) bool {
+	if !isOnBoard(fromX, fromY) || !isOnBoard(toX, toY) {
+		return false
+	}
+
 	diffX := fromX - toX
 	diffY := fromY - toY
 
-	return diffX >= -1 && diffX <= 1 && diffY >= -1 && diffY <= 1
+	return (diffX == 0 && (diffY == -1 || diffY == 1)) || (diffY == 0 && (diffX == -1 || diffX == 1))
+}
+
+// isOnBoard checks if the given square address is within the board's bounds.
+func isOnBoard(x, y int) bool {
+	return x >= 0 && x < rows && y >= 0 && y < files
 }
@@ -0,0 +1,4655 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// linesInput reads the given lines one at a time, and exits once there are none left.
+type linesInput struct {
+	lines []string
+}
+
+// Read returns the next line, or the exit command if every line was read.
+func (i *linesInput) Read() string {
+	if len(i.lines) == 0 {
+		return cmdExit
+	}
+
+	line := i.lines[0]
+	i.lines = i.lines[1:]
+	return line
+}
+
+// recordingGUI keeps every board it's asked to draw, for checking what the players were shown.
+type recordingGUI struct {
+	boards []GGBoard
+}
+
+// Draw records the board.
+func (r *recordingGUI) Draw(board GGBoard) {
+	r.boards = append(r.boards, board)
+}
+
+// Render returns the position string of the board.
+func (r *recordingGUI) Render(board GGBoard) string {
+	return positionString(board, playerWhite)
+}
+
+// Legend lists the piece codes as their own symbols.
+func (r *recordingGUI) Legend(codes []GGPieceCode) []GGLegendEntry {
+	legend := []GGLegendEntry{}
+	for _, code := range codes {
+		legend = append(legend, GGLegendEntry{symbol: string(code), code: code})
+	}
+	return legend
+}
+
+// newTestGame returns a game that reads the given lines as its input, along with everything it writes.
+// Its randomness is seeded, and it never actually pauses.
+func newTestGame(lines ...string) (*GG, *BufferOutput) {
+	out := &BufferOutput{}
+	g := NewGG(log.New(io.Discard, "", 0), &linesInput{lines: lines}, out, &recordingGUI{})
+	g.SetSeed(1)
+	g.SetSleeper(func(d time.Duration) {})
+	return g, out
+}
+
+// play runs the commands one at a time, the way the main loop does.
+func play(g *GG, cmds ...string) {
+	for _, cmd := range cmds {
+		g.commandStack.Append(cmd)
+		g.ResolveCommand()
+		g.DetermineResult()
+		g.ShowResult()
+	}
+}
+
+// writeFile writes the lines into a file in the test's temporary directory, and returns its path.
+func writeFile(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// pieceAt returns the piece on the square with the given coordinates.
+func pieceAt(g *GG, coordinates string) GGPiece {
+	x, y := coordinatesToSquareAddress(coordinates)
+	return g.board[x][y].piece
+}
+
+func TestLoadSampleFirstPlayerDirective(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "black.gggn", "#@first B", "SET W A1 FLG", "SET B I8 FLG"))
+	play(g, cmdLoadSample)
+
+	if g.playerToMove != playerBlack {
+		t.Errorf("player to move = %s, want %s", g.playerToMove, playerBlack)
+	}
+	if g.ply != 0 {
+		t.Errorf("ply = %d, want 0", g.ply)
+	}
+}
+
+func TestLoadSampleDefaultsToWhite(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "white.gggn", "SET W A1 FLG", "SET B I8 FLG"))
+	play(g, cmdLoadSample)
+
+	if g.playerToMove != playerWhite {
+		t.Errorf("player to move = %s, want %s", g.playerToMove, playerWhite)
+	}
+}
+
+func TestLoadSampleInvalidFirstPlayer(t *testing.T) {
+	g, out := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "bad.gggn", "#@first X", "SET W A1 FLG"))
+	play(g, cmdLoadSample)
+
+	if g.status == gameInProgress {
+		t.Error("game started from a file with an invalid starting player")
+	}
+	if !strings.Contains(out.String(), `invalid starting player "X"`) {
+		t.Errorf("output doesn't report the invalid player:\n%s", out.String())
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"MV A3 A4", []string{"MV", "A3", "A4"}},
+		{"MV A3 A4   ", []string{"MV", "A3", "A4"}},
+		{"SET\tW  A1\t FLG", []string{"SET", "W", "A1", "FLG"}},
+		{"   ", []string{}},
+	}
+	for _, tt := range tests {
+		got := tokenize(tt.cmd)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestCheckArity(t *testing.T) {
+	if err := checkArity(tokenize("MV A3 A4"), 3); err != nil {
+		t.Errorf("checkArity of a complete move: %v", err)
+	}
+	if err := checkArity(tokenize("MV A3"), 3); err == nil {
+		t.Error("checkArity accepted a move without a destination")
+	}
+}
+
+func TestHandleSetArity(t *testing.T) {
+	g, out := newTestGame()
+	g.HandleSet("SET W\tA1  FLG ")
+	if got := pieceAt(g, "A1"); got.code != flag || got.player != playerWhite {
+		t.Errorf("A1 = %+v, want White's Flag", got)
+	}
+
+	g.HandleSet("SET W A2")
+	if !strings.Contains(out.String(), "Invalid SET command: expected 4 tokens, got 3") {
+		t.Errorf("output doesn't report the missing token:\n%s", out.String())
+	}
+	if !pieceAt(g, "A2").IsEmpty() {
+		t.Error("a piece was set from an incomplete command")
+	}
+}
+
+func TestIsOneSquareAwayAtCorners(t *testing.T) {
+	corners := [][2]int{{0, 0}, {0, files - 1}, {rows - 1, 0}, {rows - 1, files - 1}}
+	for _, c := range corners {
+		x, y := c[0], c[1]
+		for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			toX, toY := x+d[0], y+d[1]
+			want := isOnBoard(toX, toY)
+			if got := isOneSquareAway(x, y, toX, toY); got != want {
+				t.Errorf("isOneSquareAway(%d, %d, %d, %d) = %v, want %v", x, y, toX, toY, got, want)
+			}
+		}
+	}
+}
+
+func TestIsOneSquareAwayAlongEdges(t *testing.T) {
+	for y := 0; y < files; y++ {
+		if isOneSquareAway(0, y, -1, y) {
+			t.Errorf("move off the 1st rank from file %d allowed", y)
+		}
+		if isOneSquareAway(rows-1, y, rows, y) {
+			t.Errorf("move off the 8th rank from file %d allowed", y)
+		}
+	}
+	for x := 0; x < rows; x++ {
+		if isOneSquareAway(x, 0, x, -1) {
+			t.Errorf("move off the A file from rank %d allowed", x)
+		}
+		if isOneSquareAway(x, files-1, x, files) {
+			t.Errorf("move off the I file from rank %d allowed", x)
+		}
+		// The last file of a rank isn't next to the first file of the next one.
+		if x+1 < rows && isOneSquareAway(x, files-1, x+1, 0) {
+			t.Errorf("move wrapping from rank %d to the next allowed", x)
+		}
+	}
+}
+
+func TestIsOneSquareAwayRejectsDiagonals(t *testing.T) {
+	if isOneSquareAway(3, 3, 4, 4) {
+		t.Error("diagonal move allowed")
+	}
+	if isOneSquareAway(3, 3, 3, 5) {
+		t.Error("two-square move allowed")
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	g, _ := newTestGame()
+	got := ""
+	if err := g.RegisterCommand("shout", func(g *GG, cmd string) { got = cmd }); err != nil {
+		t.Fatal(err)
+	}
+
+	play(g, "shout hello there")
+	if got != "shout hello there" {
+		t.Errorf("handler got %q, want the whole command", got)
+	}
+}
+
+func TestRegisterCommandRejectsClashes(t *testing.T) {
+	g, _ := newTestGame()
+	handler := func(g *GG, cmd string) {}
+	if err := g.RegisterCommand(cmdHelp, handler); err == nil {
+		t.Error("registered over a built-in exact command")
+	}
+	if err := g.RegisterCommand(cmdMove, handler); err == nil {
+		t.Error("registered over a built-in pattern command")
+	}
+	if err := g.RegisterCommand("shout", handler); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RegisterCommand("shout", handler); err == nil {
+		t.Error("registered the same command twice")
+	}
+}
+
+func TestPatternCommandRouting(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		pattern *regexp.Regexp
+	}{
+		{"SET W A1 FLG", setCmdRegex},
+		{"MV A3 A4", mvCmdRegex},
+		{"export csv out.csv", csvCmdRegex},
+		{"export frames out", framesCmdRegex},
+		{"export json out.json", jsonExportRegex},
+		{"export gggn out.gggn", gggnExportRegex},
+		{"export pgn out.pgn", pgnExportRegex},
+		{"import json in.json", jsonCmdRegex},
+		{"import pgn in.pgn", pgnCmdRegex},
+		{"open sicilian", openCmdRegex},
+		{"try MV A3 A4", tryCmdRegex},
+		{"rewind 2", rewindCmdRegex},
+		{"wait 1s", waitCmdRegex},
+		{"barrier D4", barrierCmdRegex},
+		{"shuffle W", shuffleCmdRegex},
+		{"undoto 3", undoToCmdRegex},
+		{"puzzle p.gggn", puzzleCmdRegex},
+		{"lint p.gggn", lintCmdRegex},
+		{"note a fine move", noteCmdRegex},
+		{"rank SPY", rankCmdRegex},
+		{"fog on", fogCmdRegex},
+		{"notation numeric", notationRegex},
+		{"defense", defenseCmdRegex},
+		{"defense B", defenseCmdRegex},
+		{"flagthreats W", flagThreatRegex},
+		{"compare a.ggb b.ggb", compareCmdRegex},
+		{"openings games", openingsRegex},
+		{"savebin game.ggb", saveBinCmdRegex},
+		{"loadbin game.ggb", loadBinCmdRegex},
+	}
+
+	g, _ := newTestGame()
+	for _, tt := range tests {
+		var matched *regexp.Regexp
+		for _, c := range g.patternCommands {
+			if c.pattern.MatchString(tt.cmd) {
+				matched = c.pattern
+				break
+			}
+		}
+		if matched != tt.pattern {
+			t.Errorf("%q routed to %v, want %v", tt.cmd, matched, tt.pattern)
+		}
+	}
+}
+
+func TestExactCommandRouting(t *testing.T) {
+	g, _ := newTestGame()
+	for _, name := range []string{
+		cmdExit, cmdHelp, cmdLoadSample, cmdStart, cmdValidate, cmdTimeline, cmdRotate, cmdHeatmap, cmdStats,
+		cmdUndo, cmdRedo, cmdLegend, cmdAnalyze, cmdShare, cmdSuggest, cmdBattles, cmdEval, cmdCount, cmdForks,
+	} {
+		if _, ok := g.exactCommands[name]; !ok {
+			t.Errorf("%q isn't an exact command", name)
+		}
+	}
+}
+
+func TestResolveCommandInvalid(t *testing.T) {
+	g, out := newTestGame()
+	g.commandStack.Append("fly away")
+	if g.ResolveCommand() {
+		t.Error("an unknown command was resolved")
+	}
+	if !strings.Contains(out.String(), "Invalid command.") {
+		t.Errorf("output doesn't report the invalid command:\n%s", out.String())
+	}
+}
+
+func TestEngineRespectsTimeBudget(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample)
+
+	e := NewGGEngine(playerWhite, 50*time.Millisecond)
+	e.SetSeed(1)
+	start := time.Now()
+	m, ok := e.BestMove(g.board, g.rules)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("search took %s with a 50ms budget", elapsed)
+	}
+	if !ok {
+		t.Fatal("no move found")
+	}
+	if _, err := validateMove(g.board, playerWhite, m, g.rules); err != nil {
+		t.Errorf("best move %s is illegal: %v", m, err)
+	}
+}
+
+func TestEngineWithoutMoves(t *testing.T) {
+	g, _ := newTestGame()
+	g.HandleSet("SET B I8 FLG")
+
+	e := NewGGEngine(playerWhite, 10*time.Millisecond)
+	if m, ok := e.BestMove(g.board, g.rules); ok {
+		t.Errorf("found move %s without any pieces", m)
+	}
+}
+
+func TestValidateDuplicateUniquePiece(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "SET W A1 FLG", "SET W B1 5*G", "SET W C1 5*G", cmdValidate)
+
+	want := "White has 2 5*G (max 1): B1, C1"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+	}
+}
+
+func TestValidateCleanBoard(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "SET W A1 FLG", "SET W B1 5*G", cmdValidate)
+
+	if !strings.Contains(out.String(), "No roster violations found.") {
+		t.Errorf("output reports violations for a clean board:\n%s", out.String())
+	}
+}
+
+func TestStartRejectsDuplicateUniquePiece(t *testing.T) {
+	g, out := newTestGame()
+	g.status = gameSetup
+	play(g, "SET W A1 FLG", "SET W B1 5*G", "SET W C1 5*G", cmdStart)
+
+	if g.status == gameInProgress {
+		t.Error("game started with two 5*G")
+	}
+	if !strings.Contains(out.String(), "Unable to start the game:") {
+		t.Errorf("output doesn't explain why the game didn't start:\n%s", out.String())
+	}
+}
+
+func TestGlyphs(t *testing.T) {
+	want := map[GGPieceCode]rune{
+		fiveStarGeneral: '5', fourStarGeneral: '4', threeStarGeneral: '3', twoStarGeneral: '2', oneStarGeneral: '1',
+		colonel: 'C', ltColonel: 'L', major: 'M', captain: 'K', firstLt: 'T', secondLt: 't', sergeant: 'N',
+		private: 'P', spy: 'S', flag: 'F',
+	}
+	seen := map[rune]GGPieceCode{}
+	for _, code := range pieceCodes {
+		got := glyph(code)
+		if got != want[code] {
+			t.Errorf("glyph(%s) = %q, want %q", code, got, want[code])
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("%s and %s are both drawn as %q", code, other, got)
+		}
+		seen[got] = code
+	}
+	if got := glyph("XYZ"); got != '?' {
+		t.Errorf("glyph of an unknown code = %q, want '?'", got)
+	}
+}
+
+func TestCompactRender(t *testing.T) {
+	board := GGBoard{}
+	board[0][0].piece = GGPiece{code: flag, player: playerWhite}
+	board[7][8].piece = GGPiece{code: spy, player: playerBlack}
+
+	compact := ConsoleGUI{opts: ConsoleGUIOptions{mode: renderCompact}}.Render(board)
+	if !strings.Contains(compact, "| F |") || !strings.Contains(compact, "| S |") {
+		t.Errorf("compact board doesn't show the glyphs:\n%s", compact)
+	}
+	if strings.Contains(compact, "FLG") {
+		t.Errorf("compact board shows piece codes:\n%s", compact)
+	}
+
+	full := ConsoleGUI{opts: ConsoleGUIOptions{mode: renderFull}}.Render(board)
+	if !strings.Contains(full, "|  FLG  |") {
+		t.Errorf("full board doesn't show the piece codes:\n%s", full)
+	}
+}
+
+// testBoard returns a board with the given pieces, each written as its player, square and code (ex: "W A1 FLG").
+func testBoard(pieces ...string) GGBoard {
+	board := GGBoard{}
+	for _, p := range pieces {
+		tokens := tokenize(p)
+		x, y := coordinatesToSquareAddress(tokens[1])
+		board[x][y].piece = GGPiece{player: GGPlayer(tokens[0]), code: GGPieceCode(tokens[2])}
+	}
+	return board
+}
+
+func TestFlagChallengeBan(t *testing.T) {
+	board := testBoard("W D4 FLG", "B D5 FLG", "B I8 PVT")
+	challenge := newMove("D4", "D5")
+
+	if _, err := validateMove(board, playerWhite, challenge, GGRuleSet{}); err != nil {
+		t.Errorf("flag challenge rejected without the rule: %v", err)
+	}
+
+	banned := GGRuleSet{flagChallengeBan: true}
+	if _, err := validateMove(board, playerWhite, challenge, banned); err == nil {
+		t.Error("flag challenge allowed under the rule")
+	}
+	if _, err := validateMove(board, playerWhite, newMove("D4", "C4"), banned); err != nil {
+		t.Errorf("flag move to an empty square rejected under the rule: %v", err)
+	}
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+// Now returns the clock's current time.
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestTimelineDeltas(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}
+	g, out := newTestGame()
+	g.SetClock(clock.Now)
+	play(g, cmdLoadSample)
+
+	clock.now = clock.now.Add(2 * time.Second)
+	play(g, "MV A3 A4")
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	play(g, "MV A6 A5")
+	// A clock going backwards doesn't make a move happen before the previous one.
+	clock.now = clock.now.Add(-time.Minute)
+	play(g, "MV D3 D4", cmdTimeline)
+
+	for _, want := range []string{
+		"1. White MV A3 A4 (+2s)",
+		"2. Black MV A6 A5 (+500ms)",
+		"3. White MV D3 D4 (+0s)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("timeline doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "captures.csv")
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", "MV A4 A5", "MV B6 B5", "MV A5 B5", "export csv "+path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(records[0], ","); got != "piece,white,black" {
+		t.Errorf("header = %q", got)
+	}
+	if len(records) != len(pieceCodes)+1 {
+		t.Errorf("%d rows, want one per piece code", len(records)-1)
+	}
+	want := map[string]string{"2LT": "0,1", "PVT": "0,1", "3*G": "0,0"}
+	for _, record := range records[1:] {
+		if w, ok := want[record[0]]; ok && strings.Join(record[1:], ",") != w {
+			t.Errorf("%s row = %q, want %q", record[0], record[1:], w)
+		}
+	}
+}
+
+func TestExportCSVUnwritablePath(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "export csv "+filepath.Join(t.TempDir(), "missing", "captures.csv"))
+	if !strings.Contains(out.String(), "Unable to export to") {
+		t.Errorf("output doesn't report the error:\n%s", out.String())
+	}
+}
+
+func TestInformationalCommandsSkipRedraw(t *testing.T) {
+	g, _ := newTestGame()
+	gui := &recordingGUI{}
+	g.SetGUI(gui)
+	play(g, cmdLoadSample)
+	g.DrawBoard()
+	drawn := len(gui.boards)
+
+	play(g, cmdHelp)
+	g.DrawBoard()
+	if len(gui.boards) != drawn {
+		t.Errorf("board redrawn after help")
+	}
+
+	play(g, cmdOfferDraw)
+	g.DrawBoard()
+	if len(gui.boards) != drawn {
+		t.Errorf("board redrawn after offering a draw")
+	}
+
+	play(g, "MV A3 A4")
+	g.DrawBoard()
+	if len(gui.boards) != drawn+1 {
+		t.Errorf("board not redrawn after a move")
+	}
+}
+
+func TestHandicappedArmyValidates(t *testing.T) {
+	g, out := newTestGame()
+	player, codes, err := parseHandicap("W:2*G,COL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetHandicap(player, codes); err != nil {
+		t.Fatal(err)
+	}
+	play(g, cmdLoadSample)
+
+	if g.status != gameInProgress {
+		t.Fatalf("handicapped game didn't start:\n%s", out.String())
+	}
+	if violations := rosterViolations(g.board, g.rosters); len(violations) > 0 {
+		t.Errorf("handicapped army has violations: %q", violations)
+	}
+	for _, coordinates := range []string{"H1", "C1"} {
+		if piece := pieceAt(g, coordinates); piece.code != "" {
+			t.Errorf("%s still holds %s", coordinates, piece.code)
+		}
+	}
+}
+
+func TestHandicapRefusesFlag(t *testing.T) {
+	g, _ := newTestGame()
+	if err := g.SetHandicap(playerWhite, []GGPieceCode{"PVT", flag}); err == nil {
+		t.Error("the Flag was handicapped")
+	}
+	if len(g.handicaps[playerWhite]) > 0 || g.rosters[playerWhite]["PVT"] != 6 {
+		t.Error("a refused handicap changed the roster")
+	}
+}
+
+func TestParseHandicapInvalid(t *testing.T) {
+	for _, s := range []string{"", "X:COL", "W2*G"} {
+		if _, _, err := parseHandicap(s); err == nil {
+			t.Errorf("parseHandicap(%q) succeeded", s)
+		}
+	}
+}
+
+func TestRotateTwiceIsIdentity(t *testing.T) {
+	g, out := newTestGame()
+	g.SetTimeControl(time.Minute, 2*time.Minute)
+	g.SetPlayerNames("Alice", "Bob")
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", cmdUndo)
+	board, player := g.board, g.playerToMove
+	redoMoves, timeLeft, names := slices.Clone(g.redoMoves), maps.Clone(g.timeLeft), maps.Clone(g.names)
+
+	play(g, cmdRotate, cmdRotate)
+	if g.board != board {
+		t.Error("double rotation changed the board")
+	}
+	if g.playerToMove != player {
+		t.Errorf("player to move = %s, want %s", g.playerToMove, player)
+	}
+	if !slices.Equal(g.redoMoves, redoMoves) || !maps.Equal(g.timeLeft, timeLeft) || !maps.Equal(g.names, names) {
+		t.Errorf("double rotation changed the redo moves %v, clocks %v or names %v", g.redoMoves, g.timeLeft, g.names)
+	}
+
+	play(g, cmdRedo)
+	if pieceAt(g, "A5").code != secondLt {
+		t.Errorf("move not redone after a double rotation:\n%s", out.String())
+	}
+}
+
+func TestRotateMirrorsPosition(t *testing.T) {
+	g, _ := newTestGame()
+	g.board = testBoard("W A1 FLG", "W C2 SPY", "B E8 FLG")
+	play(g, cmdRotate)
+
+	want := testBoard("B I8 FLG", "B G7 SPY", "W E1 FLG")
+	if g.board != want {
+		t.Errorf("rotated board = %s, want %s",
+			positionString(g.board, playerWhite), positionString(want, playerWhite))
+	}
+	if g.playerToMove != playerBlack {
+		t.Errorf("player to move = %s, want %s", g.playerToMove, playerBlack)
+	}
+
+	g, out := newTestGame()
+	g.SetClock((&fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}).Now)
+	g.SetTimeControl(time.Minute, 2*time.Minute)
+	g.SetPlayerNames("Alice", "Bob")
+	play(g, cmdLoadSample, "MV A3 A4", cmdUndo, cmdRotate)
+
+	// White's army, now Black's, keeps its clock and name.
+	if g.timeLeft[playerBlack] != time.Minute || g.timeBudgets[playerBlack] != time.Minute || g.timeLeft[playerWhite] != 2*time.Minute {
+		t.Errorf("clocks after rotating = %v, budgets = %v", g.timeLeft, g.timeBudgets)
+	}
+	if g.names[playerBlack] != "Alice" || g.names[playerWhite] != "Bob" {
+		t.Errorf("names after rotating = %v", g.names)
+	}
+
+	// The move undone before rotating is redone on its mirrored squares.
+	play(g, cmdRedo)
+	if strings.Contains(out.String(), "Unable to redo") || pieceAt(g, "I5").code != threeStarGeneral || g.playerToMove != playerWhite {
+		t.Errorf("move not redone after rotating:\n%s", out.String())
+	}
+}
+
+func TestRotateResultNames(t *testing.T) {
+	g, out := newTestGame()
+	g.SetPlayerNames("Alice", "Bob")
+	g.board = testBoard("W D4 SGT", "W A1 FLG", "B D5 FLG")
+	g.status = gameInProgress
+	play(g, cmdRotate, "MV F5 F4")
+
+	// Alice's army, now Black's, captures the Flag.
+	if g.winner != playerBlack || !strings.Contains(out.String(), "Alice (Black) wins! (flag captured)") {
+		t.Errorf("result doesn't name the winner after rotating:\n%s", out.String())
+	}
+}
+
+func TestIsLoneFlagBlocked(t *testing.T) {
+	tests := []struct {
+		name  string
+		board GGBoard
+		want  bool
+	}{
+		{"walled in", testBoard("W A1 FLG", "B A2 PVT", "B B1 PVT", "B I8 FLG"), true},
+		{"around the blocker", testBoard("W D4 FLG", "B D5 PVT", "B I8 FLG"), false},
+		{"through the enemy flag", testBoard("W A1 FLG", "B A2 FLG", "B B1 PVT"), false},
+		{"walled in by its own side", testBoard("W A1 FLG", "W A2 PVT", "W B1 PVT", "B I8 FLG"), false},
+		{"already home", testBoard("W D8 FLG", "B I8 FLG"), false},
+		{"walled in by barriers", flagsWalledIn(), true},
+	}
+	for _, tt := range tests {
+		if got := isLoneFlagBlocked(tt.board, playerWhite); got != tt.want {
+			t.Errorf("%s: isLoneFlagBlocked = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoneFlagLoss(t *testing.T) {
+	board := testBoard("W A1 FLG", "B A2 PVT", "B B1 PVT", "B I8 FLG")
+	for _, enabled := range []bool{false, true} {
+		g, _ := newTestGame()
+		g.SetRules(GGRuleSet{loneFlagLoss: enabled})
+		g.board = board
+		g.status = gameInProgress
+		g.DetermineResult()
+
+		if over := g.status == gameOver; over != enabled {
+			t.Errorf("rule enabled = %v: game over = %v", enabled, over)
+		}
+		if enabled && g.winner != playerBlack {
+			t.Errorf("winner = %q, want %s", g.winner, playerBlack)
+		}
+	}
+}
+
+// flagsWalledIn returns a board where both lone Flags are walled in their corners by barriers.
+func flagsWalledIn() GGBoard {
+	board := testBoard("W A1 FLG", "B I8 FLG")
+	for _, coordinates := range []string{"A2", "B1", "I7", "H8"} {
+		x, y := coordinatesToSquareAddress(coordinates)
+		board[x][y].barrier = true
+	}
+	return board
+}
+
+func TestBothLoneFlagsBlocked(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetRules(GGRuleSet{loneFlagLoss: true})
+	g.board = flagsWalledIn()
+	g.status = gameInProgress
+	g.DetermineResult()
+
+	if g.status != gameOver || g.winner != "" || g.endReason != endStalemate {
+		t.Errorf("status = %s, winner = %q, reason = %q; want a draw by stalemate", g.status, g.winner, g.endReason)
+	}
+	for _, lastMover := range []GGPlayer{playerWhite, playerBlack} {
+		if winner := boardWinner(g.board, lastMover, g.rules); winner != "" {
+			t.Errorf("boardWinner after %s's move = %q, want a draw", lastMover, winner)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"help", "help", 0},
+		{"halp", "help", 1},
+		{"", "undo", 4},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidCommandSuggestions(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"halp", "Invalid command. Did you mean 'help'?\n"},
+		{"xyzzyq", "Invalid command.\n"},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		play(g, tt.cmd)
+		if !strings.HasPrefix(out.String(), tt.want) {
+			t.Errorf("%q: output = %q, want %q", tt.cmd, out.String(), tt.want)
+		}
+	}
+}
+
+func TestTry(t *testing.T) {
+	tests := []struct {
+		try  string
+		want string
+	}{
+		{"try MV D3 D4", "is a legal move."},
+		{"try MV A4 A5", "is a legal challenge: 3*G vs 2LT, the challenger wins."},
+		{"try MV A4 A6", "is invalid: can only move one square forward, backward, or sideways."},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5")
+		board, player, ply := g.board, g.playerToMove, g.ply
+
+		play(g, tt.try)
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%q: output doesn't contain %q:\n%s", tt.try, tt.want, out.String())
+		}
+		if g.board != board || g.playerToMove != player || g.ply != ply {
+			t.Errorf("%q changed the game", tt.try)
+		}
+	}
+}
+
+func TestManagerKeepsGamesApart(t *testing.T) {
+	m := NewGGManager(func() *GG {
+		g, _ := newTestGame()
+		return g
+	})
+	first := m.Current()
+	play(first, cmdLoadSample, "MV A3 A4")
+
+	play(first, cmdNewGame)
+	second := m.Current()
+	if second == first {
+		t.Fatal("newgame didn't switch to a new game")
+	}
+	play(second, cmdLoadSample)
+	before := first.board
+
+	play(second, "MV D3 D4", "MV A6 A5")
+	if first.board != before || first.playerToMove != playerBlack {
+		t.Error("moves in the second game changed the first")
+	}
+	if pieceAt(second, "A3").code != "3*G" {
+		t.Error("moves in the first game changed the second")
+	}
+
+	play(second, "game 1")
+	if m.Current() != first {
+		t.Error("game 1 didn't switch back to the first game")
+	}
+}
+
+func TestManagerInvalidGame(t *testing.T) {
+	m := NewGGManager(func() *GG {
+		g, _ := newTestGame()
+		return g
+	})
+	g := m.Current()
+	out := g.out.(*BufferOutput)
+	play(g, "game 2")
+
+	if m.Current() != g {
+		t.Error("switched to a game that doesn't exist")
+	}
+	if !strings.Contains(out.String(), "There is no game 2") {
+		t.Errorf("output doesn't report the missing game:\n%s", out.String())
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", "MV A4 A5", "MV B6 B5")
+	var buf bytes.Buffer
+	if err := g.EncodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := DecodeBinary(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.board != g.board || loaded.setup != g.setup {
+		t.Error("boards differ after the round trip")
+	}
+	if loaded.status != g.status || loaded.playerToMove != g.playerToMove || loaded.ply != g.ply {
+		t.Errorf("state = %s/%s/%d, want %s/%s/%d",
+			loaded.status, loaded.playerToMove, loaded.ply, g.status, g.playerToMove, g.ply)
+	}
+	if len(loaded.events) != len(g.events) {
+		t.Fatalf("%d events, want %d", len(loaded.events), len(g.events))
+	}
+	for i, e := range g.events {
+		l := loaded.events[i]
+		if l.move != e.move || l.moveType != e.moveType || l.challenger != e.challenger || l.target != e.target ||
+			l.result != e.result || !l.time.Equal(e.time) {
+			t.Errorf("event %d = %+v, want %+v", i, l, e)
+		}
+	}
+}
+
+func TestBinaryRoundTripKeepsClocks(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}
+	g, _ := newTestGame()
+	g.SetClock(clock.Now)
+	g.SetTimeControl(5*time.Minute, 2*time.Minute)
+	play(g, cmdLoadSample)
+	clock.now = clock.now.Add(10 * time.Second)
+	play(g, "MV A3 A4")
+	clock.now = clock.now.Add(20 * time.Second)
+	var buf bytes.Buffer
+	if err := g.EncodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The game is loaded hours later, into one with a time control of its own.
+	later := &fakeClock{now: clock.now.Add(3 * time.Hour)}
+	loaded, out := newTestGame()
+	loaded.SetClock(later.Now)
+	loaded.SetTimeControl(time.Hour, time.Hour)
+	if err := loaded.decodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	play(loaded)
+
+	if loaded.status != gameInProgress {
+		t.Fatalf("loaded game is over:\n%s", out.String())
+	}
+	if !maps.Equal(loaded.timeBudgets, g.timeBudgets) {
+		t.Errorf("time budgets = %v, want %v", loaded.timeBudgets, g.timeBudgets)
+	}
+	if loaded.clockLeft(playerWhite) != 4*time.Minute+50*time.Second || loaded.clockLeft(playerBlack) != 100*time.Second {
+		t.Errorf("clocks = %s/%s, want 4m50s/1m40s", loaded.clockLeft(playerWhite), loaded.clockLeft(playerBlack))
+	}
+
+	later.now = later.now.Add(5 * time.Second)
+	play(loaded, "MV A6 A5")
+	if loaded.ply != 2 || loaded.clockLeft(playerBlack) != 95*time.Second {
+		t.Errorf("ply %d, Black's clock = %s; want the move made with 1m35s left:\n%s",
+			loaded.ply, loaded.clockLeft(playerBlack), out.String())
+	}
+}
+
+func TestLoadBinResetsGameState(t *testing.T) {
+	g, out := newTestGame()
+	path := filepath.Join(t.TempDir(), "game.ggb")
+	play(g, cmdLoadSample, cmdSaveBin+" "+path, "MV A3 A4", "MV A6 A5", cmdUndo, cmdOfferDraw)
+	play(g, cmdLoadBin+" "+path)
+
+	if len(g.redoMoves) != 0 || g.drawOfferedBy != "" {
+		t.Errorf("redo moves %v and draw offer by %q carried over into the loaded game", g.redoMoves, g.drawOfferedBy)
+	}
+
+	out.Reset()
+	play(g, cmdRedo)
+	if !strings.Contains(out.String(), "There are no undone moves to redo.") || g.ply != 0 {
+		t.Errorf("move of the previous game redone after loading:\n%s", out.String())
+	}
+}
+
+func TestDecodeBinaryRejectsOtherFormats(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"text", "SET W A1 FLG\n"},
+		{"newer version", binaryMagic + "\x02"},
+		{"truncated", binaryMagic},
+	}
+	for _, tt := range tests {
+		g, _ := newTestGame()
+		play(g, cmdLoadSample)
+		board := g.board
+		if err := g.decodeBinary(strings.NewReader(tt.input)); err == nil {
+			t.Errorf("%s: decoded", tt.name)
+		}
+		if g.board != board {
+			t.Errorf("%s: failed decode changed the game", tt.name)
+		}
+		if loaded, err := DecodeBinary(strings.NewReader(tt.input)); err == nil || loaded != nil {
+			t.Errorf("%s: DecodeBinary = %v, %v; want an error", tt.name, loaded, err)
+		}
+	}
+}
+
+func TestRuleSetProfiles(t *testing.T) {
+	challenge := testBoard("W D4 FLG", "B D5 FLG", "B I8 PVT")
+	walledIn := testBoard("W A1 FLG", "B A2 PVT", "B B1 PVT", "B I8 FLG")
+	tests := []struct {
+		profile          string
+		flagChallengeBan bool
+		loneFlagLoss     bool
+	}{
+		{"standard", false, false},
+		{"club", true, true},
+		{"beginner", true, false},
+	}
+	for _, tt := range tests {
+		rules, ok := ruleSetProfiles[tt.profile]
+		if !ok {
+			t.Fatalf("no %s profile", tt.profile)
+		}
+
+		_, err := validateMove(challenge, playerWhite, newMove("D4", "D5"), rules)
+		if banned := err != nil; banned != tt.flagChallengeBan {
+			t.Errorf("%s: flag challenge banned = %v, want %v", tt.profile, banned, tt.flagChallengeBan)
+		}
+
+		g, _ := newTestGame()
+		g.SetRules(rules)
+		g.board = walledIn
+		g.status = gameInProgress
+		g.DetermineResult()
+		if lost := g.status == gameOver; lost != tt.loneFlagLoss {
+			t.Errorf("%s: lone flag lost = %v, want %v", tt.profile, lost, tt.loneFlagLoss)
+		}
+	}
+}
+
+func TestLoadRejectsDuplicatePlacement(t *testing.T) {
+	g, out := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "dup.gggn", "SET W A1 FLG", "SET W B1 PVT", "SET W A1 SPY", "SET B I8 FLG"))
+	play(g, cmdLoadSample)
+
+	if g.status == gameInProgress {
+		t.Error("game started from a file with two pieces on one square")
+	}
+	if !strings.Contains(out.String(), "duplicate placement at A1, first set on line 1 (line 3)") {
+		t.Errorf("output doesn't report the duplicate placement:\n%s", out.String())
+	}
+}
+
+func TestInfluence(t *testing.T) {
+	board := testBoard("W D4 PVT", "W D5 SPY", "B E4 PVT")
+	want := map[string]int{"C4": 1, "E4": 1, "D3": 1, "C5": 1, "E5": 1, "D6": 1, "D4": 1, "D5": 1}
+
+	counts := influence(board, playerWhite, GGRuleSet{})
+	for x := range counts {
+		for y := range counts[x] {
+			coordinates := squareAddressToCoordinates(x, y)
+			if counts[x][y] != want[coordinates] {
+				t.Errorf("%s = %d, want %d", coordinates, counts[x][y], want[coordinates])
+			}
+		}
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	g, out := newTestGame()
+	g.board = testBoard("W D4 PVT", "W D5 SPY", "B E4 PVT")
+	play(g, cmdHeatmap)
+
+	for _, line := range []string{"Heatmap for White:", "  5  . . 1 1 1 . . . .", "  4  . . 1 1 1 . . . ."} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("output doesn't contain %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMoveLimit(t *testing.T) {
+	g, out := newTestGame()
+	g.SetMaxMoves(3)
+	play(g, cmdLoadSample, "MV D3 D4", "MV A6 A5")
+	if g.status != gameInProgress {
+		t.Fatalf("game over below the move limit:\n%s", out.String())
+	}
+
+	play(g, "MV A3 A4")
+	if g.status != gameOver || g.winner != "" {
+		t.Errorf("status = %s, winner = %q; want a drawn game over", g.status, g.winner)
+	}
+	if !strings.Contains(out.String(), "Draw: move limit reached.") {
+		t.Errorf("output doesn't report the draw:\n%s", out.String())
+	}
+}
+
+func TestMoveLimitUnlimited(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		g, _ := newTestGame()
+		g.SetMaxMoves(n)
+		play(g, cmdLoadSample, "MV D3 D4", "MV A6 A5", "MV A3 A4")
+		if g.status != gameInProgress {
+			t.Errorf("max moves %d: game over", n)
+		}
+	}
+}
+
+func TestSetSampleFilePath(t *testing.T) {
+	g, out := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "fixture.gggn", "SET W C2 FLG", "SET B G7 FLG"))
+	play(g, cmdLoadSample)
+
+	if g.status != gameInProgress {
+		t.Fatalf("game didn't start from the injected file:\n%s", out.String())
+	}
+	if pieceAt(g, "C2").code != flag || pieceAt(g, "G7").code != flag || pieceAt(g, "F1").code != "" {
+		t.Errorf("board wasn't loaded from the injected file: %s", positionString(g.board, playerWhite))
+	}
+}
+
+func TestSetSampleFilePathMissing(t *testing.T) {
+	g, out := newTestGame()
+	g.SetSampleFilePath(filepath.Join(t.TempDir(), "missing.gggn"))
+	play(g, cmdLoadSample)
+
+	if g.status == gameInProgress {
+		t.Error("game started without a sample file")
+	}
+	if !strings.Contains(out.String(), "Unable to load file") {
+		t.Errorf("output doesn't report the missing file:\n%s", out.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	want := []string{
+		"\tMoves: 5 (3 plain, 2 challenges)\n",
+		"\tAverage move distance: 1.00\n",
+		"\t\t2LT: 0 White, 1 Black\n",
+		"\t\tPVT: 0 White, 1 Black\n",
+	}
+
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", "MV A4 A5", "MV B6 B5", "MV A5 B5")
+	out.Reset()
+	play(g, cmdStats)
+	for _, line := range want {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output doesn't contain %q:\n%s", line, out.String())
+		}
+	}
+
+	// The stats only depend on the events, so a reloaded game has the same ones.
+	var buf bytes.Buffer
+	if err := g.EncodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, loadedOut := newTestGame()
+	if err := loaded.decodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	play(loaded, cmdStats)
+	if loadedOut.String() != out.String() {
+		t.Errorf("reloaded stats = %q, want %q", loadedOut.String(), out.String())
+	}
+}
+
+func TestPieceAt(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample)
+
+	piece, occupied, err := g.PieceAt("F1")
+	if err != nil || !occupied || piece != (GGPiece{player: playerWhite, code: flag}) {
+		t.Errorf("PieceAt(F1) = %+v, %v, %v; want the white Flag", piece, occupied, err)
+	}
+
+	piece, occupied, err = g.PieceAt("E5")
+	if err != nil || occupied || !piece.IsEmpty() {
+		t.Errorf("PieceAt(E5) = %+v, %v, %v; want an empty square", piece, occupied, err)
+	}
+
+	for _, coordinates := range []string{"J1", "A9", "A0", "", "11"} {
+		if _, occupied, err := g.PieceAt(coordinates); err == nil || occupied {
+			t.Errorf("PieceAt(%q) = %v, %v; want an error", coordinates, occupied, err)
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	tests := []struct {
+		level GGLogLevel
+		want  []string
+	}{
+		{logError, []string{"error"}},
+		{logInfo, []string{"error", "info"}},
+		{logDebug, []string{"error", "info", "debug"}},
+		// The zero value, which parseLogLevel returns for an invalid name, still logs errors.
+		{0, []string{"error"}},
+	}
+	for _, tt := range tests {
+		var buf strings.Builder
+		l := NewGGLogger(log.New(&buf, "", 0), tt.level)
+		l.Errorf("error")
+		l.Infof("info")
+		l.Debugf("debug")
+
+		if got := strings.Fields(buf.String()); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("level %d logged %q, want %q", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]GGLogLevel{"error": logError, "info": logInfo, "debug": logDebug} {
+		if got, err := parseLogLevel(name); err != nil || got != want {
+			t.Errorf("parseLogLevel(%q) = %d, %v; want %d", name, got, err, want)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("parseLogLevel(verbose) succeeded")
+	}
+}
+
+func TestGameLogsAtItsLevel(t *testing.T) {
+	var buf strings.Builder
+	g := NewGG(log.New(&buf, "", 0), &linesInput{}, DiscardOutput{}, &recordingGUI{})
+	g.SetLogLevel(logError)
+	play(g, cmdLoadSample, "MV A3 A4")
+	if buf.Len() > 0 {
+		t.Errorf("info messages logged at the error level:\n%s", buf.String())
+	}
+}
+
+func TestRewind(t *testing.T) {
+	g, out := newTestGame()
+	gui := &recordingGUI{}
+	g.SetGUI(gui)
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5")
+	before := g.board
+	play(g, "MV A4 A5")
+	live, player := g.board, g.playerToMove
+
+	play(g, "rewind 1")
+	if len(gui.boards) == 0 || gui.boards[len(gui.boards)-1] != before {
+		t.Error("rewind 1 didn't show the board before the last move")
+	}
+	if g.board != live || g.playerToMove != player || len(g.events) != 3 {
+		t.Error("rewind changed the live game")
+	}
+
+	play(g, "rewind 4")
+	if !strings.Contains(out.String(), "Can only rewind up to 3 moves.") {
+		t.Errorf("output doesn't bound the rewind:\n%s", out.String())
+	}
+}
+
+func TestChallengeObservers(t *testing.T) {
+	tests := []struct {
+		moves              []string
+		challenger, target GGPieceCode
+		result             GGChallengeResult
+	}{
+		{[]string{"MV A3 A4", "MV A6 A5", "MV A4 A5"}, "3*G", "2LT", resChallengerWins},
+		{[]string{"MV D3 D4", "MV D6 D5", "MV D4 D5"}, "PVT", "4*G", resChallengerLoses},
+		{[]string{"MV F3 F4", "MV F6 F5", "MV F4 F5"}, "5*G", "5*G", resDraw},
+	}
+	for _, tt := range tests {
+		g, _ := newTestGame()
+		type challenge struct {
+			challenger, target GGPiece
+			result             GGChallengeResult
+		}
+		var first, second []challenge
+		g.OnChallenge(func(c, tgt GGPiece, r GGChallengeResult) { first = append(first, challenge{c, tgt, r}) })
+		g.OnChallenge(func(c, tgt GGPiece, r GGChallengeResult) { second = append(second, challenge{c, tgt, r}) })
+		play(g, cmdLoadSample)
+		play(g, tt.moves...)
+
+		if len(first) != 1 || len(second) != 1 {
+			t.Fatalf("%s: observers notified %d and %d times, want once each", tt.result, len(first), len(second))
+		}
+		got := first[0]
+		if got.challenger.code != tt.challenger || got.challenger.player != playerWhite ||
+			got.target.code != tt.target || got.target.player != playerBlack || got.result != tt.result {
+			t.Errorf("observer got %+v, want W %s vs B %s, %s", got, tt.challenger, tt.target, tt.result)
+		}
+	}
+}
+
+func TestFairnessSymmetric(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample)
+	if a := armyAsymmetries(g.board); len(a) > 0 {
+		t.Errorf("sample armies differ: %q", a)
+	}
+
+	play(g, cmdFairness)
+	if !strings.Contains(out.String(), "Both armies are made up of the same pieces.") {
+		t.Errorf("output doesn't report symmetric armies:\n%s", out.String())
+	}
+}
+
+func TestFairnessHandicapped(t *testing.T) {
+	g, out := newTestGame()
+	if err := g.SetHandicap(playerWhite, []GGPieceCode{"COL"}); err != nil {
+		t.Fatal(err)
+	}
+	play(g, cmdLoadSample)
+	if a := armyAsymmetries(g.board); len(a) != 1 || !strings.Contains(a[0], "COL") {
+		t.Errorf("asymmetries = %q, want the missing COL", a)
+	}
+
+	play(g, cmdFairness)
+	if !strings.Contains(out.String(), "The armies differ:") {
+		t.Errorf("output doesn't flag the handicap:\n%s", out.String())
+	}
+}
+
+// fixedTerminal is a terminal of a known width, if any.
+type fixedTerminal struct {
+	width int
+	ok    bool
+}
+
+// Width returns the terminal's fixed width.
+func (t fixedTerminal) Width() (int, bool) {
+	return t.width, t.ok
+}
+
+func TestAutoRenderMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     GGRenderMode
+		terminal Terminal
+		want     bool
+	}{
+		{"narrow", renderAuto, fixedTerminal{width: 60, ok: true}, true},
+		{"wide", renderAuto, fixedTerminal{width: 120, ok: true}, false},
+		{"exactly wide enough", renderAuto, fixedTerminal{width: fullBoardWidth, ok: true}, false},
+		{"unknown width", renderAuto, fixedTerminal{}, false},
+		{"no terminal", renderAuto, nil, false},
+		{"forced full", renderFull, fixedTerminal{width: 60, ok: true}, false},
+		{"forced compact", renderCompact, fixedTerminal{width: 120, ok: true}, true},
+	}
+	for _, tt := range tests {
+		gui := ConsoleGUI{opts: ConsoleGUIOptions{mode: tt.mode, terminal: tt.terminal, compactBelow: fullBoardWidth}}
+		if got := gui.isCompact(); got != tt.want {
+			t.Errorf("%s: compact = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnvTerminal(t *testing.T) {
+	t.Setenv("COLUMNS", "42")
+	if width, ok := (EnvTerminal{}).Width(); !ok || width != 42 {
+		t.Errorf("Width() = %d, %v; want 42, true", width, ok)
+	}
+
+	t.Setenv("COLUMNS", "")
+	if _, ok := (EnvTerminal{}).Width(); ok {
+		t.Error("width determined without COLUMNS")
+	}
+}
+
+func TestDrawOffer(t *testing.T) {
+	for _, accept := range []bool{true, false} {
+		g, out := newTestGame()
+		play(g, cmdLoadSample, cmdOfferDraw)
+		if !strings.Contains(out.String(), "Draw offered by White; Black to respond.\n") {
+			t.Errorf("result line doesn't show the pending offer:\n%s", out.String())
+		}
+
+		play(g, "MV A3 A4")
+		out.Reset()
+		response := cmdDeclineDraw
+		if accept {
+			response = cmdAcceptDraw
+		}
+		play(g, response)
+		if strings.Contains(out.String(), "Draw offered") {
+			t.Errorf("%s: result line still shows the offer:\n%s", response, out.String())
+		}
+		if accept && (g.status != gameOver || g.endReason != endAgreement || g.winner != "") {
+			t.Errorf("accepted draw: status = %s, reason = %q, winner = %q", g.status, g.endReason, g.winner)
+		}
+		if !accept && g.status != gameInProgress {
+			t.Errorf("declined draw ended the game")
+		}
+	}
+}
+
+func TestOffererCantRespondToDraw(t *testing.T) {
+	for _, response := range []string{cmdAcceptDraw, cmdDeclineDraw} {
+		g, out := newTestGame()
+		play(g, cmdLoadSample, cmdOfferDraw)
+		out.Reset()
+		play(g, response)
+		if g.status != gameInProgress || g.drawOfferedBy != playerWhite {
+			t.Errorf("%s: White responded to its own offer: status = %s, offered by %q", response, g.status, g.drawOfferedBy)
+		}
+		if !strings.Contains(out.String(), "The draw was offered by White, only Black can respond to it after White's move.\n") {
+			t.Errorf("%s: output doesn't refuse the response:\n%s", response, out.String())
+		}
+	}
+}
+
+func TestMovingDeclinesDrawOffer(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, cmdOfferDraw, "MV A3 A4", "MV A6 A5")
+	out.Reset()
+	play(g, cmdAcceptDraw)
+	if g.status != gameInProgress || !strings.Contains(out.String(), "There is no draw offer to respond to.") {
+		t.Errorf("draw accepted after the offer was moved past:\n%s", out.String())
+	}
+}
+
+func TestPuzzleSolved(t *testing.T) {
+	g, out := newTestGame()
+	path := writeFile(t, "puzzle.gggn", "#@goal capture-flag-in 2", "SET W A1 FLG", "SET W D4 SGT", "SET B D6 FLG", "SET B I8 PVT")
+	play(g, "puzzle "+path)
+	if g.puzzle == nil {
+		t.Fatalf("puzzle wasn't loaded:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "White to capture the enemy Flag within 2 moves") {
+		t.Errorf("output doesn't describe the goal:\n%s", out.String())
+	}
+
+	play(g, "MV D4 D5", "MV I8 I7", "MV D5 D6")
+	if !strings.Contains(out.String(), ">>>>> Puzzle solved in 2 moves!\n") {
+		t.Errorf("output doesn't report the solved puzzle:\n%s", out.String())
+	}
+}
+
+func TestPuzzleFailed(t *testing.T) {
+	g, out := newTestGame()
+	path := writeFile(t, "puzzle.gggn", "#@goal capture-flag-in 1", "SET W A1 FLG", "SET W D4 SGT", "SET B D6 FLG", "SET B I8 PVT")
+	play(g, "puzzle "+path, "MV D4 D5", "MV I8 I7", "MV D5 D6")
+
+	if !strings.Contains(out.String(), ">>>>> Puzzle failed: White to capture the enemy Flag within 1 moves.\n") {
+		t.Errorf("output doesn't report the failed puzzle:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "Puzzle solved") {
+		t.Errorf("puzzle solved past its move limit:\n%s", out.String())
+	}
+}
+
+func TestParsePuzzleGoalInvalid(t *testing.T) {
+	for _, value := range []string{"win-in", "win-in 0", "win-in three", "mate-in 2"} {
+		if _, err := parsePuzzleGoal(value); err == nil {
+			t.Errorf("parsePuzzleGoal(%q) succeeded", value)
+		}
+	}
+}
+
+func TestCommandParserTransitions(t *testing.T) {
+	tests := []struct {
+		tokens   []string
+		guidance []string
+	}{
+		{[]string{"MV", "A3", "A4"}, []string{guideOrigin, guideDestination, ""}},
+		{[]string{"SET", "W", "A1", "FLG"}, []string{guidePlayer, guideSquare, guidePiece, ""}},
+	}
+	for _, tt := range tests {
+		p := &GGCommandParser{}
+		if p.Guidance() != guideCommand {
+			t.Errorf("empty parser guidance = %q, want %q", p.Guidance(), guideCommand)
+		}
+		for i, token := range tt.tokens {
+			if err := p.Feed(token); err != nil {
+				t.Fatalf("Feed(%q): %v", token, err)
+			}
+			if p.Guidance() != tt.guidance[i] {
+				t.Errorf("after %q, guidance = %q, want %q", p, p.Guidance(), tt.guidance[i])
+			}
+		}
+		if !p.Done() || p.String() != strings.Join(tt.tokens, " ") {
+			t.Errorf("parser = %q, done = %v; want %q done", p, p.Done(), strings.Join(tt.tokens, " "))
+		}
+		if err := p.Feed("A5"); err == nil {
+			t.Errorf("%q accepted a token after it was done", p)
+		}
+	}
+}
+
+func TestCommandParserRejectsInvalidTokens(t *testing.T) {
+	tests := [][]string{
+		{"help"},
+		{"MV", "Z9"},
+		{"MV", "A3", "A"},
+		{"SET", "X"},
+		{"SET", "W", "A1", "KNG"},
+	}
+	for _, tokens := range tests {
+		p := &GGCommandParser{}
+		var err error
+		for _, token := range tokens {
+			if err = p.Feed(token); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Errorf("%q was accepted", tokens)
+		}
+		if len(p.tokens) != len(tokens)-1 {
+			t.Errorf("%q: invalid token was added to the command", tokens)
+		}
+	}
+}
+
+func TestInteractiveInput(t *testing.T) {
+	out := &BufferOutput{}
+	in := NewInteractiveInput(&linesInput{lines: []string{"MV", "A3", "Z9", "MV A3", "A4", "help"}}, out)
+
+	if got := in.Read(); got != "MV A3 A4" {
+		t.Errorf("Read() = %q, want %q", got, "MV A3 A4")
+	}
+	for _, want := range []string{"MV (enter origin coordinate): ", `invalid "Z9", expected to enter destination coordinate.`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if got := in.Read(); got != cmdHelp {
+		t.Errorf("Read() = %q, want %q", got, cmdHelp)
+	}
+}
+
+func TestStdinInputExitsOnEOF(t *testing.T) {
+	in := &StdinInput{reader: bufio.NewReader(strings.NewReader("MV  A3 A4\nhelp"))}
+	for _, want := range []string{"MV A3 A4", cmdHelp, cmdExit, cmdExit} {
+		if got := in.Read(); got != want {
+			t.Errorf("Read() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSwapSides(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, cmdSwapSides)
+	if g.playerToMove != playerWhite || !strings.Contains(out.String(), "Sides can only be swapped in analysis mode.") {
+		t.Errorf("sides swapped in normal play:\n%s", out.String())
+	}
+
+	g, _ = newTestGame()
+	g.SetAnalysis(true)
+	play(g, cmdLoadSample, cmdSwapSides)
+	if g.playerToMove != playerBlack || g.ply != 0 {
+		t.Errorf("player to move = %s, ply = %d; want %s without a move", g.playerToMove, g.ply, playerBlack)
+	}
+	play(g, "MV A6 A5")
+	if pieceAt(g, "A5").code != "2LT" {
+		t.Error("Black couldn't move after the swap")
+	}
+}
+
+func TestSwapSidesOutsideGame(t *testing.T) {
+	g, out := newTestGame()
+	g.SetAnalysis(true)
+	play(g, cmdSwapSides)
+	if !strings.Contains(out.String(), "Sides can only be swapped during the game.") {
+		t.Errorf("sides swapped before the game:\n%s", out.String())
+	}
+}
+
+func TestEngineTieBreakIsSeeded(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample)
+
+	// The clock ticks once per position, so every search stops at the same node.
+	bestMove := func(seed int64) GGMove {
+		clock := &fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}
+		e := NewGGEngine(playerWhite, 2000*time.Microsecond)
+		e.now = func() time.Time {
+			clock.now = clock.now.Add(time.Microsecond)
+			return clock.now
+		}
+		e.SetSeed(seed)
+		m, ok := e.BestMove(g.board, g.rules)
+		if !ok {
+			t.Fatal("no move found")
+		}
+		return m
+	}
+
+	want := bestMove(7)
+	for i := 0; i < 5; i++ {
+		if got := bestMove(7); got != want {
+			t.Fatalf("same seed picked %s, then %s", want, got)
+		}
+	}
+}
+
+func TestNotes(t *testing.T) {
+	g, out := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "noted.gggn", "#@note a quiet opening", "SET W A1 FLG", "SET W D3 PVT", "SET B I8 FLG"))
+	play(g, cmdLoadSample, "MV D3 D4", "note pushing the Private (see D4)")
+
+	if len(g.notes) != 2 || g.notes[0].ply != 0 || g.notes[1].ply != 1 {
+		t.Fatalf("notes = %+v, want one at ply 0 and one at ply 1", g.notes)
+	}
+	if g.notes[1].text != "pushing the Private (see D4)" {
+		t.Errorf("note text = %q", g.notes[1].text)
+	}
+
+	out.Reset()
+	play(g, cmdTimeline)
+	timeline := out.String()
+	opening := strings.Index(timeline, "\t# a quiet opening\n")
+	move := strings.Index(timeline, "\t1. White MV D3 D4")
+	push := strings.Index(timeline, "\t# pushing the Private (see D4)\n")
+	if opening == -1 || move == -1 || push == -1 || !(opening < move && move < push) {
+		t.Errorf("timeline doesn't show the notes around the move:\n%s", timeline)
+	}
+
+	var buf bytes.Buffer
+	if err := g.EncodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := newTestGame()
+	if err := loaded.decodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.notes) != 2 || loaded.notes[1].ply != 1 || loaded.notes[1].text != g.notes[1].text {
+		t.Errorf("notes after loading = %+v, want %+v", loaded.notes, g.notes)
+	}
+}
+
+func TestNoteDirectivePlies(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "noted.gggn",
+		"#@note a quiet opening", "#@note 1 pushing the Private", "#@note 5 past the last move",
+		"SET W A1 FLG", "SET W D3 PVT", "SET B I8 FLG", "SET B H8 PVT", "MV D3 D4", "MV H8 H7",
+	))
+	play(g, cmdLoadSample)
+
+	want := []GGNote{{ply: 0, text: "a quiet opening"}, {ply: 1, text: "pushing the Private"}, {ply: 2, text: "past the last move"}}
+	if len(g.notes) != len(want) {
+		t.Fatalf("notes = %+v, want %+v", g.notes, want)
+	}
+	for i, n := range g.notes {
+		if n.ply != want[i].ply || n.text != want[i].text {
+			t.Errorf("note %d = %+v, want %+v", i, n, want[i])
+		}
+	}
+
+	exported := &bytes.Buffer{}
+	if err := g.ExportGGGN(exported); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"#@note 0 a quiet opening\n", "#@note 1 pushing the Private\n", "#@note 2 past the last move\n"} {
+		if !strings.Contains(exported.String(), line) {
+			t.Errorf("export doesn't contain %q:\n%s", line, exported.String())
+		}
+	}
+
+	// The exported position doesn't include the moves, so its notes all come before the first one.
+	loaded, _ := newTestGame()
+	loaded.board = GGBoard{}
+	if err := loaded.loadFile(writeFile(t, "exported.gggn", strings.Split(strings.TrimSpace(exported.String()), "\n")...)); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.notes) != len(want) || loaded.notes[1].ply != 0 || loaded.notes[1].text != want[1].text {
+		t.Errorf("notes after reloading the export = %+v", loaded.notes)
+	}
+}
+
+func TestSetupBlock(t *testing.T) {
+	g, out := newTestGame("SET W A1 FLG", "SET W Z9 PVT", "SET B I8 FLG", "SET B H8 KNG", "done", "help")
+	g.status = gameSetup
+	play(g, cmdSetup)
+
+	if pieceAt(g, "A1").code != flag || pieceAt(g, "I8").code != flag {
+		t.Errorf("valid SET lines weren't applied: %s", positionString(g.board, playerWhite))
+	}
+	if !pieceAt(g, "H8").IsEmpty() {
+		t.Error("invalid SET line was applied")
+	}
+	for _, want := range []string{"Placed 2 pieces.\n", "Skipped 2 invalid lines:\n", "\tline 2: ", "\tline 4: "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if next := g.in.Read(); next != cmdHelp {
+		t.Errorf("setup read past done: next line = %q", next)
+	}
+}
+
+func TestDefaultResultFormatter(t *testing.T) {
+	tests := []struct {
+		winner GGPlayer
+		reason GGEndReason
+		want   string
+	}{
+		{playerWhite, endFlagCaptured, "White wins! (flag captured)"},
+		{playerBlack, endFlagHome, "Black wins! (flag reached the other side)"},
+		{playerWhite, endBothFlagsHome, "White wins! (both flags reached the other side)"},
+		{playerBlack, endStalemate, "Black wins! (stalemate)"},
+		{playerWhite, endTimeout, "White wins! (time ran out)"},
+		{playerBlack, "", "Black wins!"},
+		{"", endMoveLimit, "Draw: move limit reached."},
+		{"", endAgreement, "Draw: agreed by both players."},
+	}
+	f := DefaultResultFormatter{}
+	for _, tt := range tests {
+		if got := f.FormatResult(tt.winner, tt.reason); got != tt.want {
+			t.Errorf("FormatResult(%q, %q) = %q, want %q", tt.winner, tt.reason, got, tt.want)
+		}
+	}
+
+	named := DefaultResultFormatter{names: map[GGPlayer]string{playerWhite: "Alice"}}
+	if got := named.FormatResult(playerWhite, endFlagCaptured); got != "Alice (White) wins! (flag captured)" {
+		t.Errorf("named FormatResult = %q", got)
+	}
+}
+
+// shortResults announces results as the winner and reason alone.
+type shortResults struct{}
+
+// FormatResult returns the winner and reason.
+func (shortResults) FormatResult(winner GGPlayer, reason GGEndReason) string {
+	return fmt.Sprintf("%s/%s", winner, reason)
+}
+
+func TestCustomResultFormatter(t *testing.T) {
+	g, out := newTestGame()
+	g.SetResultFormatter(shortResults{})
+	g.board = testBoard("W D4 SGT", "W A1 FLG", "B D5 FLG")
+	g.status = gameInProgress
+	play(g, "MV D4 D5")
+
+	if !strings.Contains(out.String(), "White/flag captured") {
+		t.Errorf("output doesn't use the custom formatter:\n%s", out.String())
+	}
+}
+
+func TestEndReasons(t *testing.T) {
+	tests := []struct {
+		name   string
+		play   func(g *GG)
+		winner GGPlayer
+		reason GGEndReason
+	}{
+		{"flag captured", func(g *GG) {
+			g.board = testBoard("W D4 SGT", "W A1 FLG", "B D5 FLG")
+			g.status = gameInProgress
+			play(g, "MV D4 D5")
+		}, playerWhite, endFlagCaptured},
+		{"flag home", func(g *GG) {
+			g.board = testBoard("W D7 FLG", "B A8 FLG")
+			g.status = gameInProgress
+			play(g, "MV D7 D8")
+		}, playerWhite, endFlagHome},
+		{"stalemate", func(g *GG) {
+			g.SetRules(GGRuleSet{loneFlagLoss: true})
+			g.board = testBoard("W A1 FLG", "B A2 PVT", "B B1 PVT", "B I8 FLG")
+			g.status = gameInProgress
+			g.DetermineResult()
+		}, playerBlack, endStalemate},
+		{"move limit", func(g *GG) {
+			g.SetMaxMoves(1)
+			play(g, cmdLoadSample, "MV A3 A4")
+		}, "", endMoveLimit},
+		{"agreement", func(g *GG) {
+			play(g, cmdLoadSample, cmdOfferDraw, "MV A3 A4", cmdAcceptDraw)
+		}, "", endAgreement},
+		{"timeout", func(g *GG) {
+			clock := &fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}
+			g.SetClock(clock.Now)
+			g.SetTimeControl(time.Minute, time.Minute)
+			play(g, cmdLoadSample)
+			clock.now = clock.now.Add(2 * time.Minute)
+			g.DetermineResult()
+		}, playerBlack, endTimeout},
+	}
+	for _, tt := range tests {
+		g, _ := newTestGame()
+		tt.play(g)
+		if g.status != gameOver || g.winner != tt.winner || g.EndReason() != tt.reason {
+			t.Errorf("%s: status = %s, winner = %q, reason = %q; want game over, %q, %q",
+				tt.name, g.status, g.winner, g.EndReason(), tt.winner, tt.reason)
+		}
+	}
+}
+
+func TestEndReasonEmptyDuringGame(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4")
+	if g.EndReason() != "" {
+		t.Errorf("reason = %q during the game", g.EndReason())
+	}
+}
+
+func TestRestart(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample)
+	start := g.board
+	play(g, "MV A3 A4", "MV A6 A5", "MV A4 A5", cmdRestart)
+
+	if g.board != start {
+		t.Errorf("board = %s, want the starting position", positionString(g.board, playerWhite))
+	}
+	if g.playerToMove != playerWhite || g.ply != 0 || len(g.events) != 0 {
+		t.Errorf("player to move = %s, ply = %d, %d events; want a fresh game", g.playerToMove, g.ply, len(g.events))
+	}
+	if g.graveyard()[playerBlack]["2LT"] != 0 {
+		t.Error("captures survived the restart")
+	}
+	if !strings.Contains(out.String(), "Game restarted, White to move.") {
+		t.Errorf("output doesn't report the restart:\n%s", out.String())
+	}
+}
+
+func TestRestartOutsideGame(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdRestart)
+	if !strings.Contains(out.String(), "Only a game in progress can be restarted.") {
+		t.Errorf("output doesn't refuse the restart:\n%s", out.String())
+	}
+}
+
+func TestSameSquareMoveRejected(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A3")
+
+	if g.playerToMove != playerWhite || g.ply != 0 {
+		t.Errorf("player to move = %s, ply = %d; the turn switched", g.playerToMove, g.ply)
+	}
+	if !strings.Contains(out.String(), "origin and destination are the same") {
+		t.Errorf("output doesn't reject the move:\n%s", out.String())
+	}
+
+	if _, err := validateMove(g.board, playerWhite, newMove("B3", "B3"), g.rules); err == nil ||
+		err.Error() != "origin and destination are the same" {
+		t.Errorf("empty same-square move error = %v, want the same-square error first", err)
+	}
+}
+
+func TestFlagScan(t *testing.T) {
+	for _, scan := range []bool{false, true} {
+		g, _ := newTestGame()
+		g.SetFlagScan(scan)
+		g.board = testBoard("W A1 FLG", "W D4 PVT", "B I8 PVT")
+		g.status = gameInProgress
+		g.DetermineResult()
+
+		if over := g.status == gameOver; over != scan {
+			t.Errorf("scan = %v: game over with a single flag = %v", scan, over)
+		}
+		if scan && g.winner != playerWhite {
+			t.Errorf("scan: winner = %q, want %s", g.winner, playerWhite)
+		}
+	}
+}
+
+func TestFlagCaptureWithoutScan(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetFlagScan(false)
+	g.board = testBoard("W D4 SGT", "W A1 FLG", "B D5 FLG", "B I8 PVT")
+	g.status = gameInProgress
+	play(g, "MV D4 D5")
+
+	if g.status != gameOver || g.winner != playerWhite || g.endReason != endFlagCaptured {
+		t.Errorf("status = %s, winner = %q, reason = %q; want White to win by capture", g.status, g.winner, g.endReason)
+	}
+}
+
+func TestDefense(t *testing.T) {
+	tests := []struct {
+		name  string
+		board GGBoard
+		want  string
+	}{
+		{"guarded", testBoard("W D4 FLG", "W D5 SPY", "W C4 PVT", "B E4 PVT", "B I8 FLG"),
+			"White's Flag on D4: 2 defenders, 1 attackers.\n\tSPY on D5\n\tPVT on C4\n"},
+		{"alone", testBoard("W A1 FLG", "W I1 PVT", "B I8 FLG"),
+			"White's Flag on A1: 0 defenders, 0 attackers.\n"},
+		{"captured", testBoard("W D4 PVT", "B I8 FLG"),
+			"White has no Flag on the board.\n"},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		g.board = tt.board
+		play(g, cmdDefense)
+		if !strings.HasPrefix(out.String(), tt.want) {
+			t.Errorf("%s: output = %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+func TestDefenseOfOtherSide(t *testing.T) {
+	board := testBoard("W A1 FLG", "B I8 FLG", "B H8 PVT")
+
+	g, out := newTestGame()
+	g.board = board
+	play(g, "defense B")
+	if !strings.Contains(out.String(), "Only the side to move's Flag can be looked into outside of analysis mode.") {
+		t.Errorf("enemy Flag looked into outside of analysis mode:\n%s", out.String())
+	}
+
+	g, out = newTestGame()
+	g.SetAnalysis(true)
+	g.board = board
+	play(g, "defense B")
+	if !strings.Contains(out.String(), "Black's Flag on I8: 1 defenders, 0 attackers.\n\tPVT on H8\n") {
+		t.Errorf("output doesn't show the enemy Flag's defense:\n%s", out.String())
+	}
+}
+
+func TestFirstPlayerBlack(t *testing.T) {
+	g, out := newTestGame()
+	g.SetFirstPlayer(playerBlack)
+	g.SetSampleFilePath(writeFile(t, "plain.gggn", "SET W A1 FLG", "SET W D3 PVT", "SET B I8 FLG", "SET B D6 PVT"))
+	play(g, cmdLoadSample)
+	if g.playerToMove != playerBlack {
+		t.Fatalf("player to move = %s, want %s", g.playerToMove, playerBlack)
+	}
+
+	play(g, "MV D3 D4")
+	if pieceAt(g, "D4").code != "" {
+		t.Error("White moved first")
+	}
+	play(g, "MV D6 D5", "MV D3 D4", "MV D5 D6")
+	for coordinates, want := range map[string]GGPlayer{"D4": playerWhite, "D6": playerBlack} {
+		if piece := pieceAt(g, coordinates); piece.player != want {
+			t.Errorf("%s = %+v, want a %s piece:\n%s", coordinates, piece, want, out.String())
+		}
+	}
+	if g.playerToMove != playerWhite || g.ply != 3 {
+		t.Errorf("player to move = %s, ply = %d; want %s after 3 moves", g.playerToMove, g.ply, playerWhite)
+	}
+}
+
+func TestFirstPlayerDirectiveOverridesOption(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetFirstPlayer(playerBlack)
+	g.SetSampleFilePath(writeFile(t, "white.gggn", "#@first W", "SET W A1 FLG", "SET B I8 FLG"))
+	play(g, cmdLoadSample)
+	if g.playerToMove != playerWhite {
+		t.Errorf("player to move = %s, want %s", g.playerToMove, playerWhite)
+	}
+}
+
+func TestRuleSetCommand(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdRuleSet)
+	if !strings.Contains(out.String(), "\t* no-flag-challenge: off\n") || strings.Contains(out.String(), ": on\n") {
+		t.Errorf("default rules aren't all off:\n%s", out.String())
+	}
+	if n := strings.Count(out.String(), "\t* "); n != len(GGRuleSet{}.Toggles()) {
+		t.Errorf("%d rules listed, want every toggle", n)
+	}
+
+	g, out = newTestGame()
+	g.SetRules(GGRuleSet{flagChallengeBan: true})
+	play(g, cmdRuleSet)
+	if !strings.Contains(out.String(), "\t* no-flag-challenge: on\n") || !strings.Contains(out.String(), "\t* lone-flag-loss: off\n") {
+		t.Errorf("enabled rule isn't listed as on:\n%s", out.String())
+	}
+}
+
+func TestScoutPracticeRevealsOnePiecePerTurn(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetScoutPractice(true)
+	play(g, cmdLoadSample)
+
+	moves := []string{"MV D3 D4", "MV A6 A5", "MV G3 G4", "MV B6 B5"}
+	for k := 0; k <= len(moves); k++ {
+		if k > 0 {
+			play(g, moves[k-1])
+		}
+
+		// Black's pieces are scouted on White's turns, starting with the first one, and the other way around.
+		wantBlack, wantWhite := k/2+1, (k+1)/2
+		if got := revealedSquares(g.board, playerBlack); len(got) != wantBlack {
+			t.Errorf("after %d moves, Black's revealed pieces = %q, want %d", k, got, wantBlack)
+		}
+		if got := revealedSquares(g.board, playerWhite); len(got) != wantWhite {
+			t.Errorf("after %d moves, White's revealed pieces = %q, want %d", k, got, wantWhite)
+		}
+	}
+}
+
+func TestUndoKeepsScoutedPieces(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetScoutPractice(true)
+	play(g, cmdLoadSample, "MV D3 D4", "MV A6 A5", "MV G3 G4")
+	board := g.board
+	play(g, "MV B6 B5", cmdUndo)
+
+	if g.board != board {
+		t.Errorf("revealed after undoing: White %q, Black %q; want White %q, Black %q",
+			revealedSquares(g.board, playerWhite), revealedSquares(g.board, playerBlack),
+			revealedSquares(board, playerWhite), revealedSquares(board, playerBlack))
+	}
+
+	play(g, "undoto 0")
+	if got := revealedSquares(g.board, playerBlack); len(got) != 1 {
+		t.Errorf("Black's revealed pieces at the start = %q, want the opening scout", got)
+	}
+}
+
+func TestScoutedPiecesSurviveBinarySave(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetScoutPractice(true)
+	play(g, cmdLoadSample, "MV D3 D4", "MV A6 A5")
+	var buf bytes.Buffer
+	if err := g.EncodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _ := newTestGame()
+	loaded.SetScoutPractice(true)
+	if err := loaded.decodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	board := loaded.board
+	play(loaded, "MV G3 G4", cmdUndo)
+	if loaded.board != board {
+		t.Errorf("reloaded game lost its scouted pieces when undoing")
+	}
+}
+
+// compareSetup is a small setup that the compared game files start from.
+var compareSetup = []string{"SET W A1 FLG", "SET W D3 PVT", "SET W G3 SGT", "SET B I8 FLG", "SET B D6 PVT", "SET B G6 SGT"}
+
+func TestCompareDivergence(t *testing.T) {
+	a := writeFile(t, "a.gggn", append(compareSetup, "MV D3 D4", "MV D6 D5", "MV G3 G4", "MV G6 G5")...)
+	b := writeFile(t, "b.gggn", append(compareSetup, "MV D3 D4", "MV D6 D5", "MV G3 H3")...)
+	g, out := newTestGame()
+	gui := &recordingGUI{}
+	g.SetGUI(gui)
+	play(g, "compare "+a+" "+b)
+
+	for _, want := range []string{"The games differ at move 3:\n", "\t" + a + ": MV G3 G4\n", "\t" + b + ": MV G3 H3\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	x, y := coordinatesToSquareAddress("D5")
+	if len(gui.boards) != 2 || gui.boards[0] != gui.boards[1] || gui.boards[0][x][y].piece.code != "PVT" {
+		t.Errorf("compare didn't show both boards before the third move")
+	}
+}
+
+func TestCompareDifferentLengths(t *testing.T) {
+	a := writeFile(t, "a.gggn", append(compareSetup, "MV D3 D4", "MV D6 D5")...)
+	b := writeFile(t, "b.gggn", append(compareSetup, "MV D3 D4")...)
+	g, out := newTestGame()
+	play(g, "compare "+a+" "+b)
+
+	if !strings.Contains(out.String(), "The games differ at move 2:\n") || !strings.Contains(out.String(), "\t"+b+": the game ends\n") {
+		t.Errorf("output doesn't report the shorter game ending:\n%s", out.String())
+	}
+}
+
+func TestCompareSameGames(t *testing.T) {
+	a := writeFile(t, "a.gggn", append(compareSetup, "MV D3 D4", "MV D6 D5")...)
+	g, out := newTestGame()
+	play(g, "compare "+a+" "+a)
+
+	if !strings.Contains(out.String(), "The games are the same, with 2 moves.") {
+		t.Errorf("output doesn't report the same games:\n%s", out.String())
+	}
+}
+
+func TestCellWidth(t *testing.T) {
+	board := testBoard("W A1 FLG", "B I8 SPY")
+	for _, width := range []int{5, 9} {
+		rendered := ConsoleGUI{opts: ConsoleGUIOptions{mode: renderFull, cellWidth: width}}.Render(board)
+
+		// Every row of cells spans 9 cells, each followed by a border, and the borders run right under them.
+		dashes := []string{}
+		for i := 0; i < files; i++ {
+			dashes = append(dashes, strings.Repeat("-", width))
+		}
+		border := "     " + strings.Join(dashes, " ")
+		rows := 0
+		for _, line := range strings.Split(rendered, "\n") {
+			if strings.Contains(line, "-") && line != border {
+				t.Errorf("width %d: border = %q, want %q", width, line, border)
+			}
+			if !strings.HasPrefix(line, "    |") {
+				continue
+			}
+
+			rows++
+			if wantLength := len("    |") + files*(width+1); len(line) != wantLength {
+				t.Errorf("width %d: row %q is %d columns, want %d", width, line, len(line), wantLength)
+			}
+			for _, cell := range strings.Split(strings.Trim(strings.TrimSpace(line), "|"), "|") {
+				if len(cell) != width {
+					t.Errorf("width %d: cell %q is %d columns", width, cell, len(cell))
+				}
+			}
+		}
+		if rows != 8 {
+			t.Errorf("width %d: %d rows of cells, want 8", width, rows)
+		}
+
+		padding := strings.Repeat(" ", (width-3)/2)
+		if !strings.Contains(rendered, "|"+padding+"FLG"+padding+"|") {
+			t.Errorf("width %d: FLG isn't centered in its cell:\n%s", width, rendered)
+		}
+	}
+}
+
+func TestFreezeWinners(t *testing.T) {
+	g, out := newTestGame()
+	g.SetRules(GGRuleSet{freezeWinners: true})
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", "MV A4 A5", "MV B6 B5")
+
+	out.Reset()
+	play(g, "MV A5 A6")
+	if pieceAt(g, "A5").code != "3*G" || g.playerToMove != playerWhite {
+		t.Fatalf("frozen piece moved:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "the piece won a challenge last turn, and is frozen for this one") {
+		t.Errorf("output doesn't report the frozen piece:\n%s", out.String())
+	}
+
+	play(g, "MV D3 D4", "MV C6 C5", "MV A5 A6")
+	if pieceAt(g, "A6").code != "3*G" {
+		t.Error("piece still frozen after sitting out a turn")
+	}
+}
+
+func TestWinnersMoveWithoutFreezeRule(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", "MV A4 A5", "MV B6 B5", "MV A5 A6")
+	if pieceAt(g, "A6").code != "3*G" {
+		t.Error("challenge winner frozen without the rule")
+	}
+}
+
+// partialPosition is a JSON position with only three pieces.
+const partialPosition = `{"first": "B", "pieces": [
+	{"player": "W", "square": "A1", "code": "FLG"},
+	{"player": "W", "square": "D4", "code": "SPY"},
+	{"player": "B", "square": "I8", "code": "FLG"}
+]}`
+
+func TestImportJSONLenient(t *testing.T) {
+	g, out := newTestGame()
+	g.SetLenientImport(true)
+	play(g, "import json "+writeFile(t, "partial.json", partialPosition))
+
+	if g.status != gameInProgress || g.playerToMove != playerBlack {
+		t.Fatalf("status = %s, player to move = %s:\n%s", g.status, g.playerToMove, out.String())
+	}
+	if pieceAt(g, "D4") != (GGPiece{player: playerWhite, code: spy}) {
+		t.Errorf("D4 = %+v, want the white Spy", pieceAt(g, "D4"))
+	}
+}
+
+func TestImportJSONStrict(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "import json "+writeFile(t, "partial.json", partialPosition))
+
+	if g.status == gameInProgress || !pieceAt(g, "D4").IsEmpty() {
+		t.Error("partial position imported in strict mode")
+	}
+	if !strings.Contains(out.String(), "invalid position: ") {
+		t.Errorf("output doesn't report the missing pieces:\n%s", out.String())
+	}
+}
+
+func TestImportJSONInvalid(t *testing.T) {
+	tests := map[string]string{
+		"code":      `{"pieces": [{"player": "W", "square": "A1", "code": "KNG"}]}`,
+		"square":    `{"pieces": [{"player": "W", "square": "J1", "code": "FLG"}]}`,
+		"player":    `{"pieces": [{"player": "X", "square": "A1", "code": "FLG"}]}`,
+		"first":     `{"first": "X", "pieces": []}`,
+		"duplicate": `{"pieces": [{"player": "W", "square": "A1", "code": "FLG"}, {"player": "B", "square": "A1", "code": "FLG"}]}`,
+		"not json":  `SET W A1 FLG`,
+		"two flags": `{"pieces": [{"player": "W", "square": "A1", "code": "FLG"}, {"player": "W", "square": "B1", "code": "FLG"}]}`,
+	}
+	for name, position := range tests {
+		g, _ := newTestGame()
+		g.SetLenientImport(true)
+		if err := g.ImportJSON(strings.NewReader(position)); err == nil {
+			t.Errorf("%s: imported", name)
+		}
+		if g.status == gameInProgress {
+			t.Errorf("%s: game started", name)
+		}
+	}
+}
+
+func TestKnownPieces(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, cmdKnown)
+	if !strings.Contains(out.String(), "None of Black's pieces are known.") {
+		t.Errorf("enemy pieces known before any challenge:\n%s", out.String())
+	}
+
+	play(g, "MV A3 A4", "MV A6 A5", "MV A4 A5")
+	out.Reset()
+	play(g, cmdKnown)
+	if !strings.HasPrefix(out.String(), "Known White pieces:\n\t3*G on A5\n>") {
+		t.Errorf("output = %q, want only the challenge winner", out.String())
+	}
+
+	play(g, "MV D6 D5", "MV D3 D4", "MV D5 D4")
+	out.Reset()
+	play(g, cmdKnown)
+	if !strings.HasPrefix(out.String(), "Known Black pieces:\n\t4*G on D4\n>") {
+		t.Errorf("output = %q, want only the surviving challenger", out.String())
+	}
+}
+
+func TestRetryInvalid(t *testing.T) {
+	for _, retry := range []bool{false, true} {
+		var out *BufferOutput
+		m := NewGGManager(func() *GG {
+			var g *GG
+			g, out = newTestGame("fly away", "help", cmdExit)
+			return g
+		})
+		out.Reset()
+		m.Play(retry)
+
+		// Every command but the retried one shows the result.
+		want := 3
+		if retry {
+			want = 2
+		}
+		if got := strings.Count(out.String(), ">>>>>"); got != want {
+			t.Errorf("retry = %v: %d results shown, want %d:\n%s", retry, got, want, out.String())
+		}
+		if !strings.Contains(out.String(), "Invalid command.") || !strings.Contains(out.String(), "Available commands:") {
+			t.Errorf("retry = %v: commands weren't all run:\n%s", retry, out.String())
+		}
+	}
+}
+
+func TestRetryRejectedMove(t *testing.T) {
+	for _, retry := range []bool{false, true} {
+		var out *BufferOutput
+		m := NewGGManager(func() *GG {
+			var g *GG
+			g, out = newTestGame(cmdLoadSample, "MV A3 A5", "help", cmdExit)
+			return g
+		})
+		out.Reset()
+		m.Play(retry)
+
+		// The illegal move is retried like an unknown command.
+		want := 4
+		if retry {
+			want = 3
+		}
+		if got := strings.Count(out.String(), ">>>>>"); got != want {
+			t.Errorf("retry = %v: %d results shown, want %d:\n%s", retry, got, want, out.String())
+		}
+		if !strings.Contains(out.String(), "Invalid move: ") || m.Current().ply != 0 {
+			t.Errorf("retry = %v: illegal move wasn't rejected:\n%s", retry, out.String())
+		}
+	}
+}
+
+// slowInput is an input that keeps the players thinking: the clock moves ahead by the delay before every line.
+type slowInput struct {
+	Input
+	clock *fakeClock
+	delay time.Duration
+}
+
+// Read advances the clock, and returns the next line.
+func (i *slowInput) Read() string {
+	i.clock.now = i.clock.now.Add(i.delay)
+	return i.Input.Read()
+}
+
+func TestRetryOutOfTime(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}
+	var g *GG
+	var out *BufferOutput
+	m := NewGGManager(func() *GG {
+		g, out = newTestGame(cmdLoadSample, "MV A3 A4", "MV A3 A4", cmdExit)
+		g.in = &slowInput{Input: g.in, clock: clock, delay: time.Minute}
+		g.SetClock(clock.Now)
+		g.SetTimeControl(30*time.Second, 30*time.Second)
+		return g
+	})
+	out.Reset()
+	m.Play(true)
+
+	if g.status != gameOver || g.endReason != endTimeout || g.winner != playerBlack {
+		t.Errorf("end reason = %q, winner = %q; want Black to win on time:\n%s", g.endReason, g.winner, out.String())
+	}
+	if got := strings.Count(out.String(), "Invalid move: out of time"); got != 1 {
+		t.Errorf("the move was rejected %d times, want once:\n%s", got, out.String())
+	}
+}
+
+func TestRetryInvalidSet(t *testing.T) {
+	var out *BufferOutput
+	m := NewGGManager(func() *GG {
+		var g *GG
+		g, out = newTestGame("SET W A8 FLG", "help", cmdExit)
+		return g
+	})
+	out.Reset()
+	m.Play(true)
+
+	if !strings.Contains(out.String(), "Invalid SET command: ") {
+		t.Fatalf("the SET command wasn't rejected:\n%s", out.String())
+	}
+	if got := strings.Count(out.String(), ">>>>>"); got != 2 {
+		t.Errorf("%d results shown, want 2:\n%s", got, out.String())
+	}
+}
+
+func TestOccupancyMatchesScan(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample)
+	boards := map[string]GGBoard{
+		"empty":   {},
+		"corners": testBoard("W A1 FLG", "W I1 PVT", "B A8 FLG", "B I8 PVT"),
+		"sample":  g.board,
+	}
+	play(g, "MV A3 A4", "MV A6 A5", "MV A4 A5")
+	boards["after a challenge"] = g.board
+
+	for name, board := range boards {
+		for _, player := range []GGPlayer{playerWhite, playerBlack} {
+			bb := board.Occupancy(player)
+			want := [][2]int{}
+			for x := range board {
+				for y := range board[x] {
+					occupied := board[x][y].piece.player == player
+					if bb.Has(x, y) != occupied {
+						t.Errorf("%s: %s occupancy of %s = %v, want %v", name, player, squareAddressToCoordinates(x, y), bb.Has(x, y), occupied)
+					}
+					if occupied {
+						want = append(want, [2]int{x, y})
+					}
+				}
+			}
+
+			if bb.Count() != len(want) {
+				t.Errorf("%s: %s count = %d, want %d", name, player, bb.Count(), len(want))
+			}
+			if got := bb.Squares(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s: %s squares = %v, want %v", name, player, got, want)
+			}
+		}
+	}
+}
+
+func TestBitboardOffBoard(t *testing.T) {
+	bb := GGBitboard{}
+	bb.Set(rows-1, files-1)
+	if !bb.Has(rows-1, files-1) || bb.Has(rows, 0) || bb.Has(-1, 0) || bb.Has(0, files) {
+		t.Errorf("bitboard %v doesn't hold just I8", bb)
+	}
+}
+
+func TestUndoToAndRedo(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample)
+	start := g.board
+	boards := []GGBoard{start}
+	for _, move := range []string{"MV A3 A4", "MV A6 A5", "MV A4 A5", "MV B6 B5"} {
+		play(g, move)
+		boards = append(boards, g.board)
+	}
+
+	play(g, "undoto 2")
+	if g.board != boards[2] || g.ply != 2 || g.playerToMove != playerWhite {
+		t.Errorf("undoto 2: ply = %d, %s to move, board = %s", g.ply, g.playerToMove, positionString(g.board, playerWhite))
+	}
+
+	play(g, cmdRedo, cmdRedo)
+	if g.board != boards[4] || g.ply != 4 {
+		t.Errorf("redo didn't re-apply the undone moves: ply = %d", g.ply)
+	}
+	out.Reset()
+	play(g, cmdRedo)
+	if !strings.Contains(out.String(), "There are no undone moves to redo.") {
+		t.Errorf("output doesn't report the empty redo buffer:\n%s", out.String())
+	}
+
+	play(g, "undoto 0")
+	if g.board != start || g.ply != 0 || len(g.events) != 0 {
+		t.Errorf("undoto 0 didn't return to the setup: ply = %d", g.ply)
+	}
+}
+
+func TestUndoToOutOfRange(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5")
+	board := g.board
+	play(g, "undoto 2", "undoto 5")
+
+	if g.board != board || g.ply != 2 {
+		t.Errorf("out of range undoto changed the game")
+	}
+	if strings.Count(out.String(), "Can only undo back to a move from 0 to 1.") != 2 {
+		t.Errorf("output doesn't bound the undo:\n%s", out.String())
+	}
+}
+
+func TestMovingClearsRedo(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", cmdUndo, "MV B6 B5")
+	out.Reset()
+	play(g, cmdRedo)
+	if !strings.Contains(out.String(), "There are no undone moves to redo.") {
+		t.Errorf("undone moves can be redone after a new move:\n%s", out.String())
+	}
+}
+
+func TestSandboxLeavesLiveGameAlone(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}
+	g, out := newTestGame()
+	g.SetClock(clock.Now)
+	g.SetTimeControl(5*time.Minute, 2*time.Minute)
+	g.SetPlayerNames("Alice", "Bob")
+	play(g, cmdLoadSample)
+	clock.now = clock.now.Add(10 * time.Second)
+	play(g, "MV A3 A4")
+	clock.now = clock.now.Add(3 * time.Second)
+
+	timeLeft := maps.Clone(g.timeLeft)
+	names := maps.Clone(g.names)
+	white, black := g.clockLeft(playerWhite), g.clockLeft(playerBlack)
+	events := len(g.events)
+
+	dir := t.TempDir()
+	for _, name := range []string{"a.gggn", "b.gggn"} {
+		lines := append(append([]string{}, compareSetup...), "MV D3 D4", "MV D6 D5")
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	play(g, "compare "+filepath.Join(dir, "a.gggn")+" "+filepath.Join(dir, "b.gggn"), "openings "+dir)
+
+	if !strings.Contains(out.String(), "The games are the same") || !strings.Contains(out.String(), "Openings of 2 games:") {
+		t.Fatalf("compare and openings didn't run:\n%s", out.String())
+	}
+	if !maps.Equal(g.timeLeft, timeLeft) {
+		t.Errorf("time left = %v, want %v", g.timeLeft, timeLeft)
+	}
+	if g.clockLeft(playerWhite) != white || g.clockLeft(playerBlack) != black {
+		t.Errorf("clocks = %s/%s, want %s/%s", g.clockLeft(playerWhite), g.clockLeft(playerBlack), white, black)
+	}
+	if !maps.Equal(g.names, names) {
+		t.Errorf("names = %v, want %v", g.names, names)
+	}
+	if len(g.events) != events || pieceAt(g, "A4").code != "3*G" {
+		t.Error("the live game's records or board changed")
+	}
+}
+
+func TestSandboxCopiesMaps(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetTimeControl(time.Minute, time.Minute)
+	g.SetPlayerNames("Alice", "Bob")
+	s := g.sandbox()
+	s.timeLeft[playerWhite] = 0
+	s.timeBudgets[playerWhite] = 0
+	s.names[playerWhite] = "Mallory"
+
+	if g.timeLeft[playerWhite] != time.Minute || g.timeBudgets[playerWhite] != time.Minute || g.names[playerWhite] != "Alice" {
+		t.Error("changing the sandbox changed the game")
+	}
+}
+
+func TestTimeOddsWeakerSideRunsOut(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}
+	g, out := newTestGame()
+	g.SetClock(clock.Now)
+	g.SetTimeControl(5*time.Minute, 2*time.Minute)
+	play(g, cmdLoadSample)
+
+	clock.now = clock.now.Add(time.Minute)
+	play(g, "MV A3 A4")
+	clock.now = clock.now.Add(90 * time.Second)
+	play(g, "MV A6 A5")
+	if g.status != gameInProgress {
+		t.Fatalf("game over with time left on both clocks:\n%s", out.String())
+	}
+	if g.clockLeft(playerWhite) != 4*time.Minute || g.clockLeft(playerBlack) != 30*time.Second {
+		t.Errorf("clocks = %s/%s, want 4m0s/30s", g.clockLeft(playerWhite), g.clockLeft(playerBlack))
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	play(g, "MV D3 D4")
+	clock.now = clock.now.Add(31 * time.Second)
+	g.DetermineResult()
+	if g.status != gameOver || g.winner != playerWhite || g.endReason != endTimeout {
+		t.Errorf("status = %s, winner = %q, reason = %q; want Black to lose on time", g.status, g.winner, g.endReason)
+	}
+}
+
+func TestParseTimeControl(t *testing.T) {
+	tests := []struct {
+		value        string
+		white, black time.Duration
+	}{
+		{"300", 5 * time.Minute, 5 * time.Minute},
+		{"5m", 5 * time.Minute, 5 * time.Minute},
+		{"300:120", 5 * time.Minute, 2 * time.Minute},
+		{"5m:90s", 5 * time.Minute, 90 * time.Second},
+	}
+	for _, tt := range tests {
+		white, black, err := parseTimeControl(tt.value)
+		if err != nil || white != tt.white || black != tt.black {
+			t.Errorf("parseTimeControl(%q) = %s, %s, %v; want %s, %s", tt.value, white, black, err, tt.white, tt.black)
+		}
+	}
+
+	for _, value := range []string{"", "0", "-5m", "1:2:3", "soon"} {
+		if _, _, err := parseTimeControl(value); err == nil {
+			t.Errorf("parseTimeControl(%q) succeeded", value)
+		}
+	}
+}
+
+func TestFlagViolations(t *testing.T) {
+	if v := flagViolations(testBoard("W A1 FLG", "B I8 FLG")); len(v) > 0 {
+		t.Errorf("one flag each: violations = %q", v)
+	}
+
+	v := flagViolations(testBoard("W A1 FLG", "W C2 FLG", "B I8 FLG"))
+	if len(v) != 1 || v[0] != "White has 2 FLG (only one allowed): A1, C2" {
+		t.Errorf("two white flags: violations = %q", v)
+	}
+}
+
+func TestLoadRejectsTwoFlags(t *testing.T) {
+	g, out := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "flags.gggn", "SET W A1 FLG", "SET W C2 FLG", "SET B I8 FLG"))
+	play(g, cmdLoadSample)
+
+	if g.status == gameInProgress {
+		t.Error("game started with two white flags")
+	}
+	if !strings.Contains(out.String(), "impossible position: White has 2 FLG (only one allowed): A1, C2") {
+		t.Errorf("output doesn't report the flags:\n%s", out.String())
+	}
+}
+
+func TestValidateReportsTwoFlags(t *testing.T) {
+	g, out := newTestGame()
+	g.board = testBoard("W A1 FLG", "B H8 FLG", "B I8 FLG")
+	play(g, cmdValidate)
+	if !strings.Contains(out.String(), "Black has 2 FLG (only one allowed): H8, I8") {
+		t.Errorf("output doesn't report the flags:\n%s", out.String())
+	}
+}
+
+func TestLegendFollowsRenderMode(t *testing.T) {
+	tests := []struct {
+		mode GGRenderMode
+		want []string
+	}{
+		{renderCompact, []string{"\t* F: FLG\n", "\t* S: SPY\n", "\t* P: PVT\n"}},
+		{renderFull, []string{"\t* FLG: FLG\n", "\t* SPY: SPY\n", "\t* PVT: PVT\n"}},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		g.SetGUI(NewConsoleGUI(nil, ConsoleGUIOptions{mode: tt.mode}))
+		play(g, cmdLegend)
+		for _, want := range tt.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s legend doesn't contain %q:\n%s", tt.mode, want, out.String())
+			}
+		}
+		if strings.Contains(out.String(), "hidden by the fog of war") {
+			t.Errorf("%s legend lists hidden pieces without the fog:\n%s", tt.mode, out.String())
+		}
+	}
+}
+
+func TestLegendWithFog(t *testing.T) {
+	g, out := newTestGame()
+	g.SetGUI(NewConsoleGUI(nil, ConsoleGUIOptions{mode: renderCompact}))
+	g.SetFog(true)
+	play(g, cmdLegend)
+	if !strings.Contains(out.String(), ": an enemy piece hidden by the fog of war\n") {
+		t.Errorf("legend doesn't list hidden pieces under the fog:\n%s", out.String())
+	}
+}
+
+func TestAnalyzeHangingPiece(t *testing.T) {
+	g, out := newTestGame()
+	g.SetAnalysis(true)
+	g.board = testBoard("W A1 FLG", "W D4 SGT", "B D5 CPT", "B E4 PVT", "B I8 FLG")
+	play(g, cmdAnalyze)
+
+	want := "Threats against White:\n\t* CPT on D5 beats SGT on D4\nUnder threat: SGT on D4.\n"
+	if !strings.HasPrefix(out.String(), want) {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestAnalyzeWithoutThreats(t *testing.T) {
+	g, out := newTestGame()
+	g.SetAnalysis(true)
+	g.board = testBoard("W A1 FLG", "W D4 SGT", "B E4 PVT", "B I8 FLG")
+	play(g, cmdAnalyze)
+	if !strings.Contains(out.String(), "None of White's pieces are under threat.") {
+		t.Errorf("output doesn't report the safe position:\n%s", out.String())
+	}
+}
+
+func TestAnalyzeOnlyInAnalysisMode(t *testing.T) {
+	g, out := newTestGame()
+	g.board = testBoard("W A1 FLG", "W D4 SGT", "B D5 CPT", "B I8 FLG")
+	play(g, cmdAnalyze)
+	if !strings.Contains(out.String(), "Threats can only be analyzed in analysis mode.") || strings.Contains(out.String(), "CPT") {
+		t.Errorf("threats analyzed outside of analysis mode:\n%s", out.String())
+	}
+}
+
+func TestAutosave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autosave.ggb")
+	autosaver := NewGGAutosaver(path, 2, NewGGLogger(log.New(io.Discard, "", 0), logError))
+	g, _ := newTestGame()
+	g.SetAutosaver(autosaver)
+	play(g, cmdLoadSample, "MV A3 A4")
+	autosaver.Wait()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("autosaved before 2 moves: %v", err)
+	}
+
+	play(g, "MV A6 A5")
+	autosaver.Wait()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("no autosave after 2 moves: %v", err)
+	}
+	defer f.Close()
+
+	loaded, _ := newTestGame()
+	if err := loaded.decodeBinary(f); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.board != g.board || loaded.ply != 2 || loaded.playerToMove != playerWhite {
+		t.Errorf("autosave doesn't hold the current position: ply = %d, %s to move", loaded.ply, loaded.playerToMove)
+	}
+}
+
+func TestAutosaveKeepsLatest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autosave.ggb")
+	autosaver := NewGGAutosaver(path, 1, NewGGLogger(log.New(io.Discard, "", 0), logError))
+	for _, data := range []string{"first", "second", "third"} {
+		autosaver.Save([]byte(data))
+	}
+	autosaver.Wait()
+
+	if data, err := os.ReadFile(path); err != nil || string(data) != "third" {
+		t.Errorf("autosave = %q, %v; want the latest save", data, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestShareTokenRoundTrip(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4")
+	token := shareToken(g.board, g.playerToMove)
+
+	opened, _ := newTestGame()
+	if err := opened.OpenShareToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if opened.board != g.board || opened.playerToMove != g.playerToMove {
+		t.Errorf("opened position differs from the shared one: %s to move", opened.playerToMove)
+	}
+}
+
+func TestShareAndOpenCommands(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", cmdShare)
+	_, token, found := strings.Cut(out.String(), "Share token: ")
+	if !found {
+		t.Fatalf("no share token in output:\n%s", out.String())
+	}
+	token, _, _ = strings.Cut(token, "\n")
+
+	opened, openedOut := newTestGame()
+	play(opened, cmdOpen+" "+token)
+	if !strings.Contains(openedOut.String(), "Shared position successfully opened") {
+		t.Fatalf("token not opened:\n%s", openedOut.String())
+	}
+	if opened.board != g.board || opened.playerToMove != playerBlack {
+		t.Errorf("opened position differs from the shared one: %s to move", opened.playerToMove)
+	}
+}
+
+func TestOpenInvalidShareToken(t *testing.T) {
+	for _, token := range []string{
+		"not*base64",
+		base64.RawURLEncoding.EncodeToString([]byte("not a position")),
+		shareToken(testBoard("W A1 FLG", "W D4 FLG", "B I8 FLG"), playerWhite),
+	} {
+		g, _ := newTestGame()
+		play(g, cmdLoadSample)
+		board := g.board
+		if err := g.OpenShareToken(token); err == nil {
+			t.Errorf("token %q opened", token)
+		}
+		if g.board != board {
+			t.Errorf("token %q changed the board", token)
+		}
+	}
+}
+
+func TestShareRefusedUnderFog(t *testing.T) {
+	g, out := newTestGame()
+	g.SetFog(true)
+	play(g, cmdLoadSample, cmdShare)
+	if !strings.Contains(out.String(), "Positions can't be shared while the fog of war is on.") || strings.Contains(out.String(), "Share token: ") {
+		t.Errorf("position shared under the fog:\n%s", out.String())
+	}
+}
+
+// captureStdout returns what f prints to Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	f()
+	w.Close()
+	printed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(printed)
+}
+
+func TestDrawOnNarrowTerminal(t *testing.T) {
+	board := testBoard("W A1 FLG", "B I8 SPY")
+	tests := []struct {
+		name   string
+		width  int
+		advise bool
+	}{
+		// The compact grid is 41 columns wide: its indent, 9 squares with their left bars, and the closing bar.
+		{"one column short", 40, true},
+		{"exactly compact", 41, false},
+		{"compact", 60, false},
+	}
+	for _, tt := range tests {
+		gui := NewConsoleGUI(&StdoutOutput{}, ConsoleGUIOptions{
+			mode: renderAuto, terminal: fixedTerminal{width: tt.width, ok: true}, compactBelow: fullBoardWidth,
+		})
+		printed := captureStdout(t, func() { gui.Draw(board) })
+		advised := strings.Contains(printed, "The terminal is too narrow to draw the board")
+		if advised != tt.advise {
+			t.Errorf("%s: advised = %v, want %v:\n%s", tt.name, advised, tt.advise, printed)
+		}
+		if drawn := strings.Contains(printed, "---"); drawn == tt.advise {
+			t.Errorf("%s: board drawn = %v alongside the advice:\n%s", tt.name, drawn, printed)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"rank SPY", []string{"SPY (Spy):", "but the Private, which eliminates it."}},
+		{"rank FLG", []string{"FLG (Flag):", "the home run"}},
+		{"rank 5*G", []string{"5*G (General of the Army): 1 of 15 in the hierarchy"}},
+		{"rank XYZ", []string{`Unknown piece code "XYZ".`}},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		play(g, tt.cmd)
+		for _, want := range tt.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: output doesn't contain %q:\n%s", tt.cmd, want, out.String())
+			}
+		}
+	}
+}
+
+func TestOpenings(t *testing.T) {
+	dir := t.TempDir()
+	games := map[string][]string{
+		"a.gggn":    append(compareSetup, "MV D3 D4", "MV D6 D5"),
+		"b.gggn":    append(compareSetup, "MV D3 D4", "MV G6 G5"),
+		"c.gggn":    append(compareSetup, "MV G3 G4", "MV D6 D5"),
+		"bad.gggn":  append(compareSetup, "MV D3 D9"),
+		"notes.txt": {"MV A1 A2"},
+	}
+	for name, lines := range games {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, out := newTestGame()
+	play(g, cmdLoadSample)
+	board := g.board
+	play(g, cmdOpenings+" "+dir)
+
+	for _, want := range []string{
+		"Skipping " + filepath.Join(dir, "bad.gggn") + ": ",
+		"Openings of 3 games:\n",
+		"White's move 1:\n\tMV D3 D4: 2\n\tMV G3 G4: 1\n",
+		"Black's move 1:\n\tMV D6 D5: 2\n\tMV G6 G5: 1\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "MV A1 A2") {
+		t.Errorf("tallied a file that isn't a game:\n%s", out.String())
+	}
+	if g.board != board {
+		t.Error("openings changed the game")
+	}
+}
+
+func TestOpeningsUnreadableDirectory(t *testing.T) {
+	g, out := newTestGame()
+	dir := filepath.Join(t.TempDir(), "missing")
+	play(g, cmdOpenings+" "+dir, cmdOpenings+" "+t.TempDir())
+	if !strings.Contains(out.String(), "Unable to read directory "+dir) || !strings.Contains(out.String(), "No games found in ") {
+		t.Errorf("output doesn't report the missing games:\n%s", out.String())
+	}
+}
+
+func TestBothFlagsHome(t *testing.T) {
+	tests := []struct {
+		name       string
+		draw       bool
+		toMove     GGPlayer
+		wantWinner GGPlayer
+		wantReason GGEndReason
+	}{
+		{"black moved last", false, playerWhite, playerBlack, endFlagHome},
+		{"white moved last", false, playerBlack, playerWhite, endFlagHome},
+		{"draw", true, playerWhite, "", endBothFlagsHome},
+	}
+	for _, tt := range tests {
+		g, _ := newTestGame()
+		g.rules.dualHomeDraw = tt.draw
+		g.board = testBoard("W A8 FLG", "B I1 FLG")
+		g.playerToMove = tt.toMove
+		g.DetermineResult()
+		if g.status != gameOver || g.winner != tt.wantWinner || g.endReason != tt.wantReason {
+			t.Errorf("%s: status = %s, winner = %q, reason = %q; want %q, %q", tt.name, g.status, g.winner, g.endReason, tt.wantWinner, tt.wantReason)
+		}
+
+		lastMover := tt.toMove.Opponent()
+		if winner := boardWinner(g.board, lastMover, g.rules); winner != tt.wantWinner {
+			t.Errorf("%s: boardWinner = %q, want %q", tt.name, winner, tt.wantWinner)
+		}
+	}
+}
+
+func TestFogCommand(t *testing.T) {
+	g, _ := newTestGame()
+	gui := &recordingGUI{}
+	g.SetGUI(gui)
+	g.SetAnalysis(true)
+	play(g, cmdLoadSample, "fog on")
+	g.DrawBoard()
+	play(g, "fog off")
+	g.DrawBoard()
+
+	if len(gui.boards) != 2 {
+		t.Fatalf("drew %d boards, want 2", len(gui.boards))
+	}
+	x, y := coordinatesToSquareAddress("I6")
+	if piece := gui.boards[0][x][y].piece; piece.code != hidden {
+		t.Errorf("enemy piece shown with the fog on: %s", piece.code)
+	}
+	if gui.boards[1] != g.board {
+		t.Error("enemy pieces hidden with the fog off")
+	}
+}
+
+func TestFogCommandRefusedDuringCompetitiveGame(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "fog on")
+	if g.fog || !strings.Contains(out.String(), "The fog of war can only be toggled between games or in analysis mode.\n") {
+		t.Errorf("fog toggled during a competitive game:\n%s", out.String())
+	}
+
+	g, _ = newTestGame()
+	play(g, "fog on")
+	if !g.fog {
+		t.Error("fog not toggled between games")
+	}
+}
+
+func TestExportGGGNKeepsRevealedPieces(t *testing.T) {
+	g, _ := newTestGame()
+	g.board = testBoard("W A1 FLG", "W D4 SGT", "W E4 SPY", "B I8 FLG", "B D5 CPT", "B H8 PVT")
+	for _, coordinates := range []string{"D4", "D5", "H8"} {
+		x, y := coordinatesToSquareAddress(coordinates)
+		g.board[x][y].piece.revealed = true
+	}
+
+	exported := &bytes.Buffer{}
+	if err := g.ExportGGGN(exported); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"#@revealed W D4\n", "#@revealed B D5 H8\n"} {
+		if !strings.Contains(exported.String(), want) {
+			t.Errorf("export doesn't contain %q:\n%s", want, exported.String())
+		}
+	}
+
+	loaded, _ := newTestGame()
+	loaded.board = GGBoard{}
+	if err := loaded.loadFile(writeFile(t, "revealed.gggn", strings.Split(strings.TrimSpace(exported.String()), "\n")...)); err != nil {
+		t.Fatal(err)
+	}
+	for _, player := range []GGPlayer{playerWhite, playerBlack} {
+		if got, want := revealedSquares(loaded.board, player), revealedSquares(g.board, player); !slices.Equal(got, want) {
+			t.Errorf("%s's revealed pieces after reloading = %v, want %v", player, got, want)
+		}
+	}
+	if loaded.board != g.board {
+		t.Error("reloaded board differs from the exported one")
+	}
+}
+
+func TestRevealedDirectiveNeedsPiece(t *testing.T) {
+	g, _ := newTestGame()
+	g.board = GGBoard{}
+	err := g.loadFile(writeFile(t, "revealed.gggn", "#@revealed B A1", "SET W A1 FLG", "SET B I8 FLG"))
+	if err == nil || !strings.Contains(err.Error(), "no Black piece on A1 to reveal (line 1)") {
+		t.Errorf("loadFile() = %v, want an error about the missing piece", err)
+	}
+}
+
+func TestSuggestIsLegal(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4")
+	board := g.board
+	play(g, cmdSuggest)
+
+	_, suggestion, found := strings.Cut(out.String(), "Suggested move: ")
+	if !found {
+		t.Fatalf("no suggestion in output:\n%s", out.String())
+	}
+	suggestion, _, _ = strings.Cut(suggestion, "\n")
+	fields := strings.Fields(suggestion)
+	if len(fields) != 3 || fields[0] != cmdMove {
+		t.Fatalf("suggestion %q isn't a move", suggestion)
+	}
+	if _, err := validateMove(g.board, playerBlack, newMove(fields[1], fields[2]), g.rules); err != nil {
+		t.Errorf("suggested %s is illegal: %v", suggestion, err)
+	}
+	if g.board != board || g.playerToMove != playerBlack {
+		t.Error("suggesting played the move")
+	}
+}
+
+func TestSuggestOnlyDuringGame(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdSuggest)
+	if !strings.Contains(out.String(), "Moves can only be suggested during the game.\n") {
+		t.Errorf("move suggested before the game:\n%s", out.String())
+	}
+}
+
+func TestEngineGuessesHiddenPieces(t *testing.T) {
+	board := testBoard("W A1 FLG", "W D4 SGT", "B I8 FLG", "B D5 CPT", "B E5 SPY")
+	x, y := coordinatesToSquareAddress("E5")
+	board[x][y].piece.revealed = true
+
+	engine := NewGGEngine(playerWhite, time.Millisecond)
+	engine.SetSeed(1)
+	guessed := engine.guessHidden(fogView(board, playerWhite))
+	if guessed[x][y].piece.code != spy {
+		t.Errorf("revealed piece guessed as %s", guessed[x][y].piece.code)
+	}
+	for _, coordinates := range []string{"I8", "D5"} {
+		x, y := coordinatesToSquareAddress(coordinates)
+		if code := guessed[x][y].piece.code; code == hidden || guessed[x][y].piece.player != playerBlack {
+			t.Errorf("hidden piece on %s left unguessed: %s", coordinates, code)
+		}
+	}
+	x, y = coordinatesToSquareAddress("D4")
+	if guessed[x][y].piece != board[x][y].piece {
+		t.Error("engine's own piece changed by the guess")
+	}
+}
+
+func TestSetSetupRanks(t *testing.T) {
+	tests := []struct {
+		n     int
+		valid bool
+	}{
+		{0, false},
+		{1, true},
+		{4, true},
+		{5, false},
+	}
+	for _, tt := range tests {
+		g, _ := newTestGame()
+		err := g.SetSetupRanks(tt.n)
+		if (err == nil) != tt.valid {
+			t.Errorf("SetSetupRanks(%d) = %v, want valid = %v", tt.n, err, tt.valid)
+		}
+
+		want := defaultSetupRanks
+		if tt.valid {
+			want = tt.n
+		}
+		if g.setupRanks != want {
+			t.Errorf("SetSetupRanks(%d): setupRanks = %d, want %d", tt.n, g.setupRanks, want)
+		}
+	}
+}
+
+func TestSetupRanksInLintAndShuffle(t *testing.T) {
+	sample, err := os.ReadFile(sampleGggnFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, "deep.gggn", strings.Replace(string(sample), "SET W G3 PVT", "SET W G4 PVT", 1))
+
+	for _, ranks := range []int{defaultSetupRanks, 4} {
+		g, out := newTestGame()
+		if err := g.SetSetupRanks(ranks); err != nil {
+			t.Fatal(err)
+		}
+		g.board = testBoard("W A1 FLG", "W G4 PVT", "B I8 FLG")
+		g.status = gameSetup
+		play(g, cmdLint+" "+path, cmdShuffle+" W")
+
+		// Both lint and shuffle report the piece when it's outside of the setup ranks.
+		reports := strings.Count(out.String(), "White's PVT on G4 is outside of its first 3 ranks")
+		if ranks == defaultSetupRanks && reports != 2 {
+			t.Errorf("%d ranks: piece on the 4th rank reported %d times, want 2:\n%s", ranks, reports, out.String())
+		}
+		if ranks == 4 && (reports != 0 || !strings.Contains(out.String(), "No problems found in "+path)) {
+			t.Errorf("%d ranks: piece on the 4th rank reported:\n%s", ranks, out.String())
+		}
+	}
+}
+
+func TestSetupRanksInStartAndSet(t *testing.T) {
+	sample, err := os.ReadFile(sampleGggnFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ranks := range []int{defaultSetupRanks, 4} {
+		g, out := newTestGame()
+		if err := g.SetSetupRanks(ranks); err != nil {
+			t.Fatal(err)
+		}
+		file, problems, err := g.parseGameFile(strings.NewReader(strings.Replace(string(sample), "SET W G3 PVT", "SET W G4 PVT", 1)), GGBoard{})
+		if err != nil || len(problems) > 0 {
+			t.Fatalf("%d ranks: sample setup not parsed: %v %v", ranks, err, problems)
+		}
+		g.board = file.board
+		g.status = gameSetup
+		play(g, "SET B A4 PVT", cmdStart)
+
+		if !strings.Contains(out.String(), fmt.Sprintf("Invalid SET command: A4 is outside of Black's first %d ranks", ranks)) {
+			t.Errorf("%d ranks: SET outside of the setup ranks not rejected:\n%s", ranks, out.String())
+		}
+		if pieceAt(g, "A4") != (GGPiece{}) {
+			t.Errorf("%d ranks: piece placed outside of the setup ranks", ranks)
+		}
+
+		started := g.status == gameInProgress
+		if ranks == defaultSetupRanks && (started || !strings.Contains(out.String(), "White's PVT on G4 is outside of its first 3 ranks")) {
+			t.Errorf("%d ranks: game started with a piece on the 4th rank:\n%s", ranks, out.String())
+		}
+		if ranks == 4 && !started {
+			t.Errorf("%d ranks: game not started with a piece on the 4th rank:\n%s", ranks, out.String())
+		}
+	}
+}
+
+func TestBattles(t *testing.T) {
+	g, out := newTestGame()
+	g.board = testBoard("W A1 FLG", "W D4 SGT", "W F4 PVT", "B I8 FLG", "B D5 PVT", "B E6 SPY", "B G5 CPT")
+	g.status = gameInProgress
+	play(g, cmdBattles)
+	if !strings.Contains(out.String(), "No challenges have been made yet.\n") {
+		t.Errorf("output doesn't report the lack of challenges:\n%s", out.String())
+	}
+
+	out.Reset()
+	play(g, "MV D4 D5", "MV E6 E5", "MV F4 G4", "MV E5 D5", "MV G4 G5", cmdBattles)
+	want := "Battles:\n" +
+		"\t1. White SGT from D4 vs Black PVT on D5: the challenger wins\n" +
+		"\t4. Black SPY from E5 vs White SGT on D5: the challenger wins\n" +
+		"\t5. White PVT from G4 vs Black CPT on G5: the challenger loses\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("output doesn't contain the battles %q:\n%s", want, out.String())
+	}
+}
+
+func TestBattlesAfterLoading(t *testing.T) {
+	g, out := newTestGame()
+	g.SetSampleFilePath(writeFile(t, "battle.gggn", append(compareSetup, "MV D3 D4", "MV D6 D5", "MV D4 D5")...))
+	play(g, cmdLoadSample, cmdBattles)
+	if !strings.Contains(out.String(), "Battles:\n\t3. White PVT from D4 vs Black PVT on D5: both pieces are eliminated\n") {
+		t.Errorf("output doesn't list the loaded game's battle:\n%s", out.String())
+	}
+}
+
+func TestRunScripts(t *testing.T) {
+	m := NewGGManager(func() *GG {
+		g, _ := newTestGame()
+		return g
+	})
+	setup := sampleGggnFile
+	moves := writeFile(t, "moves.gggn", cmdStart, "", "MV A3 A4", "MV A6 A9", "MV A6 A5")
+	for _, path := range []string{setup, moves} {
+		if err := m.RunScript(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g := m.Current()
+	if g.status != gameInProgress || g.ply != 2 || pieceAt(g, "A4").code != threeStarGeneral || pieceAt(g, "A5").code != secondLt {
+		t.Errorf("scripts didn't combine: status = %s, ply = %d\n%s", g.status, g.ply, g.out.(*BufferOutput).String())
+	}
+	if out := g.out.(*BufferOutput).String(); !strings.Contains(out, moves+" line 4: ") {
+		t.Errorf("output of the invalid move isn't prefixed with its file and line:\n%s", out)
+	}
+}
+
+func TestRunScriptAppliesDirectives(t *testing.T) {
+	m := NewGGManager(func() *GG {
+		g, _ := newTestGame()
+		return g
+	})
+	script := writeFile(t, "directives.gggn",
+		"# a comment", "  # an indented comment", "#@first B", "#@seed 7", "#@barrier E4 E5", "#@note before the game",
+		"#@revealed W A1", "SET W A1 FLG",
+	)
+	if err := m.RunScript(script); err != nil {
+		t.Fatal(err)
+	}
+
+	g := m.Current()
+	out := g.out.(*BufferOutput).String()
+	if g.firstPlayer != playerBlack || g.playerToMove != playerBlack {
+		t.Errorf("first player = %s, player to move = %s; want Black", g.firstPlayer, g.playerToMove)
+	}
+	if g.rngSource.seed != 7 {
+		t.Errorf("seed = %d, want 7", g.rngSource.seed)
+	}
+	if got := barrierSquares(g.board); !slices.Equal(got, []string{"E4", "E5"}) {
+		t.Errorf("barriers = %v, want E4 and E5", got)
+	}
+	if len(g.notes) != 1 || g.notes[0].text != "before the game" {
+		t.Errorf("notes = %+v, want the script's", g.notes)
+	}
+	want := script + " line 7: Ignoring the #@revealed directive, it only applies to loaded game files.\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+	if strings.Contains(out, "comment") || pieceAt(g, "A1").code != flag {
+		t.Errorf("script didn't skip the comments and run the SET:\n%s", out)
+	}
+}
+
+func TestRunScriptFirstPlayerAfterMoves(t *testing.T) {
+	m := NewGGManager(func() *GG {
+		g, _ := newTestGame()
+		return g
+	})
+	script := writeFile(t, "late.gggn", cmdLoadSample, "MV A3 A4", "#@first W")
+	if err := m.RunScript(script); err != nil {
+		t.Fatal(err)
+	}
+
+	g := m.Current()
+	if out := g.out.(*BufferOutput).String(); !strings.Contains(out, script+" line 3: The side that moves first can't change once moves are made.\n") {
+		t.Errorf("late #@first directive wasn't refused:\n%s", out)
+	}
+	if g.playerToMove != playerBlack {
+		t.Errorf("player to move = %s, want Black", g.playerToMove)
+	}
+}
+
+func TestRunScriptRejectsMultiLineCommands(t *testing.T) {
+	for _, cmd := range []string{cmdSetup, cmdPaste} {
+		m := NewGGManager(func() *GG {
+			g, _ := newTestGame("SET W A1 FLG", cmdDone)
+			return g
+		})
+		script := writeFile(t, cmd+".txt", "SET W B1 SPY", cmd, "SET W C1 PVT")
+		err := m.RunScript(script)
+		if err == nil || !strings.HasPrefix(err.Error(), script+" line 2: "+cmd+" reads its lines from the input") {
+			t.Errorf("RunScript() with %s = %v", cmd, err)
+		}
+
+		// Nothing is read from the input, and the script stops at the command.
+		g := m.Current()
+		if pieceAt(g, "B1").code != spy || pieceAt(g, "A1") != (GGPiece{}) || pieceAt(g, "C1") != (GGPiece{}) {
+			t.Errorf("script with %s ran past it:\n%s", cmd, g.out.(*BufferOutput).String())
+		}
+	}
+}
+
+func TestRunMissingScript(t *testing.T) {
+	m := NewGGManager(func() *GG {
+		g, _ := newTestGame()
+		return g
+	})
+	if err := m.RunScript(filepath.Join(t.TempDir(), "missing.gggn")); err == nil {
+		t.Error("missing script ran")
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		cmds       []string
+		wantWinner GGPlayer
+		wantReason GGEndReason
+		wantOver   bool
+	}{
+		{"ongoing", []string{"MV D4 E4"}, "", "", false},
+		{"won", []string{"MV D4 D5"}, playerWhite, endFlagCaptured, true},
+		{"drawn", []string{cmdOfferDraw, "MV A1 A2", cmdAcceptDraw}, "", endAgreement, true},
+		{"exited", []string{cmdExit}, "", "", false},
+	}
+	for _, tt := range tests {
+		g, _ := newTestGame()
+		g.board = testBoard("W A1 FLG", "W D4 SGT", "B D5 FLG")
+		g.status = gameInProgress
+		play(g, tt.cmds...)
+		winner, reason, over := g.Result()
+		if winner != tt.wantWinner || reason != tt.wantReason || over != tt.wantOver {
+			t.Errorf("%s: Result() = %q, %q, %v; want %q, %q, %v", tt.name, winner, reason, over, tt.wantWinner, tt.wantReason, tt.wantOver)
+		}
+	}
+}
+
+func TestDistances(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdDistances)
+	if !strings.Contains(out.String(), "No moves have been made yet.\n") {
+		t.Errorf("output doesn't report the lack of moves:\n%s", out.String())
+	}
+
+	out.Reset()
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", cmdDistances)
+	if !strings.Contains(out.String(), "All moves were single-square (2 in total).\n") {
+		t.Errorf("output doesn't report single-square moves:\n%s", out.String())
+	}
+
+	// Moves covering several squares can't be made in the standard game, so they're recorded directly.
+	out.Reset()
+	g.events = append(g.events,
+		GGEvent{move: newMove("A4", "A7")},
+		GGEvent{move: newMove("B6", "D6")},
+		GGEvent{move: newMove("D3", "F4")},
+	)
+	play(g, cmdDistances)
+	if want := "Move distances:\n\t1-square moves: 2\n\t2-square moves: 1\n\t3-square moves: 2\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("output doesn't contain the distances %q:\n%s", want, out.String())
+	}
+}
+
+// secretChallengeGame returns a game played with the fog of war and secret challenges, in which White's
+// Sergeant has just taken Black's Private.
+func secretChallengeGame(t *testing.T) (*GG, *BufferOutput, *bytes.Buffer) {
+	t.Helper()
+	logs := &bytes.Buffer{}
+	g, out := newTestGame()
+	g.logger = NewGGLogger(log.New(logs, "", 0), logInfo)
+	g.SetFog(true)
+	g.rules.hideChallenges = true
+	g.board = testBoard("W A1 FLG", "W D4 SGT", "W G4 PVT", "B I8 FLG", "B D5 PVT", "B G5 CPT")
+	g.status = gameInProgress
+	play(g, "MV D4 D5")
+	return g, out, logs
+}
+
+func TestChallengeReveal(t *testing.T) {
+	for _, hide := range []bool{false, true} {
+		g, _ := newTestGame()
+		g.rules.hideChallenges = hide
+		g.board = testBoard("W A1 FLG", "W D4 SGT", "B I8 FLG", "B D5 PVT")
+		g.status = gameInProgress
+		play(g, "MV D4 D5")
+		if revealed := pieceAt(g, "D5").revealed; revealed == hide {
+			t.Errorf("hide challenges %v: survivor revealed = %v", hide, revealed)
+		}
+	}
+}
+
+func TestSecretChallengesStaySecret(t *testing.T) {
+	g, out, logs := secretChallengeGame(t)
+	path := filepath.Join(t.TempDir(), "captures.csv")
+	play(g, cmdBattles, cmdStats, "export csv "+path)
+
+	if x, y := coordinatesToSquareAddress("D5"); g.view(g.board)[x][y].piece.code != hidden {
+		t.Error("the winner of the secret challenge is shown to the enemy")
+	}
+	for _, want := range []string{
+		"\t1. White ??? from D4 vs Black PVT on D5: the challenger wins\n",
+		"\t\tPVT: 0 White, 1 Black\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "SGT") || strings.Contains(logs.String(), "SGT") {
+		t.Errorf("the hidden Sergeant is given away:\n%s\nlogs:\n%s", out.String(), logs.String())
+	}
+
+	// Once it's White's turn, Black's captured piece is the one that's unknown.
+	play(g, "MV G5 G4", "export csv "+path)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := map[string][]string{}
+	for _, record := range records {
+		rows[record[0]] = record[1:]
+	}
+	if !slices.Equal(rows[string(private)], []string{"1", "0"}) || !slices.Equal(rows[string(hidden)], []string{"0", "1"}) {
+		t.Errorf("export doesn't hide Black's captured piece from White: %v", records)
+	}
+}
+
+func TestTryUnderFog(t *testing.T) {
+	g, out, _ := secretChallengeGame(t)
+	play(g, "try MV G5 G4")
+	if !strings.Contains(out.String(), "MV G5 G4 is a legal challenge against a piece hidden by the fog of war.\n") {
+		t.Errorf("output doesn't keep the challenged piece hidden:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "CPT vs PVT") {
+		t.Errorf("try gives away the challenge outcome:\n%s", out.String())
+	}
+}
+
+func TestPlayerNames(t *testing.T) {
+	g, out := newTestGame()
+	g.SetPlayerNames("Alice", "Bob")
+	g.board = testBoard("W A1 FLG", "W D4 SGT", "B I8 PVT", "B D6 FLG")
+	g.status = gameInProgress
+	play(g, "MV D4 D5", cmdTimeline)
+	for _, want := range []string{"Bob (Black) to move.", "1. Alice (White) MV D4 D5"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	play(g, "MV I8 H8", "MV D5 D6")
+	if !strings.Contains(out.String(), "Alice (White) wins!") {
+		t.Errorf("result doesn't name the winner:\n%s", out.String())
+	}
+}
+
+func TestPlayerNamesFallBackToColors(t *testing.T) {
+	g, out := newTestGame()
+	g.SetPlayerNames("Alice", "")
+	play(g, cmdLoadSample, "MV A3 A4")
+	if !strings.Contains(out.String(), ">>>>> Black to move.") {
+		t.Errorf("unnamed player isn't shown by color:\n%s", out.String())
+	}
+}
+
+func TestPlayerNamesSaved(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetPlayerNames("Alice", "Bob")
+	play(g, cmdLoadSample)
+	var buf bytes.Buffer
+	if err := g.EncodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _ := newTestGame()
+	if err := loaded.decodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.playerName(playerWhite) != "Alice (White)" || loaded.playerName(playerBlack) != "Bob (Black)" {
+		t.Errorf("names after loading = %q, %q", loaded.playerName(playerWhite), loaded.playerName(playerBlack))
+	}
+}
+
+func TestPlayerNamesReplacedOnLoad(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetPlayerNames("Alice", "")
+	g.board = testBoard("W D4 SGT", "W A1 FLG", "B D5 FLG")
+	g.status = gameInProgress
+	var buf bytes.Buffer
+	if err := g.EncodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, out := newTestGame()
+	loaded.SetPlayerNames("Carol", "Dave")
+	if err := loaded.decodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.playerName(playerWhite) != "Alice (White)" || loaded.playerName(playerBlack) != "Black" {
+		t.Errorf("names after loading = %q, %q", loaded.playerName(playerWhite), loaded.playerName(playerBlack))
+	}
+
+	// The result is announced with the save's names too.
+	play(loaded, "MV D4 D5")
+	if !strings.Contains(out.String(), "Alice (White) wins!") {
+		t.Errorf("result doesn't name the save's winner:\n%s", out.String())
+	}
+}
+
+func TestExportFrames(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5")
+	dir := filepath.Join(t.TempDir(), "frames")
+	play(g, "export frames "+dir)
+
+	if !strings.Contains(out.String(), "Exported 3 frames to "+dir+"\n") {
+		t.Fatalf("output doesn't report the export:\n%s", out.String())
+	}
+	frames, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("exported %v, want 3 frames", frames)
+	}
+	for n, path := range frames {
+		if want := filepath.Join(dir, fmt.Sprintf("frame-%d.txt", n)); path != want {
+			t.Errorf("frame %d is %s, want %s", n, path, want)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := g.gui.Render(g.replay(n)); string(data) != want {
+			t.Errorf("frame %d = %q, want %q", n, data, want)
+		}
+	}
+}
+
+func TestExportFramesNeverOverwrites(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4")
+	dir := t.TempDir()
+	play(g, "export frames "+dir, "export frames "+dir)
+	if !strings.Contains(out.String(), "Unable to export to "+dir+": it already has frames.\n") {
+		t.Errorf("frames exported over existing ones:\n%s", out.String())
+	}
+}
+
+func TestParsePlayer(t *testing.T) {
+	tests := []struct {
+		token string
+		want  GGPlayer
+		valid bool
+	}{
+		{"W", playerWhite, true},
+		{"w", playerWhite, true},
+		{"b", playerBlack, true},
+		{"X", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parsePlayer(tt.token)
+		if got != tt.want || (err == nil) != tt.valid {
+			t.Errorf("parsePlayer(%q) = %q, %v; want %q, valid = %v", tt.token, got, err, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestSetNormalizesPlayer(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "SET w A1 FLG", "SET x A2 PVT")
+	if piece := pieceAt(g, "A1"); piece.player != playerWhite || piece.code != flag {
+		t.Errorf("lowercase SET placed %+v", piece)
+	}
+	if !pieceAt(g, "A2").IsEmpty() {
+		t.Errorf("SET with an unknown player placed %+v:\n%s", pieceAt(g, "A2"), out.String())
+	}
+}
+
+func TestExportOrder(t *testing.T) {
+	g, _ := newTestGame()
+	g.board = testBoard("B I8 FLG", "W D4 SGT", "W A1 FLG", "B A8 PVT")
+	want := map[string]string{
+		"gggn": "#@first W\nSET W A1 FLG\nSET B A8 PVT\nSET W D4 SGT\nSET B I8 FLG\n",
+		"json": `{
+  "first": "W",
+  "pieces": [
+    {
+      "player": "W",
+      "square": "A1",
+      "code": "FLG"
+    },
+    {
+      "player": "B",
+      "square": "A8",
+      "code": "PVT"
+    },
+    {
+      "player": "W",
+      "square": "D4",
+      "code": "SGT"
+    },
+    {
+      "player": "B",
+      "square": "I8",
+      "code": "FLG"
+    }
+  ]
+}
+`,
+	}
+
+	for format, export := range map[string]func(io.Writer) error{"gggn": g.ExportGGGN, "json": g.ExportJSON} {
+		first, second := &bytes.Buffer{}, &bytes.Buffer{}
+		if err := export(first); err != nil {
+			t.Fatal(err)
+		}
+		if err := export(second); err != nil {
+			t.Fatal(err)
+		}
+		if first.String() != want[format] {
+			t.Errorf("%s export = %q, want %q", format, first.String(), want[format])
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Errorf("%s exports of the same board differ", format)
+		}
+	}
+}
+
+func TestExportPositionCommand(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4")
+	path := filepath.Join(t.TempDir(), "position.json")
+	play(g, "export json "+path)
+	if !strings.Contains(out.String(), "Position exported to "+path+"\n") {
+		t.Fatalf("output doesn't report the export:\n%s", out.String())
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	imported, _ := newTestGame()
+	if err := imported.ImportJSON(f); err != nil {
+		t.Fatal(err)
+	}
+	if imported.board != g.board || imported.playerToMove != playerBlack {
+		t.Errorf("imported position differs from the exported one: %s to move", imported.playerToMove)
+	}
+}
+
+func TestEngineSearchStats(t *testing.T) {
+	g, _ := newTestGame()
+	play(g, cmdLoadSample)
+
+	// The clock ticks once per position, so the search stops after visiting as many positions as its budget.
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}
+	e := NewGGEngine(playerWhite, 500*time.Microsecond)
+	e.now = func() time.Time {
+		clock.now = clock.now.Add(time.Microsecond)
+		return clock.now
+	}
+	if _, ok := e.BestMove(g.board, g.rules); !ok {
+		t.Fatal("no move found")
+	}
+	if e.stats.nodes < 100 || e.stats.depth < 1 || e.stats.elapsed <= 0 {
+		t.Errorf("search stats = %+v, want positions counted over at least one finished depth", e.stats)
+	}
+}
+
+func TestAIStatsCommand(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdAIStats)
+	if !strings.Contains(out.String(), "The AI hasn't searched yet.\n") {
+		t.Errorf("output doesn't report the lack of searches:\n%s", out.String())
+	}
+
+	out.Reset()
+	g.recordSearch(GGSearchStats{depth: 3, nodes: 1234, elapsed: 1500 * time.Millisecond})
+	play(g, cmdAIStats)
+	if !strings.Contains(out.String(), "Last AI search: 1234 positions evaluated in 1.5s, reaching depth 3\n") {
+		t.Errorf("output doesn't show the last search:\n%s", out.String())
+	}
+}
+
+func TestBoardThemes(t *testing.T) {
+	board := testBoard("W A1 FLG", "B I8 SPY")
+	tests := []struct {
+		theme   string
+		want    []string
+		notWant []string
+	}{
+		{"ascii", []string{"|", "-", "="}, []string{"│", "─", "┼", "═"}},
+		{"unicode", []string{"│", "─", "┼", "═"}, []string{"|", "-", "="}},
+	}
+	for _, tt := range tests {
+		for _, cellWidth := range []int{0, 9} {
+			rendered := ConsoleGUI{opts: ConsoleGUIOptions{mode: renderFull, cellWidth: cellWidth, theme: boardThemes[tt.theme]}}.Render(board)
+			for _, want := range tt.want {
+				if !strings.Contains(rendered, want) {
+					t.Errorf("%s board with %d-column cells doesn't contain %q:\n%s", tt.theme, cellWidth, want, rendered)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(rendered, notWant) {
+					t.Errorf("%s board with %d-column cells contains %q:\n%s", tt.theme, cellWidth, notWant, rendered)
+				}
+			}
+
+			// The squares' edges line up with their sides.
+			vertical := boardThemes[tt.theme].vertical
+			for _, line := range strings.Split(rendered, "\n") {
+				if !strings.Contains(line, vertical) {
+					continue
+				}
+				edge := strings.Repeat(" ", strings.Index(line, vertical))
+				for _, cell := range strings.Split(strings.Trim(strings.TrimSpace(line), vertical), vertical) {
+					edge += boardThemes[tt.theme].corner + strings.Repeat(boardThemes[tt.theme].horizontal, utf8.RuneCountInString(cell))
+				}
+				edge = strings.TrimRight(edge+boardThemes[tt.theme].corner, " ")
+				if !strings.Contains(rendered, edge+"\n") {
+					t.Errorf("%s board with %d-column cells has no edge %q lining up with %q", tt.theme, cellWidth, edge, line)
+				}
+			}
+		}
+	}
+}
+
+func TestReview(t *testing.T) {
+	g, out := newTestGame()
+	g.SetAnalysis(true)
+	g.SetSampleFilePath(writeFile(t, "blunder.gggn",
+		"SET W A1 FLG", "SET W D4 SGT", "SET W H1 PVT", "SET B I8 FLG", "SET B D6 CPT", "SET B H3 PVT",
+		"MV D4 D5", "MV I8 H8", "MV H1 H2",
+	))
+	play(g, cmdLoadSample, cmdReview)
+	want := "Blunders:\n\t1. White MV D4 D5: left SGT on D5 open to the CPT on D6.\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("output doesn't contain the blunder %q:\n%s", want, out.String())
+	}
+	if strings.Contains(out.String(), "\t2. ") || strings.Contains(out.String(), "\t3. ") {
+		t.Errorf("sound moves flagged as blunders:\n%s", out.String())
+	}
+}
+
+func TestReviewLostChallengeAndMissedFlag(t *testing.T) {
+	g, out := newTestGame()
+	g.SetAnalysis(true)
+	g.SetSampleFilePath(writeFile(t, "blunder.gggn",
+		"SET W A1 FLG", "SET W D4 PVT", "SET W F4 SGT", "SET B F5 FLG", "SET B D5 CPT", "MV D4 D5",
+	))
+	play(g, cmdLoadSample, cmdReview)
+	for _, want := range []string{
+		"\t1. White MV D4 D5: PVT lost a challenge against the CPT on D5.\n",
+		"\t1. White MV D4 D5: missed capturing the Flag on F5 from F4.\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain the blunder %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestReviewOnlyInAnalysisMode(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", cmdReview)
+	if !strings.Contains(out.String(), "Games can only be reviewed in analysis mode.\n") {
+		t.Errorf("game reviewed outside of analysis mode:\n%s", out.String())
+	}
+}
+
+func TestPasteDrawnBoard(t *testing.T) {
+	sample, _ := newTestGame()
+	play(sample, "barrier E4", cmdLoadSample)
+	if x, y := coordinatesToSquareAddress("E4"); !sample.board[x][y].barrier {
+		t.Fatal("E4 isn't a barrier")
+	}
+	tests := []struct {
+		name string
+		opts ConsoleGUIOptions
+	}{
+		{"full", ConsoleGUIOptions{mode: renderFull}},
+		{"compact", ConsoleGUIOptions{mode: renderCompact}},
+		{"unicode", ConsoleGUIOptions{mode: renderFull, theme: boardThemes["unicode"]}},
+		{"wide cells", ConsoleGUIOptions{mode: renderFull, cellWidth: 11}},
+	}
+	for _, tt := range tests {
+		drawn := ConsoleGUI{opts: tt.opts}.Render(sample.board)
+		g, out := newTestGame(append(strings.Split(drawn, "\n"), cmdDone)...)
+		play(g, cmdPaste)
+		if !strings.Contains(out.String(), "Board successfully pasted\n") {
+			t.Errorf("%s: board not pasted:\n%s", tt.name, out.String())
+			continue
+		}
+		if g.board != sample.board || g.status != gameInProgress {
+			t.Errorf("%s: pasted board differs from the drawn one:\n%s", tt.name, drawn)
+		}
+	}
+}
+
+func TestPasteCrossedPiece(t *testing.T) {
+	board := testBoard("W A1 FLG", "W D5 PVT", "B I8 FLG")
+	drawn := ConsoleGUI{opts: ConsoleGUIOptions{mode: renderFull}}.Render(board)
+
+	// Without its player, the piece that crossed the center goes to the side whose half it's on.
+	g, out := newTestGame(append(strings.Split(drawn, "\n"), cmdDone)...)
+	play(g, cmdPaste)
+	if got := pieceAt(g, "D5"); got.player != playerBlack || got.code != private {
+		t.Errorf("D5 = %+v, want Black's PVT:\n%s", got, out.String())
+	}
+
+	fixed := strings.Replace(drawn, "  PVT  ", " W PVT ", 1)
+	g, out = newTestGame(append(strings.Split(fixed, "\n"), cmdDone)...)
+	play(g, cmdPaste)
+	if g.board != board {
+		t.Errorf("board with the crossed piece's player differs from the drawn one:\n%s", out.String())
+	}
+}
+
+func TestPasteMalformedBoard(t *testing.T) {
+	drawn := strings.Split(ConsoleGUI{opts: ConsoleGUIOptions{mode: renderFull}}.Render(testBoard("W A1 FLG", "B I8 FLG")), "\n")
+	replace := func(from string, to string) []string {
+		lines := slices.Clone(drawn)
+		for i, line := range lines {
+			if strings.Contains(line, from) {
+				lines[i] = strings.Replace(line, from, to, 1)
+				break
+			}
+		}
+		return lines
+	}
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"missing rank", drawn[:len(drawn)-6], "expected 8 ranks, got 7"},
+		{"unknown code", replace("FLG", "XYZ"), `unknown piece code "XYZ" (I8)`},
+		{"unknown player", replace("FLG", "X FLG"), `invalid player "X" (I8)`},
+	}
+	for _, tt := range tests {
+		g, _ := newTestGame()
+		err := g.PasteBoard(tt.lines)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: PasteBoard() = %v, want %q", tt.name, err, tt.want)
+		}
+		if g.status != gamePreSetup {
+			t.Errorf("%s: malformed board started the game", tt.name)
+		}
+	}
+}
+
+func TestRestoreRandomness(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetSeed(42)
+	for i := 0; i < 5; i++ {
+		g.rng.Intn(10)
+	}
+	g.rng.Float64()
+
+	restored, _ := newTestGame()
+	restored.restoreRandomness(g.rngSource.seed, g.rngSource.draws)
+	for i := 0; i < 5; i++ {
+		if got, want := restored.rng.Int63(), g.rng.Int63(); got != want {
+			t.Fatalf("draw %d after restoring = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestBinarySaveKeepsRandomness(t *testing.T) {
+	g, _ := newTestGame()
+	g.SetSeed(42)
+	g.SetScoutPractice(true)
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5")
+	var buf bytes.Buffer
+	if err := g.EncodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _ := newTestGame()
+	loaded.SetScoutPractice(true)
+	if err := loaded.decodeBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	play(g, "MV B3 B4", "MV B6 B5")
+	play(loaded, "MV B3 B4", "MV B6 B5")
+	if loaded.board != g.board {
+		t.Error("loaded game revealed other pieces than the saved one")
+	}
+}
+
+func TestSeedDirective(t *testing.T) {
+	path := writeFile(t, "seeded.gggn", "#@seed 42", "SET W A1 FLG", "SET B I8 FLG")
+	draws := []int64{}
+	for i := 0; i < 2; i++ {
+		g, _ := newTestGame()
+		g.SetSeed(int64(i))
+		if err := g.loadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		draws = append(draws, g.rng.Int63())
+	}
+	if draws[0] != draws[1] {
+		t.Errorf("games loaded from the same seed drew %d, then %d", draws[0], draws[1])
+	}
+
+	g, _ := newTestGame()
+	err := g.loadFile(writeFile(t, "bad.gggn", "#@seed many", "SET W A1 FLG", "SET B I8 FLG"))
+	if err == nil || !strings.Contains(err.Error(), `invalid seed "many" (line 1)`) {
+		t.Errorf("loadFile() = %v, want an error about the seed", err)
+	}
+}
+
+func TestSetGUI(t *testing.T) {
+	g, _ := newTestGame()
+	before := g.gui.(*recordingGUI)
+	play(g, cmdLoadSample)
+	g.DrawBoard()
+
+	after := &recordingGUI{}
+	play(g, cmdHelp)
+	g.SetGUI(after)
+	g.DrawBoard()
+	if len(before.boards) != 1 || len(after.boards) != 1 || after.boards[0] != g.board {
+		t.Errorf("old GUI drew %d boards, new one %d; want 1 each", len(before.boards), len(after.boards))
+	}
+}
+
+func TestManagerSetGUI(t *testing.T) {
+	m := NewGGManager(func() *GG {
+		g, _ := newTestGame()
+		return g
+	})
+	gui := &recordingGUI{}
+	first := m.Current()
+	m.SetGUI(gui)
+	play(first, cmdNewGame)
+	second := m.Current()
+
+	for i, g := range []*GG{first, second} {
+		if g.gui != GUI(gui) {
+			t.Errorf("game %d doesn't draw with the session's GUI", i+1)
+		}
+	}
+}
+
+func TestFlagThreats(t *testing.T) {
+	tests := []struct {
+		name     string
+		fog      bool
+		analysis bool
+		cmd      string
+		want     string
+	}{
+		{"safe", false, false, cmdFlagThreats, "White's Flag on D4 is safe for now.\n"},
+		{"threatened", false, false, cmdFlagThreats, "Threats against White's Flag on D4:\n\t* SGT on D5 captures it\n"},
+		{"fog", true, false, cmdFlagThreats, "\t* Unknown piece on D5 might capture it\n"},
+		{"other side", false, true, cmdFlagThreats + " B", "Black's Flag on I8 is safe for now.\n"},
+		{"other side outside of analysis", false, false, cmdFlagThreats + " B", "Only the side to move's Flag can be looked into outside of analysis mode.\n"},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		g.SetFog(tt.fog)
+		g.SetAnalysis(tt.analysis)
+		g.board = testBoard("W D4 FLG", "B I8 FLG")
+		if tt.name != "safe" {
+			g.board = testBoard("W D4 FLG", "B I8 FLG", "B D5 SGT", "B C4 PVT")
+		}
+		g.status = gameInProgress
+		play(g, tt.cmd)
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%s: output doesn't contain %q:\n%s", tt.name, tt.want, out.String())
+		}
+		if !tt.fog && strings.Contains(out.String(), "C4") {
+			t.Errorf("%s: Private that can't take the Flag listed as a threat:\n%s", tt.name, out.String())
+		}
+	}
+}
+
+func TestHomeSurvivalOnEveryCorner(t *testing.T) {
+	tests := []struct {
+		player     GGPlayer
+		pieces     []string
+		arrive     string
+		corner     string
+		enemyMove  string
+		wantWinner GGPlayer
+	}{
+		{playerWhite, []string{"W A7 FLG", "B B8 SGT", "B E5 FLG"}, "MV A7 A8", "A8", "MV E5 E4", playerWhite},
+		{playerWhite, []string{"W I7 FLG", "B H8 SGT", "B E5 FLG"}, "MV I7 I8", "I8", "MV E5 E4", playerWhite},
+		{playerBlack, []string{"B A2 FLG", "W B1 SGT", "W E4 FLG"}, "MV A2 A1", "A1", "MV E4 E5", playerBlack},
+		{playerBlack, []string{"B I2 FLG", "W H1 SGT", "W E4 FLG"}, "MV I2 I1", "I1", "MV E4 E5", playerBlack},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		g.rules.homeSurvival = true
+		g.board = testBoard(tt.pieces...)
+		g.playerToMove = tt.player
+		g.status = gameInProgress
+		play(g, tt.arrive)
+
+		x, y := coordinatesToSquareAddress(tt.corner)
+		if arrival, ok := g.flagArrivals[tt.player]; !ok || arrival.x != x || arrival.y != y || arrival.ply != 1 {
+			t.Errorf("%s: arrival = %+v, %v; want %s on ply 1", tt.corner, arrival, ok, tt.corner)
+		}
+		if g.status != gameInProgress || !strings.Contains(out.String(), "Flag reached "+tt.corner+" next to an enemy piece") {
+			t.Errorf("%s: Flag won before surviving a turn:\n%s", tt.corner, out.String())
+		}
+
+		play(g, tt.enemyMove)
+		if g.status != gameOver || g.winner != tt.wantWinner || g.endReason != endFlagHome {
+			t.Errorf("%s: status = %s, winner = %q, reason = %q after surviving a turn", tt.corner, g.status, g.winner, g.endReason)
+		}
+	}
+}
+
+func TestHomeSurvivalUnexposedFlagWinsRightAway(t *testing.T) {
+	g, _ := newTestGame()
+	g.rules.homeSurvival = true
+	g.board = testBoard("W E7 FLG", "B A5 SGT", "B I5 FLG")
+	g.status = gameInProgress
+	play(g, "MV E7 E8")
+	if g.status != gameOver || g.winner != playerWhite || len(g.flagArrivals) != 0 {
+		t.Errorf("unexposed Flag didn't win right away: status = %s, arrivals = %v", g.status, g.flagArrivals)
+	}
+}
+
+func TestHomeSurvivalFlagCapturedBeforeWinning(t *testing.T) {
+	g, _ := newTestGame()
+	g.rules.homeSurvival = true
+	g.board = testBoard("W A7 FLG", "B B8 SGT", "B E5 FLG")
+	g.status = gameInProgress
+	play(g, "MV A7 A8", "MV B8 A8")
+	if g.status != gameOver || g.winner != playerBlack || g.endReason != endFlagCaptured {
+		t.Errorf("status = %s, winner = %q, reason = %q; want Black capturing the Flag", g.status, g.winner, g.endReason)
+	}
+}
+
+func TestNormalizeCoordinates(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"MV (1,1) (2,1)", "MV B2 B3"},
+		{"MV B2 (2,1)", "MV B2 B3"},
+		{"SET W (0,0) FLG", "SET W A1 FLG"},
+		{"try MV (1,1) (2,1)", "try MV B2 B3"},
+		{"barrier (3,4)", "barrier E4"},
+		{"MV (8,0) (7,0)", "MV (8,0) A8"},
+		{"MV ((1,1)) (2,1)", "MV ((1,1)) B3"},
+		{"note the Private moved from (1,1) to (2,1)", "note the Private moved from (1,1) to (2,1)"},
+		{"export gggn games/(1,1).gggn", "export gggn games/(1,1).gggn"},
+		{"lint (1,1)", "lint (1,1)"},
+		{"MV  B2 B3", "MV  B2 B3"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeCoordinates(tt.cmd); got != tt.want {
+			t.Errorf("normalizeCoordinates(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestNotations(t *testing.T) {
+	for x := 0; x < rows; x++ {
+		for y := 0; y < files; y++ {
+			algebraic := squareAddressToCoordinates(x, y)
+			if got := normalizeSquare(squareAddressToNumeric(x, y)); got != algebraic {
+				t.Errorf("(%d, %d): numeric square normalizes to %s, want %s", x, y, got, algebraic)
+			}
+			if gotX, gotY := coordinatesToSquareAddress(algebraic); gotX != x || gotY != y {
+				t.Errorf("(%d, %d): %s parses to (%d, %d)", x, y, algebraic, gotX, gotY)
+			}
+		}
+	}
+
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "notation numeric", "MV (2,0) (3,0)", "try MV (5,0) (4,0)", "note from (2,0) to (3,0)")
+	if pieceAt(g, "A4").code != threeStarGeneral {
+		t.Errorf("numeric move not made:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "Squares are now shown in numeric notation (ex: (1,1)).\n") || !strings.Contains(out.String(), "MV (5,0) (4,0) is a legal move.\n") {
+		t.Errorf("squares not shown in numeric notation:\n%s", out.String())
+	}
+	if len(g.notes) != 1 || g.notes[0].text != "from (2,0) to (3,0)" {
+		t.Errorf("note rewritten: %+v", g.notes)
+	}
+}
+
+func TestFlagGuardWarning(t *testing.T) {
+	const warning = "Careful, White's Flag on A1 has no pieces guarding it anymore.\n"
+	tests := []struct {
+		name   string
+		rules  GGRuleSet
+		pieces []string
+		move   string
+		warn   bool
+	}{
+		{"exposed", GGRuleSet{flagGuardWarning: true}, []string{"W A1 FLG", "W A2 PVT"}, "MV A2 A3", true},
+		{"still guarded", GGRuleSet{flagGuardWarning: true}, []string{"W A1 FLG", "W A2 PVT", "W B1 SGT"}, "MV A2 A3", false},
+		{"already unguarded", GGRuleSet{flagGuardWarning: true}, []string{"W A1 FLG", "W D2 PVT"}, "MV D2 D3", false},
+		{"beginner", ruleSetProfiles["beginner"], []string{"W A1 FLG", "W A2 PVT"}, "MV A2 A3", true},
+		{"off", GGRuleSet{}, []string{"W A1 FLG", "W A2 PVT"}, "MV A2 A3", false},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		g.SetRules(tt.rules)
+		g.board = testBoard(append(tt.pieces, "B I8 FLG")...)
+		g.status = gameInProgress
+		play(g, tt.move)
+		if g.ply != 1 {
+			t.Errorf("%s: move not made:\n%s", tt.name, out.String())
+		}
+		if warned := strings.Contains(out.String(), warning); warned != tt.warn {
+			t.Errorf("%s: warned = %v, want %v:\n%s", tt.name, warned, tt.warn, out.String())
+		}
+	}
+}
+
+func TestAtomicBlockCommits(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdAtomic, "SET W A1 FLG", "SET B I8 FLG")
+	if !pieceAt(g, "A1").IsEmpty() {
+		t.Fatal("SET placed before the atomic block ended")
+	}
+
+	play(g, cmdEndAtomic)
+	if !strings.Contains(out.String(), "Atomic block committed, 2 commands run.\n") || pieceAt(g, "A1").code != flag || pieceAt(g, "I8").code != flag {
+		t.Errorf("atomic block not committed:\n%s", out.String())
+	}
+}
+
+func TestAtomicBlockRollsBack(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "SET W A1 FLG")
+	board := g.board
+	play(g, cmdAtomic, "SET W B1 PVT", "SET W C1 XYZ", "SET B I8 FLG", cmdEndAtomic)
+	if !strings.Contains(out.String(), `Atomic block rolled back, command 2 failed: unknown piece code in "SET W C1 XYZ"`) {
+		t.Errorf("output doesn't report the rollback:\n%s", out.String())
+	}
+	if g.board != board {
+		t.Error("failed atomic block changed the board")
+	}
+}
+
+func TestAtomicBlockRejectsOtherCommands(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, "MV A3 A4", cmdAtomic, cmdUndo, cmdHelp, "SET W A5 PVT", cmdEndAtomic)
+	for _, cmd := range []string{cmdUndo, cmdHelp} {
+		if want := fmt.Sprintf("Only SET commands can be in an atomic block, skipping %q. End the block with endatomic first.\n", cmd); !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "Available commands:") || pieceAt(g, "A4").code != threeStarGeneral {
+		t.Error("command inside the atomic block was run")
+	}
+	if !strings.Contains(out.String(), "Atomic block committed, 1 commands run.\n") || pieceAt(g, "A5").code != private {
+		t.Errorf("SET inside the atomic block wasn't committed:\n%s", out.String())
+	}
+}
+
+func TestAtomicBlockMisuse(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdEndAtomic, cmdAtomic, cmdAtomic)
+	for _, want := range []string{"There is no atomic block to end.\n", "An atomic block is already open, end it with endatomic.\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+
+	play(g, cmdExit)
+	if g.status != gameOver {
+		t.Error("exit held by the atomic block")
+	}
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		name   string
+		pieces []string
+		want   string
+	}{
+		{"white up", []string{"W A1 FLG", "W D4 5*G", "B I8 FLG", "B D6 PVT"}, "White is ahead.\n"},
+		{"black up", []string{"W A1 FLG", "W D4 PVT", "B I8 FLG", "B D6 5*G"}, "Black is ahead.\n"},
+		{"even", []string{"W A1 FLG", "B I8 FLG"}, "Evaluation: 0, the position is even.\n"},
+	}
+	for _, tt := range tests {
+		g, out := newTestGame()
+		g.SetAnalysis(true)
+		g.board = testBoard(tt.pieces...)
+		play(g, cmdEval)
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%s: output doesn't contain %q:\n%s", tt.name, tt.want, out.String())
+		}
+		if score := evaluate(g.board, playerWhite); score != -evaluate(g.board, playerBlack) {
+			t.Errorf("%s: White's score %d isn't the opposite of Black's", tt.name, score)
+		}
+	}
+}
+
+func TestEvalOnlyInAnalysisMode(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, cmdEval)
+	if !strings.Contains(out.String(), "The position can only be evaluated in analysis mode.\n") || strings.Contains(out.String(), "Evaluation:") {
+		t.Errorf("position evaluated outside of analysis mode:\n%s", out.String())
+	}
+}
+
+func TestWaitCommand(t *testing.T) {
+	g, out := newTestGame()
+	slept := []time.Duration{}
+	g.SetSleeper(func(d time.Duration) { slept = append(slept, d) })
+	play(g, "wait 1.5s", "wait 500ms", "wait soon", "wait -1s")
+
+	if !slices.Equal(slept, []time.Duration{1500 * time.Millisecond, 500 * time.Millisecond}) {
+		t.Errorf("slept %v, want 1.5s then 500ms", slept)
+	}
+	for _, want := range []string{`invalid duration "soon"`, `invalid duration "-1s"`} {
+		if !strings.Contains(out.String(), "Invalid wait command: "+want) {
+			t.Errorf("output doesn't reject %s:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestWaitDirective(t *testing.T) {
+	g, _ := newTestGame()
+	plies := []int{}
+	g.SetSleeper(func(d time.Duration) {
+		if d != 2*time.Second {
+			t.Errorf("slept %v, want 2s", d)
+		}
+		plies = append(plies, g.ply)
+	})
+	path := writeFile(t, "demo.gggn", append(compareSetup, "MV D3 D4", "#@wait 2s", "MV D6 D5", "#@wait 1s", "#@wait 1s")...)
+	if err := g.loadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(plies, []int{1, 2}) {
+		t.Errorf("paused after plies %v, want 1 and 2", plies)
+	}
+
+	err := g.loadFile(writeFile(t, "bad.gggn", append(compareSetup, "#@wait soon")...))
+	if err == nil || !strings.Contains(err.Error(), `invalid duration "soon"`) {
+		t.Errorf("loadFile() = %v, want an error about the duration", err)
+	}
+}
+
+func TestCount(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLoadSample, cmdCount)
+	for code, n := range roster {
+		if want := fmt.Sprintf("\t%s: %d White, %d Black\n", code, n, n); !strings.Contains(out.String(), want) {
+			t.Errorf("starting armies don't count %q:\n%s", want, out.String())
+		}
+	}
+
+	// White's 3*G on A3 takes Black's 2LT on A6.
+	out.Reset()
+	play(g, "MV A3 A4", "MV B6 B5", "MV A4 A5", "MV B5 B4", "MV A5 A6", cmdCount)
+	for _, want := range []string{"\t3*G: 1 White, 1 Black\n", "\t2LT: 1 White, 0 Black\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't count %q after the capture:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestCountUnderFog(t *testing.T) {
+	g, out := newTestGame()
+	g.SetFog(true)
+	play(g, cmdLoadSample, "MV A3 A4")
+	out.Reset()
+	play(g, cmdCount)
+	if !strings.Contains(out.String(), "Black's pieces on the board:\n\t5*G: 1\n") || strings.Contains(out.String(), "White") {
+		t.Errorf("count gives away White's pieces to Black:\n%s", out.String())
+	}
+}
+
+func TestBarrierBlocksMoves(t *testing.T) {
+	board := testBoard("W A1 FLG", "W D4 PVT", "B I8 FLG")
+	board[4][3].barrier = true
+	if _, err := validateMove(board, playerWhite, newMove("D4", "D5"), GGRuleSet{}); err == nil || err.Error() != "can't move into a barrier" {
+		t.Errorf("validateMove() = %v, want a barrier error", err)
+	}
+}
+
+func TestBarrierCommand(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "SET W A1 FLG", "barrier A1", "barrier D4")
+	if !strings.Contains(out.String(), "A1 is occupied, only empty squares can be barriers.\n") || !strings.Contains(out.String(), "D4 is now a barrier.\n") {
+		t.Errorf("barrier command output:\n%s", out.String())
+	}
+	x, y := coordinatesToSquareAddress("D4")
+	if !g.board[x][y].barrier {
+		t.Fatal("D4 isn't a barrier")
+	}
+
+	play(g, "barrier D4")
+	if g.board[x][y].barrier || !strings.Contains(out.String(), "D4 is no longer a barrier.\n") {
+		t.Errorf("barrier wasn't toggled off:\n%s", out.String())
+	}
+
+	g.status = gameInProgress
+	play(g, "barrier D4")
+	if g.board[x][y].barrier || !strings.Contains(out.String(), "Barriers can only be changed before the game starts.\n") {
+		t.Errorf("barrier changed during the game:\n%s", out.String())
+	}
+}
+
+func TestSetOnBarrier(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "barrier D4", "SET W D4 PVT")
+	if !pieceAt(g, "D4").IsEmpty() || !strings.Contains(out.String(), "Invalid SET command: D4 is a barrier\n") {
+		t.Errorf("SET placed a piece on a barrier:\n%s", out.String())
+	}
+}
+
+func TestAtomicBlockRollsBackOnBarrier(t *testing.T) {
+	g, out := newTestGame()
+	play(g, "barrier D4")
+	board := g.board
+	play(g, cmdAtomic, "SET W A1 FLG", "SET W D4 PVT", "SET B I8 FLG", cmdEndAtomic)
+	if !strings.Contains(out.String(), "Atomic block rolled back, command 2 failed: D4 is a barrier\n") {
+		t.Errorf("output doesn't report the rollback:\n%s", out.String())
+	}
+	if g.board != board {
+		t.Error("atomic block with a SET on a barrier changed the board")
+	}
+}
+
+func TestSetupBlockSkipsBarriers(t *testing.T) {
+	g, out := newTestGame("SET W A1 FLG", "SET W D4 PVT", "done")
+	g.board[3][3].barrier = true
+	g.status = gameSetup
+	play(g, cmdSetup)
+	for _, want := range []string{"Placed 1 pieces.\n", "Skipped 1 invalid lines:\n", "\tline 2: D4 is a barrier\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestBarrierDirectiveRoundTrips(t *testing.T) {
+	g, _ := newTestGame()
+	g.board = GGBoard{}
+	if err := g.loadFile(writeFile(t, "barriers.gggn", "SET W A1 FLG", "SET B I8 FLG", "#@barrier D4 F5")); err != nil {
+		t.Fatal(err)
+	}
+	for _, coordinates := range []string{"D4", "F5"} {
+		x, y := coordinatesToSquareAddress(coordinates)
+		if !g.board[x][y].barrier {
+			t.Errorf("%s isn't a barrier after loading", coordinates)
+		}
+	}
+	if rendered := (ConsoleGUI{opts: ConsoleGUIOptions{mode: renderFull, cellWidth: 5}}).Render(g.board); !strings.Contains(rendered, "|#####|") {
+		t.Error("barriers aren't drawn")
+	}
+
+	exported := &bytes.Buffer{}
+	if err := g.ExportGGGN(exported); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(exported.String(), "#@barrier D4 F5\n") {
+		t.Errorf("export doesn't keep the barriers:\n%s", exported.String())
+	}
+}
+
+// shortPGNGame plays a short game on a small board, which White wins by capturing Black's flag.
+func shortPGNGame(t *testing.T) *GG {
+	t.Helper()
+	g, _ := newTestGame()
+	g.SetClock((&fakeClock{now: time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)}).Now)
+	g.SetPlayerNames("Alice", "")
+	g.board = testBoard("W A1 FLG", "W D3 SGT", "B D5 FLG", "B I8 PVT")
+	g.beginGame()
+	play(g, "MV D3 D4", "MV I8 H8", "MV D4 D5")
+	if g.status != gameOver {
+		t.Fatal("the short game didn't end")
+	}
+	return g
+}
+
+func TestExportPGN(t *testing.T) {
+	g := shortPGNGame(t)
+	path := filepath.Join(t.TempDir(), "game.pgn")
+	play(g, "export pgn "+path)
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[White "Alice"]
+[Black "Black"]
+[Date "2026.10.14"]
+[Result "1-0"]
+[Termination "flag captured"]
+[Position "8BP/9/9/3BF5/9/3WN5/9/WF8 W"]
+
+1. D3-D4 I8-H8 2. D4xD5 1-0
+`
+	if string(got) != want {
+		t.Errorf("exported transcript:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExportPGNBlackFirst(t *testing.T) {
+	g, _ := newTestGame()
+	g.board = testBoard("W A1 FLG", "W D3 SGT", "B I8 FLG", "B D6 PVT")
+	g.playerToMove = playerBlack
+	g.beginGame()
+	play(g, "MV D6 D5", "MV D3 D4")
+
+	exported := &bytes.Buffer{}
+	if err := g.ExportPGN(exported); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(exported.String(), "\n\n1... D6-D5 2. D3-D4 *\n") {
+		t.Errorf("moves aren't numbered from Black's:\n%s", exported.String())
+	}
+}
+
+func TestImportPGNRoundTrip(t *testing.T) {
+	g := shortPGNGame(t)
+	exported := &bytes.Buffer{}
+	if err := g.ExportPGN(exported); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, out := newTestGame()
+	imported.SetPlayerNames("Carol", "Dave")
+	if err := imported.ImportPGN(strings.NewReader(exported.String())); err != nil {
+		t.Fatal(err)
+	}
+	if imported.board != g.board || imported.status != gameOver || imported.winner != playerWhite {
+		t.Errorf("imported game ended differently:\n%s", positionString(imported.board, imported.playerToMove))
+	}
+	if imported.names[playerWhite] != "Alice" || imported.names[playerBlack] != "" {
+		t.Errorf("imported names = %v, want only White's from the transcript", imported.names)
+	}
+
+	// The result is announced with the transcript's names too.
+	imported.ShowResult()
+	if !strings.Contains(out.String(), "Alice (White) wins!") {
+		t.Errorf("result doesn't name the transcript's winner:\n%s", out.String())
+	}
+}
+
+func TestPGNNotesRoundTrip(t *testing.T) {
+	g, _ := newTestGame()
+	g.board = testBoard("W A1 FLG", "W D3 SGT", "B D5 FLG", "B I8 PVT")
+	g.beginGame()
+	play(g, "note a quiet start", "MV D3 D4", "note the Sergeant {finally} advances", "MV I8 H8", "MV D4 D5")
+
+	exported := &bytes.Buffer{}
+	if err := g.ExportPGN(exported); err != nil {
+		t.Fatal(err)
+	}
+	movetext := "\n\n{a quiet start} 1. D3-D4 {the Sergeant {finally) advances} 1... I8-H8 2. D4xD5 1-0\n"
+	if !strings.HasSuffix(exported.String(), movetext) {
+		t.Errorf("exported transcript:\n%s\nwant the moves:%s", exported.String(), movetext)
+	}
+
+	imported, _ := newTestGame()
+	if err := imported.ImportPGN(strings.NewReader(exported.String())); err != nil {
+		t.Fatal(err)
+	}
+	want := []GGNote{{ply: 0, text: "a quiet start"}, {ply: 1, text: "the Sergeant {finally) advances"}}
+	if len(imported.notes) != len(want) {
+		t.Fatalf("imported notes = %+v, want %+v", imported.notes, want)
+	}
+	for i, n := range imported.notes {
+		if n.ply != want[i].ply || n.text != want[i].text {
+			t.Errorf("imported note %d = %+v, want %+v", i, n, want[i])
+		}
+	}
+	if imported.board != g.board {
+		t.Errorf("imported game ended differently:\n%s", positionString(imported.board, imported.playerToMove))
+	}
+}
+
+func TestImportPGNUnterminatedComment(t *testing.T) {
+	g, _ := newTestGame()
+	transcript := "[Position \"8BP/9/9/3BF5/9/3WN5/9/WF8 W\"]\n\n1. D3-D4 {a note\nI8-H8 *\n"
+	if err := g.ImportPGN(strings.NewReader(transcript)); err == nil || !strings.Contains(err.Error(), "unterminated comment") {
+		t.Errorf("error = %v, want an unterminated comment", err)
+	}
+}
+
+func TestImportPGNGolden(t *testing.T) {
+	path := writeFile(t, "game.pgn",
+		`[White "White"]`,
+		`[Black "Bob"]`,
+		`[Date 2026.10.14]`,
+		`[Position "8BP/9/9/3BF5/9/3WN5/9/WF8 W"]`,
+		"",
+		"1. D3-D4 I8-H8 *",
+	)
+	g, out := newTestGame()
+	play(g, "import pgn "+path)
+	for _, want := range []string{`Ignoring malformed tag "[Date 2026.10.14]" (line 3)`, "File " + path + " successfully imported\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if pieceAt(g, "D4").code != sergeant || pieceAt(g, "H8").code != private || g.playerToMove != playerWhite {
+		t.Errorf("imported position = %s", positionString(g.board, g.playerToMove))
+	}
+	if g.names[playerBlack] != "Bob" {
+		t.Errorf("Black's name = %q, want Bob", g.names[playerBlack])
+	}
+}
+
+func TestImportPGNInvalidMove(t *testing.T) {
+	g, _ := newTestGame()
+	board := g.board
+	transcript := "[Position \"8BP/9/9/3BF5/9/3WN5/9/WF8 W\"]\n\n1. D3-D4 I8-H8 2. D4-D6 *\n"
+	err := g.ImportPGN(strings.NewReader(transcript))
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid move D4-D6 (move 2)") {
+		t.Errorf("ImportPGN() = %v, want an error naming move 2", err)
+	}
+	if g.board != board {
+		t.Error("failed import changed the board")
+	}
+}
+
+func TestForks(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdForks)
+	if !strings.Contains(out.String(), "Forks can only be looked for in analysis mode.\n") {
+		t.Errorf("forks looked for outside analysis mode:\n%s", out.String())
+	}
+
+	// White's 5*G can beat the PVT and the SGT, but not the SPY.
+	g.SetAnalysis(true)
+	g.board = testBoard("W A1 FLG", "W E4 5*G", "B I8 FLG", "B E5 PVT", "B F4 SGT", "B D4 SPY")
+	out.Reset()
+	play(g, cmdForks)
+	if got := out.String(); !strings.HasPrefix(got, "Forks for White:\n\t* 5*G on E4 forks ") || !strings.Contains(got, "PVT on E5") || !strings.Contains(got, "SGT on F4") || strings.Contains(got, "SPY") {
+		t.Errorf("fork not detected:\n%s", got)
+	}
+}
+
+func TestNoForks(t *testing.T) {
+	g, out := newTestGame()
+	g.SetAnalysis(true)
+	g.board = testBoard("W A1 FLG", "W E4 PVT", "W A4 SGT", "B I8 FLG", "B E5 5*G", "B F4 4*G", "B A5 PVT")
+	play(g, cmdForks)
+	if !strings.HasPrefix(out.String(), "White has no forks.\n") {
+		t.Errorf("forks output = %q, want none", out.String())
+	}
+}
+
+func TestFlipBoard(t *testing.T) {
+	board := testBoard("W A1 FLG", "B H7 PVT")
+	flipped := flipBoard(board)
+	if flipped[7][8].piece != board[0][0].piece || flipped[1][1].piece != board[6][7].piece {
+		t.Errorf("flipped board = %s", positionString(flipped, playerWhite))
+	}
+	if flipBoard(flipped) != board {
+		t.Error("flipping twice doesn't give the board back")
+	}
+}
+
+func TestAutoFlip(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		g, _ := newTestGame()
+		gui := g.gui.(*recordingGUI)
+		g.SetAutoFlip(enabled)
+		play(g, cmdLoadSample, "MV A3 A4")
+		g.DrawBoard()
+
+		want := g.board
+		if enabled {
+			want = flipBoard(g.board)
+		}
+		if drawn := gui.boards[len(gui.boards)-1]; drawn != want {
+			t.Errorf("auto-flip %v: board drawn for Black = %s", enabled, positionString(drawn, playerWhite))
+		}
+
+		play(g, "MV A6 A5")
+		g.DrawBoard()
+		if drawn := gui.boards[len(gui.boards)-1]; drawn != g.board {
+			t.Errorf("auto-flip %v: board drawn for White = %s", enabled, positionString(drawn, playerWhite))
+		}
+	}
+}
+
+// sampleLines reads the sample setup, one line per element.
+func sampleLines(t *testing.T) []string {
+	t.Helper()
+	sample, err := os.ReadFile(sampleGggnFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(sample), "\n"), "\n")
+}
+
+func TestLintCleanFile(t *testing.T) {
+	g, out := newTestGame()
+	play(g, cmdLint+" "+sampleGggnFile)
+	if !strings.Contains(out.String(), "No problems found in "+sampleGggnFile+".\n") {
+		t.Errorf("sample setup has problems:\n%s", out.String())
+	}
+	if g.status != gamePreSetup || g.board != (GGBoard{}) {
+		t.Error("lint changed the game")
+	}
+}
+
+func TestLintErrorClasses(t *testing.T) {
+	zone := sampleLines(t)
+	zone[slices.Index(zone, "SET W G3 PVT")] = "SET W G4 PVT"
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"syntax", []string{"SET W A1 FLG", "PUT B I8 FLG"}, `line 2: invalid SET command "PUT B I8 FLG"`},
+		{"move syntax", append(compareSetup, "MV D3"), `line 7: invalid move "MV D3"`},
+		{"unknown directive", append([]string{"#@colour W"}, compareSetup...), `line 1: unknown directive "colour"`},
+		{"directive value", append([]string{"#@first X"}, compareSetup...), `line 1: invalid starting player "X"`},
+		{"coordinates", []string{"SET W A1 FLG", "SET W Z9 PVT", "SET B I8 FLG"}, `line 2: invalid coordinates "Z9"`},
+		{"piece code", []string{"SET W A1 FLG", "SET W A2 XYZ", "SET B I8 FLG"}, `line 2: unknown piece code in "SET W A2 XYZ"`},
+		{"duplicate square", []string{"SET W A1 FLG", "SET W A1 PVT", "SET B I8 FLG"}, "line 2: duplicate placement at A1, first set on line 1"},
+		{"setup after moves", append(compareSetup, "MV D3 D4", "SET W A2 PVT"), "line 8: setup after the first move"},
+		{"illegal move", append(compareSetup, "MV D3 D5"), "line 7: invalid move MV D3 D5: can only move one square"},
+		{"barrier", append(compareSetup, "#@barrier D3"), "line 7: barrier on occupied square D3"},
+		{"revealed", append(compareSetup, "#@revealed B D3"), "line 7: no Black piece on D3 to reveal"},
+		{"flag count", []string{"SET W A1 FLG", "SET W C2 FLG", "SET B I8 FLG"}, "White has 2 FLG (only one allowed): A1, C2"},
+		{"roster", []string{"SET W A1 FLG", "SET W A2 SPY", "SET W A3 SPY", "SET W B3 SPY", "SET B I8 FLG"}, "White has 3 SPY"},
+		{"zone", zone, "line 26: White's PVT on G4 is outside of its first 3 ranks"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, _ := newTestGame()
+			problems, err := g.lintFile(strings.NewReader(strings.Join(tt.lines, "\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.ContainsFunc(problems, func(p string) bool { return strings.HasPrefix(p, tt.want) }) {
+				t.Errorf("lintFile() = %q, want a problem starting with %q", problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintListsEveryProblem(t *testing.T) {
+	g, _ := newTestGame()
+	lines := []string{"#@colour W", "SET W A1 FLG", "SET W A1 PVT", "SET W C2 FLG", "SET B A2 XYZ", "SET B I8 FLG"}
+	problems, err := g.lintFile(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`line 1: unknown directive "colour"`,
+		"line 3: duplicate placement at A1, first set on line 2",
+		`line 5: unknown piece code in "SET B A2 XYZ"`,
+		"White has 2 FLG (only one allowed): A1, C2",
+	}
+	if !slices.Equal(problems, want) {
+		t.Errorf("lintFile() = %q, want %q", problems, want)
+	}
+
+	// Loading stops at the first of them.
+	err = g.loadFile(writeFile(t, "bad.gggn", lines...))
+	if err == nil || err.Error() != `unknown directive "colour" (line 1)` {
+		t.Errorf("loadFile() = %v, want the unknown directive", err)
+	}
+}
+
+func TestLoadRejectsInvalidSet(t *testing.T) {
+	g, _ := newTestGame()
+	board := g.board
+	err := g.loadFile(writeFile(t, "bad.gggn", "SET W A1 FLG", "SET W A2 XYZ", "SET B I8 FLG"))
+	if err == nil || err.Error() != `unknown piece code in "SET W A2 XYZ" (line 2)` {
+		t.Errorf("loadFile() = %v, want the unknown piece code", err)
+	}
+	if g.board != board || g.status == gameInProgress {
+		t.Error("failed load changed the game")
+	}
+}
+
+// shuffleSetup is White's and Black's setups, for shuffling White's.
+var shuffleSetup = []string{"W A1 FLG", "W B1 PVT", "W C1 SPY", "W D2 5*G", "W E3 SGT", "W F3 CPT", "B I8 FLG", "B H8 PVT"}
+
+func TestShuffle(t *testing.T) {
+	shuffled := func(seed int64) GGBoard {
+		g, out := newTestGame()
+		g.SetSeed(seed)
+		g.board = testBoard(shuffleSetup...)
+		play(g, cmdShuffle+" W")
+		if !strings.Contains(out.String(), "Shuffled White's 6 pieces.\n") {
+			t.Fatalf("output doesn't report the shuffle:\n%s", out.String())
+		}
+		return g.board
+	}
+
+	// The same pieces stay on the same squares, in another arrangement, and Black's are untouched.
+	before := testBoard(shuffleSetup...)
+	after := shuffled(1)
+	arrangement := func(board GGBoard, player GGPlayer) (squares []string, codes []string) {
+		for x := range board {
+			for y := range board[x] {
+				if piece := board[x][y].piece; piece.player == player {
+					squares = append(squares, squareAddressToCoordinates(x, y))
+					codes = append(codes, string(piece.code))
+				}
+			}
+		}
+		return squares, codes
+	}
+	squaresBefore, codesBefore := arrangement(before, playerWhite)
+	squaresAfter, codesAfter := arrangement(after, playerWhite)
+	if !slices.Equal(squaresAfter, squaresBefore) {
+		t.Errorf("White's pieces are on %v, want %v", squaresAfter, squaresBefore)
+	}
+	if slices.Equal(codesAfter, codesBefore) {
+		t.Error("shuffle left White's setup as it was")
+	}
+	slices.Sort(codesBefore)
+	slices.Sort(codesAfter)
+	if !slices.Equal(codesAfter, codesBefore) {
+		t.Errorf("White's pieces are %v, want %v", codesAfter, codesBefore)
+	}
+	for _, coordinates := range []string{"I8", "H8"} {
+		x, y := coordinatesToSquareAddress(coordinates)
+		if after[x][y] != before[x][y] {
+			t.Errorf("shuffle changed Black's piece on %s", coordinates)
+		}
+	}
+
+	if after != shuffled(1) {
+		t.Error("the same seed shuffled differently")
+	}
+}
+
+func TestShuffleRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		pieces []string
+		status GGGameState
+		want   string
+	}{
+		{"during the game", shuffleSetup, gameInProgress, "Pieces can only be shuffled during setup.\n"},
+		{"outside the ranks", append(slices.Clone(shuffleSetup), "W E5 PVT"), gameSetup, "White's PVT on E5 is outside of its first 3 ranks, unable to shuffle.\n"},
+		{"one piece", []string{"W A1 FLG", "B I8 FLG"}, gameSetup, "White doesn't have enough pieces to shuffle.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, out := newTestGame()
+			g.board = testBoard(tt.pieces...)
+			g.status = tt.status
+			play(g, cmdShuffle+" W")
+			if !strings.Contains(out.String(), tt.want) || g.board != testBoard(tt.pieces...) {
+				t.Errorf("shuffle wasn't refused with %q:\n%s", tt.want, out.String())
+			}
+		})
+	}
+}
+
+func TestTrace(t *testing.T) {
+	trace := &bytes.Buffer{}
+	g, _ := newTestGame()
+	g.SetTrace(trace)
+	play(g, cmdLoadSample, "MV A3 A4", "MV A6 A5", "MV A4 A5", "MV A6 A9")
+
+	lines := strings.Split(strings.TrimSuffix(trace.String(), "\n"), "\n")
+	if len(lines) != g.ply {
+		t.Fatalf("trace has %d positions for %d plies:\n%s", len(lines), g.ply, trace.String())
+	}
+	player := g.events[0].player
+	for i, line := range lines {
+		player = player.Opponent()
+		if want := positionString(g.replay(i+1), player); line != want {
+			t.Errorf("position %d = %q, want %q", i+1, line, want)
+		}
+	}
+
+	// Undoing doesn't trace the moves it replays.
+	play(g, cmdUndo)
+	if g.ply != len(lines)-1 {
+		t.Fatalf("ply = %d after undoing, want %d", g.ply, len(lines)-1)
+	}
+	if got := strings.Count(trace.String(), "\n"); got != len(lines) {
+		t.Errorf("trace has %d positions after undoing, want %d", got, len(lines))
+	}
+}